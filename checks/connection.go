@@ -0,0 +1,214 @@
+package checks
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Connection is an active NetworkManager connection that carries a default route
+type Connection struct {
+	ID string
+	// NetworkManager connection type, e.g. "802-11-wireless" or "gsm"
+	ConnectionType string
+	// Type of the device the connection runs on, e.g. "wifi" or "modem"
+	DeviceType string
+	SSID       string
+	Interfaces []string
+}
+
+// Names for NMDeviceType: https://networkmanager.dev/docs/api/latest/nm-dbus-types.html#NMDeviceType
+var deviceTypes = map[uint32]string{
+	1:  "ethernet",
+	2:  "wifi",
+	5:  "bluetooth",
+	8:  "modem",
+	11: "vlan",
+	13: "bridge",
+	16: "tun",
+	23: "ppp",
+	29: "wireguard",
+	30: "wifi-p2p",
+	32: "loopback",
+}
+
+const (
+	MeteredSkip      = "skip"
+	MeteredCheckOnly = "check-only"
+	MeteredAllow     = "allow"
+)
+
+func ValidateMeteredPolicy(policy string) error {
+	if !slices.Contains([]string{MeteredSkip, MeteredCheckOnly, MeteredAllow}, policy) {
+		return fmt.Errorf("invalid metered policy: %q, expected %s, %s or %s", policy, MeteredSkip, MeteredCheckOnly, MeteredAllow)
+	}
+	return nil
+}
+
+// Metered returns whether the network check ran on a metered connection
+func Metered(checkInfo []Info) bool {
+	for _, info := range checkInfo {
+		if info.Name == "Network" {
+			metered, _ := info.Measured["metered"].(bool)
+			return metered
+		}
+	}
+	return false
+}
+
+type ConnectionPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+func ValidateConnectionRules(rules []string) error {
+	for _, rule := range rules {
+		kind, pattern, found := strings.Cut(rule, ":")
+		if !found || !slices.Contains([]string{"id", "ssid", "type"}, kind) {
+			return fmt.Errorf("invalid connection rule: %q, expected id:<glob>, ssid:<glob> or type:<glob>", rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid connection rule: %q, %w", rule, err)
+		}
+	}
+	return nil
+}
+
+func (c Connection) matches(rule string) bool {
+	kind, pattern, _ := strings.Cut(rule, ":")
+	var values []string
+	switch kind {
+	case "id":
+		values = []string{c.ID}
+	case "ssid":
+		values = []string{c.SSID}
+	case "type":
+		values = []string{c.DeviceType, c.ConnectionType}
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits returns an error if the connection is denied, or not allowed while allow rules are set
+func (p ConnectionPolicy) Permits(c Connection) error {
+	for _, rule := range p.Deny {
+		if c.matches(rule) {
+			return fmt.Errorf("connection %q is denied by rule %q", c.ID, rule)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allow {
+		if c.matches(rule) {
+			return nil
+		}
+	}
+	return fmt.Errorf("connection %q isn't allowed by any rule", c.ID)
+}
+
+func stringProperty(object dbus.BusObject, property string) string {
+	variant, err := object.GetProperty(property)
+	if err != nil {
+		return ""
+	}
+	value, _ := variant.Value().(string)
+	return value
+}
+
+// defaultConnections asks NetworkManager which connections the default IPv4/IPv6 routes go through
+func defaultConnections(conn *dbus.Conn) ([]Connection, error) {
+	nm := conn.Object("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager")
+	variant, err := nm.GetProperty("org.freedesktop.NetworkManager.ActiveConnections")
+	if err != nil {
+		return nil, err
+	}
+	activeConnections, ok := variant.Value().([]dbus.ObjectPath)
+	if !ok {
+		return nil, fmt.Errorf("unable to get active connections from: %v", variant)
+	}
+
+	var connections []Connection
+	for _, activePath := range activeConnections {
+		active := conn.Object("org.freedesktop.NetworkManager", activePath)
+		isDefault := false
+		for _, property := range []string{"Default", "Default6"} {
+			variant, err := active.GetProperty("org.freedesktop.NetworkManager.Connection.Active." + property)
+			if err != nil {
+				continue
+			}
+			if value, ok := variant.Value().(bool); ok && value {
+				isDefault = true
+			}
+		}
+		if !isDefault {
+			continue
+		}
+
+		connection := Connection{
+			ID:             stringProperty(active, "org.freedesktop.NetworkManager.Connection.Active.Id"),
+			ConnectionType: stringProperty(active, "org.freedesktop.NetworkManager.Connection.Active.Type"),
+		}
+
+		variant, err := active.GetProperty("org.freedesktop.NetworkManager.Connection.Active.Devices")
+		if err != nil {
+			return nil, err
+		}
+		devices, ok := variant.Value().([]dbus.ObjectPath)
+		if !ok {
+			return nil, fmt.Errorf("unable to get devices from: %v", variant)
+		}
+		for _, devicePath := range devices {
+			device := conn.Object("org.freedesktop.NetworkManager", devicePath)
+			if variant, err := device.GetProperty("org.freedesktop.NetworkManager.Device.DeviceType"); err == nil && connection.DeviceType == "" {
+				if deviceType, ok := variant.Value().(uint32); ok {
+					connection.DeviceType = deviceTypes[deviceType]
+				}
+			}
+			if connection.SSID == "" {
+				connection.SSID = activeSsid(conn, device)
+			}
+			// IpInterface is the one actually carrying traffic (e.g. ppp0 on top of a modem)
+			for _, property := range []string{"IpInterface", "Interface"} {
+				name := stringProperty(device, "org.freedesktop.NetworkManager.Device."+property)
+				if name != "" {
+					if !slices.Contains(connection.Interfaces, name) {
+						connection.Interfaces = append(connection.Interfaces, name)
+					}
+					break
+				}
+			}
+		}
+		connections = append(connections, connection)
+	}
+	return connections, nil
+}
+
+// activeSsid returns the SSID of the access point a wifi device is connected to, if any
+func activeSsid(conn *dbus.Conn, device dbus.BusObject) string {
+	variant, err := device.GetProperty("org.freedesktop.NetworkManager.Device.Wireless.ActiveAccessPoint")
+	if err != nil {
+		return ""
+	}
+	accessPointPath, ok := variant.Value().(dbus.ObjectPath)
+	if !ok || accessPointPath == "/" {
+		return ""
+	}
+	accessPoint := conn.Object("org.freedesktop.NetworkManager", accessPointPath)
+	variant, err = accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.Ssid")
+	if err != nil {
+		return ""
+	}
+	ssid, _ := variant.Value().([]byte)
+	return string(ssid)
+}
@@ -0,0 +1,144 @@
+package checks
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/session"
+)
+
+type DiskRequirement struct {
+	Path   string
+	Bytes  uint64
+	Module string
+	// Users of a module share the estimate, it's only counted once per filesystem
+	PerUser bool
+}
+
+func installed(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// DiskRequirements maps the estimates of the enabled and installed modules to the paths they write to
+func DiskRequirements(conf *config.Config, users []session.User) []DiskRequirement {
+	estimates := conf.Checks.Hardware.DiskEstimates
+	modules := conf.Modules
+	flatpak := !modules.Flatpak.Disable && installed(modules.Flatpak.BinaryPath)
+	distrobox := !modules.Distrobox.Disable && installed(modules.Distrobox.BinaryPath)
+
+	var requirements []DiskRequirement
+	add := func(path string, module string, bytes uint64, perUser bool) {
+		if bytes == 0 || path == "" {
+			return
+		}
+		requirements = append(requirements, DiskRequirement{path, bytes, module, perUser})
+	}
+
+	if !modules.System.Disable {
+		add("/sysroot", "system", estimates.System, false)
+	}
+	if flatpak {
+		add("/var", "flatpak", estimates.Flatpak, false)
+	}
+	if distrobox {
+		add("/var", "distrobox", estimates.Distrobox, false)
+	}
+	if !modules.Brew.Disable {
+		add(modules.Brew.Prefix, "brew", estimates.Brew, false)
+	}
+	for _, u := range users {
+		info, err := user.LookupId(strconv.Itoa(u.UID))
+		if err != nil {
+			continue
+		}
+		if flatpak {
+			add(info.HomeDir, "flatpak", estimates.Flatpak, true)
+		}
+		if distrobox {
+			add(info.HomeDir, "distrobox", estimates.Distrobox, true)
+		}
+	}
+	return requirements
+}
+
+type filesystem struct {
+	paths    []string
+	modules  []string
+	perUser  []string
+	required uint64
+	free     uint64
+}
+
+// CheckDiskSpace makes sure every filesystem has enough free space for all the requirements on it combined.
+// Per-user requirements of a module only count once per filesystem, paths that don't exist are skipped
+func CheckDiskSpace(requirements []DiskRequirement) error {
+	filesystems := map[uint64]*filesystem{}
+	var order []uint64
+
+	for _, requirement := range requirements {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(requirement.Path, &stat); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("unable to stat %s: %v", requirement.Path, err)
+		}
+
+		device := uint64(stat.Dev)
+		current, exists := filesystems[device]
+		if !exists {
+			var statfs syscall.Statfs_t
+			if err := syscall.Statfs(requirement.Path, &statfs); err != nil {
+				return fmt.Errorf("unable to get free space of %s: %v", requirement.Path, err)
+			}
+			current = &filesystem{free: statfs.Bavail * uint64(statfs.Bsize)}
+			filesystems[device] = current
+			order = append(order, device)
+		}
+		switch {
+		case !requirement.PerUser:
+			current.required += requirement.Bytes
+		case !slices.Contains(current.perUser, requirement.Module):
+			current.perUser = append(current.perUser, requirement.Module)
+			current.required += requirement.Bytes
+		}
+		if !slices.Contains(current.paths, requirement.Path) {
+			current.paths = append(current.paths, requirement.Path)
+		}
+		if !slices.Contains(current.modules, requirement.Module) {
+			current.modules = append(current.modules, requirement.Module)
+		}
+	}
+
+	for _, device := range order {
+		current := filesystems[device]
+		if current.free < current.required {
+			return fmt.Errorf("not enough free space on %s: %d bytes free, %d bytes needed for %s", strings.Join(current.paths, ", "), current.free, current.required, strings.Join(current.modules, ", "))
+		}
+	}
+	return nil
+}
+
+func disk(conf *config.Config) Info {
+	const name string = "Disk"
+
+	// a missing user list only means the home directories don't get checked
+	users, _ := session.ListUsers()
+	requirements := DiskRequirements(conf, users)
+	if len(requirements) == 0 {
+		return skipped(name, "no enabled module needs disk space")
+	}
+	if err := CheckDiskSpace(requirements); err != nil {
+		return failed(name, err, map[string]any{"paths": len(requirements)})
+	}
+	return passed(name, map[string]any{"paths": len(requirements)})
+}
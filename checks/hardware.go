@@ -1,28 +1,128 @@
 package checks
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/shirou/gopsutil/v4/load"
 	"github.com/shirou/gopsutil/v4/mem"
-	"github.com/shirou/gopsutil/v4/net"
 	"github.com/ublue-os/uupd/pkg/config"
 )
 
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+	// The check couldn't tell, e.g. because the service it asks isn't running. Counts as pass or fail depending on the config
+	StatusUnknown Status = "unknown"
+)
+
 type Info struct {
-	Name string
-	Err  error
+	Name   string
+	Status Status
+	Err    error
+	// Values measured by the check, e.g. the battery percentage
+	Measured map[string]any
+}
+
+func passed(name string, measured map[string]any) Info {
+	return Info{
+		Name:     name,
+		Status:   StatusPass,
+		Measured: measured,
+	}
+}
+
+func failed(name string, err error, measured map[string]any) Info {
+	return Info{
+		Name:     name,
+		Status:   StatusFail,
+		Err:      err,
+		Measured: measured,
+	}
+}
+
+func unknown(name string, err error, measured map[string]any) Info {
+	return Info{
+		Name:     name,
+		Status:   StatusUnknown,
+		Err:      err,
+		Measured: measured,
+	}
+}
+
+// serviceMissing reports whether a D-Bus call failed because nothing provides the service, e.g. UPower isn't installed
+func serviceMissing(err error) bool {
+	var name string
+	var dbusErr dbus.Error
+	var dbusErrPtr *dbus.Error
+	switch {
+	case errors.As(err, &dbusErr):
+		name = dbusErr.Name
+	case errors.As(err, &dbusErrPtr):
+		name = dbusErrPtr.Name
+	}
+	return name == "org.freedesktop.DBus.Error.ServiceUnknown" || name == "org.freedesktop.DBus.Error.NameHasNoOwner"
+}
+
+func skipped(name string, reason string) Info {
+	return Info{
+		Name:     name,
+		Status:   StatusSkip,
+		Measured: map[string]any{"reason": reason},
+	}
+}
+
+func (info Info) MarshalJSON() ([]byte, error) {
+	var errString string
+	if info.Err != nil {
+		errString = info.Err.Error()
+	}
+	return json.Marshal(struct {
+		Name     string         `json:"name"`
+		Status   Status         `json:"status"`
+		Error    string         `json:"error,omitempty"`
+		Measured map[string]any `json:"measured,omitempty"`
+	}{info.Name, info.Status, errString, info.Measured})
 }
 
 func Hardware(conn *dbus.Conn) []Info {
 	var checks []Info
 	conf := config.Get()
-	checks = append(checks, battery(conn, conf.Checks.Hardware.BatteryMinPercent))
-	checks = append(checks, network(conn, conf.Checks.Hardware.NetMaxBytes))
-	checks = append(checks, cpu(conf.Checks.Hardware.CpuMaxPercent))
-	checks = append(checks, memory(conf.Checks.Hardware.MemMaxPercent))
+	hw := conf.Checks.Hardware
+	enabled := hw.EnabledChecks
+
+	hardwareChecks := []struct {
+		name    string
+		enabled bool
+		run     func() Info
+	}{
+		{"Battery", enabled.Battery, func() Info { return battery(conn, hw.BatteryMinPercent) }},
+		{"Network", enabled.Network, func() Info { return network(conn, networkConfigFrom(conf)) }},
+		{"CPU", enabled.Cpu, func() Info { return cpu(hw.CpuMaxPercent) }},
+		{"Memory", enabled.Memory, func() Info { return memory(hw.MemMaxPercent) }},
+		{"AC", enabled.Ac, func() Info { return ac(hw.RequireAc) }},
+		{"Thermal", enabled.Thermal, func() Info { return thermal(hw.ThermalMaxCelsius) }},
+		{"Idle", enabled.Idle, func() Info { return idle(conn, hw.RequireIdle, hw.IdleMinSeconds) }},
+		{"Disk", enabled.Disk, func() Info { return disk(conf) }},
+	}
+	for _, check := range hardwareChecks {
+		if !check.enabled {
+			checks = append(checks, skipped(check.name, "disabled in config"))
+			continue
+		}
+		checks = append(checks, check.run())
+	}
 
 	return checks
 }
@@ -32,218 +132,310 @@ func battery(conn *dbus.Conn, min int) Info {
 	upower := conn.Object("org.freedesktop.UPower", "/org/freedesktop/UPower")
 	// first, check if the device is running on battery
 	variant, err := upower.GetProperty("org.freedesktop.UPower.OnBattery")
+	if serviceMissing(err) {
+		return batterySysfs(powerSupplyPath, min)
+	}
 	if err != nil {
-		return Info{
-			name,
-			err,
-		}
+		return failed(name, err, nil)
 	}
 
 	onBattery, ok := variant.Value().(bool)
 	if !ok {
-		return Info{
-			name,
-			fmt.Errorf("unable to determine if this computer is running on battery with: %v", variant),
-		}
+		return failed(name, fmt.Errorf("unable to determine if this computer is running on battery with: %v", variant), nil)
 	}
 	// Not running on battery, skip this test
 	if !onBattery {
-		return Info{
-			name,
-			nil,
-		}
+		return passed(name, map[string]any{"on_battery": false})
 	}
 
 	dev := conn.Object("org.freedesktop.UPower", "/org/freedesktop/UPower/devices/DisplayDevice")
 	variant, err = dev.GetProperty("org.freedesktop.UPower.Device.Percentage")
 	if err != nil {
-		return Info{
-			name,
-			err,
-		}
+		return failed(name, err, map[string]any{"on_battery": true})
 	}
 	batteryPercent, ok := variant.Value().(float64)
 	if !ok {
-		return Info{
-			name,
-			fmt.Errorf("unable to get battery percent from: %v", variant),
-		}
+		return failed(name, fmt.Errorf("unable to get battery percent from: %v", variant), map[string]any{"on_battery": true})
 	}
+	measured := map[string]any{"on_battery": true, "percent": batteryPercent, "min_percent": min}
 	if batteryPercent < float64(min) {
-		return Info{
-			name,
-			fmt.Errorf("battery percent below %d, detected battery percent: %v", min, batteryPercent),
-		}
+		return failed(name, fmt.Errorf("battery percent below %d, detected battery percent: %v", min, batteryPercent), measured)
 	}
 
 	// check if user is running on low power mode
 	powerProfiles := conn.Object("org.freedesktop.UPower.PowerProfiles", "/org/freedesktop/UPower/PowerProfiles")
 	variant, err = powerProfiles.GetProperty("org.freedesktop.UPower.PowerProfiles.ActiveProfile")
+	// power-profiles-daemon is optional, without it there's no power saver mode to respect
+	if serviceMissing(err) {
+		return passed(name, measured)
+	}
 	if err != nil {
-		return Info{
-			name,
-			err,
-		}
+		return failed(name, err, measured)
 	}
 	profile, ok := variant.Value().(string)
 	if !ok {
-		return Info{
-			name,
-			fmt.Errorf("unable to get power profile from: %v", variant),
-		}
+		return failed(name, fmt.Errorf("unable to get power profile from: %v", variant), measured)
 	}
+	measured["power_profile"] = profile
 	if profile == "power-saver" {
-		return Info{
-			name,
-			fmt.Errorf("current power profile is set to 'power-saver'"),
-		}
+		return failed(name, fmt.Errorf("current power profile is set to 'power-saver'"), measured)
 	}
 
-	return Info{
-		name,
-		nil,
-	}
+	return passed(name, measured)
 }
 
-func network_once(conn *dbus.Conn, max uint64) error {
-	nm := conn.Object("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager")
+func memory(max int) Info {
+	const name string = "Memory"
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return failed(name, err, nil)
+	}
+	measured := map[string]any{"used_percent": v.UsedPercent, "max_percent": max}
+	if v.UsedPercent > float64(max) {
+		return failed(name, fmt.Errorf("current memory usage above %d percent: %v", max, v.UsedPercent), measured)
+	}
+	return passed(name, measured)
+}
 
-	variant, err := nm.GetProperty("org.freedesktop.NetworkManager.Metered")
+func cpu(max int) Info {
+	const name string = "CPU"
+	avg, err := load.Avg()
 	if err != nil {
-		return err
+		return failed(name, err, nil)
 	}
-	metered, ok := variant.Value().(uint32)
-	if !ok {
-		return fmt.Errorf("Unable to determine if network connection is metered from: %v", variant)
-	}
-	// The possible values of "Metered" are documented here:
-	// https://networkmanager.dev/docs/api/latest/nm-dbus-types.html//NMMetered
-	//
-	//     NM_METERED_UNKNOWN   = 0 // The metered status is unknown
-	//     NM_METERED_YES       = 1 // Metered, the value was explicitly configured
-	//     NM_METERED_NO        = 2 // Not metered, the value was explicitly configured
-	//     NM_METERED_GUESS_YES = 3 // Metered, the value was guessed
-	//     NM_METERED_GUESS_NO  = 4 // Not metered, the value was guessed
-	//
-	if metered == 1 || metered == 3 {
-		return fmt.Errorf("network is metered")
-	}
-
-	// check if user is connected to network
-	var connectivity uint32
-	err = nm.Call("org.freedesktop.NetworkManager.CheckConnectivity", 0).Store(&connectivity)
+	measured := map[string]any{"load5": avg.Load5, "max_percent": max}
+	// Check if the CPU load in the 5 minutes was greater than 50%
+	if avg.Load5 > float64(max) {
+		return failed(name, fmt.Errorf("CPU load above %d percent: %v", max, avg.Load5), measured)
+	}
+
+	return passed(name, measured)
+}
+
+const (
+	powerSupplyPath = "/sys/class/power_supply"
+	thermalPath     = "/sys/class/thermal"
+)
+
+func readSysfsValue(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	// 4 means fully connected: https://networkmanager.dev/docs/api/latest/nm-dbus-types.html#NMConnectivityState
-	if connectivity != 4 {
-		return fmt.Errorf("network not online")
+// ReadAcState looks for mains power supplies (AC adapters) in a sysfs power_supply directory.
+// present is false when the machine doesn't report any, like most desktops
+func ReadAcState(dir string) (present bool, online bool, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, false, err
 	}
+	for _, entry := range entries {
+		supplyType, err := readSysfsValue(filepath.Join(dir, entry.Name(), "type"))
+		if err != nil || supplyType != "Mains" {
+			continue
+		}
+		present = true
+		value, err := readSysfsValue(filepath.Join(dir, entry.Name(), "online"))
+		if err == nil && value == "1" {
+			return true, true, nil
+		}
+	}
+	return present, false, nil
+}
 
-	// sample the network for 5 seconds
-	s, err := net.IOCounters(false)
+// ReadBatteryState looks for batteries in a sysfs power_supply directory
+// onBattery is only true when there's a discharging battery and no AC adapter is plugged in
+func ReadBatteryState(dir string) (present bool, onBattery bool, percent float64, err error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return false, false, 0, err
 	}
-	current := s[0].BytesRecv
-	var total uint64 = 0
-	for range 5 {
-		time.Sleep(time.Second)
-		s, err := net.IOCounters(false)
+	_, acOnline, _ := ReadAcState(dir)
+	percent = 100
+	for _, entry := range entries {
+		supplyType, err := readSysfsValue(filepath.Join(dir, entry.Name(), "type"))
+		if err != nil || supplyType != "Battery" {
+			continue
+		}
+		// Peripherals (mice, headsets) report batteries too, only count the ones powering the system
+		if scope, err := readSysfsValue(filepath.Join(dir, entry.Name(), "scope")); err == nil && scope == "Device" {
+			continue
+		}
+		present = true
+		status, err := readSysfsValue(filepath.Join(dir, entry.Name(), "status"))
+		if err != nil {
+			return true, false, 0, err
+		}
+		capacity, err := readSysfsValue(filepath.Join(dir, entry.Name(), "capacity"))
 		if err != nil {
-			return err
+			return true, false, 0, err
+		}
+		value, err := strconv.ParseFloat(capacity, 64)
+		if err != nil {
+			return true, false, 0, fmt.Errorf("unable to parse battery capacity: %s", capacity)
+		}
+		percent = min(percent, value)
+		if status == "Discharging" && !acOnline {
+			onBattery = true
 		}
-		new := s[0].BytesRecv
-		total += new - current
-		current = new
 	}
-	netAvg := total / 5
+	return present, onBattery, percent, nil
+}
 
-	if netAvg > max {
-		return fmt.Errorf("network is busy, with above %d bytes received (%v)", max, netAvg)
+func batterySysfs(dir string, min int) Info {
+	const name string = "Battery"
+	present, onBattery, percent, err := ReadBatteryState(dir)
+	measured := map[string]any{"source": "sysfs"}
+	if err != nil {
+		return unknown(name, fmt.Errorf("UPower is not available and the battery state couldn't be read: %v", err), measured)
+	}
+	measured["battery_present"] = present
+	measured["on_battery"] = onBattery
+	if !onBattery {
+		return passed(name, measured)
+	}
+	measured["percent"] = percent
+	measured["min_percent"] = min
+	if percent < float64(min) {
+		return failed(name, fmt.Errorf("battery percent below %d, detected battery percent: %v", min, percent), measured)
 	}
-	return nil
+	return passed(name, measured)
 }
 
-func network(conn *dbus.Conn, max uint64) Info {
-	const name string = "Network"
-
-	// retry if failed (6 retries max)
-	max_retry := 6
-
-	var err error
-	for range max_retry {
-		err = network_once(conn, max)
-		if err == nil {
-			break
-		}
-		// sleep for 3 seconds
-		time.Sleep(time.Second * 3)
+func ac(required bool) Info {
+	const name string = "AC"
+	if !required {
+		return skipped(name, "not required")
 	}
 
-	return Info{
-		name,
-		err,
+	present, online, err := ReadAcState(powerSupplyPath)
+	if err != nil {
+		return failed(name, err, nil)
+	}
+	measured := map[string]any{"adapter_present": present, "online": online}
+	// Machines without an AC adapter are always plugged in
+	if present && !online {
+		return failed(name, fmt.Errorf("AC adapter is not plugged in"), measured)
 	}
+	return passed(name, measured)
 }
 
-func memory(max int) Info {
-	const name string = "Memory"
-	v, err := mem.VirtualMemory()
+// ReadMaxTemperature returns the hottest thermal zone in a sysfs thermal directory, in celsius
+// Zones that can't be read (some firmware reports errors for sensors that are off) are skipped
+func ReadMaxTemperature(dir string) (float64, string, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return Info{
-			name,
-			err,
+		return 0, "", err
+	}
+	var hottest float64
+	var hottestZone string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "thermal_zone") {
+			continue
+		}
+		value, err := readSysfsValue(filepath.Join(dir, entry.Name(), "temp"))
+		if err != nil {
+			continue
+		}
+		millidegrees, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		celsius := float64(millidegrees) / 1000
+		if hottestZone == "" || celsius > hottest {
+			hottest = celsius
+			hottestZone = entry.Name()
+			if zoneType, err := readSysfsValue(filepath.Join(dir, entry.Name(), "type")); err == nil {
+				hottestZone = zoneType
+			}
 		}
 	}
-	if v.UsedPercent > float64(max) {
-		return Info{
-			name,
-			fmt.Errorf("current memory usage above %d percent: %v", max, v.UsedPercent),
+	return hottest, hottestZone, nil
+}
+
+func thermal(max int) Info {
+	const name string = "Thermal"
+	if max <= 0 {
+		return skipped(name, "no maximum temperature set")
+	}
+
+	celsius, zone, err := ReadMaxTemperature(thermalPath)
+	if err != nil {
+		// No thermal zones exposed (e.g. VMs), nothing to check
+		if errors.Is(err, fs.ErrNotExist) {
+			return skipped(name, "no thermal zones")
 		}
+		return failed(name, err, nil)
 	}
-	return Info{
-		name,
-		nil,
+	measured := map[string]any{"celsius": celsius, "zone": zone, "max_celsius": max}
+	if celsius > float64(max) {
+		return failed(name, fmt.Errorf("temperature above %d celsius: %v (%s)", max, celsius, zone), measured)
 	}
+	return passed(name, measured)
 }
 
-func cpu(max int) Info {
-	const name string = "CPU"
-	avg, err := load.Avg()
+func idle(conn *dbus.Conn, required bool, minSeconds int) Info {
+	const name string = "Idle"
+	if !required {
+		return skipped(name, "not required")
+	}
+
+	var sessions []struct {
+		ID   string
+		UID  uint32
+		User string
+		Seat string
+		Path dbus.ObjectPath
+	}
+	login := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	err := login.Call("org.freedesktop.login1.Manager.ListSessions", 0).Store(&sessions)
 	if err != nil {
-		return Info{
-			name,
-			err,
-		}
+		return failed(name, err, nil)
 	}
-	// Check if the CPU load in the 5 minutes was greater than 50%
-	if avg.Load5 > float64(max) {
-		return Info{
-			name,
-			fmt.Errorf("CPU load above %d percent: %v", max, avg.Load5),
+
+	activeSessions := 0
+	for _, s := range sessions {
+		obj := conn.Object("org.freedesktop.login1", s.Path)
+		props := map[string]any{}
+		for _, property := range []string{"Active", "Class", "IdleHint", "IdleSinceHint"} {
+			variant, err := obj.GetProperty("org.freedesktop.login1.Session." + property)
+			if err != nil {
+				return failed(name, err, nil)
+			}
+			props[property] = variant.Value()
+		}
+		active, _ := props["Active"].(bool)
+		class, _ := props["Class"].(string)
+		if !active || class != "user" {
+			continue
 		}
-	}
 
-	return Info{
-		name,
-		nil,
+		activeSessions++
+		idleHint, _ := props["IdleHint"].(bool)
+		if !idleHint {
+			return failed(name, fmt.Errorf("session %s of user %s is in use", s.ID, s.User), map[string]any{"session": s.ID, "user": s.User, "idle": false})
+		}
+		// IdleSinceHint is in microseconds since the epoch
+		idleSince, _ := props["IdleSinceHint"].(uint64)
+		idleFor := time.Since(time.UnixMicro(int64(idleSince)))
+		if idleFor < time.Duration(minSeconds)*time.Second {
+			return failed(name, fmt.Errorf("session %s of user %s has only been idle for %v, needs %ds", s.ID, s.User, idleFor.Round(time.Second), minSeconds), map[string]any{"session": s.ID, "user": s.User, "idle_seconds": int(idleFor.Seconds())})
+		}
 	}
+	return passed(name, map[string]any{"active_sessions": activeSessions})
 }
 
-func RunHwChecks() error {
+// RunHwChecks runs every hardware check, returning all the results and the first failure
+func RunHwChecks() ([]Info, error) {
 	// (some hardware checks require dbus access)
 	conn, err := dbus.SystemBus()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer conn.Close() //nolint:errcheck
 	checkInfo := Hardware(conn)
-	for _, info := range checkInfo {
-		if info.Err != nil {
-			return fmt.Errorf("%s, returned error: %v", info.Name, info.Err)
-		}
-	}
-	return nil
+	return checkInfo, Failure(checkInfo, config.Get().Checks.Hardware.OnUnknown == OnUnknownFail)
 }
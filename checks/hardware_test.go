@@ -0,0 +1,302 @@
+package checks_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/net"
+	"github.com/ublue-os/uupd/checks"
+)
+
+func writeSysfs(t *testing.T, dir string, entry string, values map[string]string) {
+	t.Helper()
+	path := filepath.Join(dir, entry)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("unable to create dir: %s, %v", path, err)
+	}
+	for name, value := range values {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(value+"\n"), 0644); err != nil {
+			t.Fatalf("unable to write file: %s, %v", name, err)
+		}
+	}
+}
+
+func TestAcState(t *testing.T) {
+	dir := t.TempDir()
+	writeSysfs(t, dir, "BAT0", map[string]string{"type": "Battery"})
+
+	present, _, err := checks.ReadAcState(dir)
+	if err != nil {
+		t.Fatalf("unable to read AC state: %v", err)
+	}
+	if present {
+		t.Fatalf("AC adapter detected without one")
+	}
+
+	writeSysfs(t, dir, "AC", map[string]string{"type": "Mains", "online": "0"})
+	present, online, _ := checks.ReadAcState(dir)
+	if !present || online {
+		t.Fatalf("Unplugged AC adapter not detected: present %v, online %v", present, online)
+	}
+
+	writeSysfs(t, dir, "ADP1", map[string]string{"type": "Mains", "online": "1"})
+	if _, online, _ := checks.ReadAcState(dir); !online {
+		t.Fatalf("Plugged in AC adapter not detected")
+	}
+}
+
+func TestBatteryState(t *testing.T) {
+	dir := t.TempDir()
+	writeSysfs(t, dir, "hidpp_battery_0", map[string]string{"type": "Battery", "scope": "Device", "status": "Discharging", "capacity": "5"})
+
+	present, _, _, err := checks.ReadBatteryState(dir)
+	if err != nil {
+		t.Fatalf("unable to read battery state: %v", err)
+	}
+	if present {
+		t.Fatalf("Peripheral battery counted as system battery")
+	}
+
+	writeSysfs(t, dir, "BAT0", map[string]string{"type": "Battery", "status": "Discharging", "capacity": "42"})
+	present, onBattery, percent, err := checks.ReadBatteryState(dir)
+	if err != nil {
+		t.Fatalf("unable to read battery state: %v", err)
+	}
+	if !present || !onBattery || percent != 42 {
+		t.Fatalf("Discharging battery not detected: present %v, on battery %v, percent %v", present, onBattery, percent)
+	}
+
+	writeSysfs(t, dir, "AC", map[string]string{"type": "Mains", "online": "1"})
+	if _, onBattery, _, _ := checks.ReadBatteryState(dir); onBattery {
+		t.Fatalf("On battery while AC adapter is online")
+	}
+
+	writeSysfs(t, dir, "BAT1", map[string]string{"type": "Battery", "status": "Charging", "capacity": "not a number"})
+	if _, _, _, err := checks.ReadBatteryState(dir); err == nil {
+		t.Fatalf("Invalid battery capacity not reported")
+	}
+}
+
+func TestMaxTemperature(t *testing.T) {
+	dir := t.TempDir()
+	writeSysfs(t, dir, "thermal_zone0", map[string]string{"type": "acpitz", "temp": "45000"})
+	writeSysfs(t, dir, "thermal_zone1", map[string]string{"type": "x86_pkg_temp", "temp": "91500"})
+	writeSysfs(t, dir, "thermal_zone2", map[string]string{"type": "broken"})
+	writeSysfs(t, dir, "cooling_device0", map[string]string{"type": "Processor"})
+
+	celsius, zone, err := checks.ReadMaxTemperature(dir)
+	if err != nil {
+		t.Fatalf("unable to read temperatures: %v", err)
+	}
+	if celsius != 91.5 || zone != "x86_pkg_temp" {
+		t.Fatalf("Wrong hottest zone. Expected: 91.5 (x86_pkg_temp), Got: %v (%s)", celsius, zone)
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	small := []checks.DiskRequirement{{Path: dir, Bytes: 1, Module: "system"}}
+	if err := checks.CheckDiskSpace(small); err != nil {
+		t.Fatalf("Small requirement failed: %v", err)
+	}
+
+	// both requirements are on the same filesystem, so they add up
+	huge := []checks.DiskRequirement{
+		{Path: dir, Bytes: math.MaxUint64 / 2, Module: "system"},
+		{Path: filepath.Join(dir, "."), Bytes: math.MaxUint64 / 2, Module: "flatpak"},
+	}
+	if err := checks.CheckDiskSpace(huge); err == nil {
+		t.Fatalf("Huge requirement went through")
+	}
+
+	// the users of a module share a filesystem, only one of them counts
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &statfs); err != nil {
+		t.Fatalf("unable to get free space: %v", err)
+	}
+	share := statfs.Bavail * uint64(statfs.Bsize) / 4 * 3
+	users := []checks.DiskRequirement{
+		{Path: dir, Bytes: share, Module: "flatpak", PerUser: true},
+		{Path: filepath.Join(dir, "."), Bytes: share, Module: "flatpak", PerUser: true},
+	}
+	if err := checks.CheckDiskSpace(users); err != nil {
+		t.Fatalf("Per-user requirement was counted twice: %v", err)
+	}
+
+	missing := []checks.DiskRequirement{{Path: filepath.Join(dir, "bogus"), Bytes: math.MaxUint64, Module: "brew"}}
+	if err := checks.CheckDiskSpace(missing); err != nil {
+		t.Fatalf("Missing path was not skipped: %v", err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	checkInfo := []checks.Info{
+		{Name: "Battery", Status: checks.StatusPass, Measured: map[string]any{"on_battery": false}},
+		{Name: "CPU", Status: checks.StatusFail, Err: errors.New("CPU load above 50 percent: 73.2"), Measured: map[string]any{"load5": 73.2}},
+		{Name: "Idle", Status: checks.StatusSkip, Measured: map[string]any{"reason": "not required"}},
+	}
+
+	if err := checks.Failure(checkInfo, false); err == nil || !strings.Contains(err.Error(), "CPU") {
+		t.Fatalf("Wrong failure reported: %v", err)
+	}
+	if err := checks.Failure(checkInfo[:1], false); err != nil {
+		t.Fatalf("Passing checks reported a failure: %v", err)
+	}
+
+	unknownInfo := []checks.Info{{Name: "Network", Status: checks.StatusUnknown, Err: errors.New("no network service")}}
+	if err := checks.Failure(unknownInfo, false); err != nil {
+		t.Fatalf("Unknown result failed with the pass policy: %v", err)
+	}
+	if err := checks.Failure(unknownInfo, true); err == nil {
+		t.Fatalf("Unknown result passed with the fail policy")
+	}
+
+	var table bytes.Buffer
+	if err := checks.WriteReport(&table, checkInfo, "table"); err != nil {
+		t.Fatalf("unable to write table: %v", err)
+	}
+	for _, expected := range []string{"Battery", "pass", "on_battery=false", "fail", "load5=73.2", "skip", "reason=not required"} {
+		if !strings.Contains(table.String(), expected) {
+			t.Fatalf("Table is missing %q:\n%s", expected, table.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := checks.WriteReport(&out, checkInfo, "json"); err != nil {
+		t.Fatalf("unable to write json: %v", err)
+	}
+	var parsed []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &parsed); err != nil {
+		t.Fatalf("unable to parse json report: %v", err)
+	}
+	if len(parsed) != 3 || parsed[1].Status != "fail" || parsed[1].Error == "" {
+		t.Fatalf("Unexpected json report: %s", out.String())
+	}
+
+	if err := checks.WriteReport(&out, checkInfo, "yaml"); err == nil {
+		t.Fatalf("Unknown format went through")
+	}
+}
+
+func TestSelectInterfaces(t *testing.T) {
+	all := []string{"lo", "enp3s0", "wlp2s0", "podman0", "veth1a2b", "tun0"}
+	exclude := []string{"lo", "podman*", "veth*", "tun*"}
+
+	if selected := checks.SelectInterfaces(all, []string{"wlp2s0"}, nil, exclude); !slices.Equal(selected, []string{"wlp2s0"}) {
+		t.Fatalf("Default route interface not selected: %v", selected)
+	}
+	if selected := checks.SelectInterfaces(all, nil, nil, exclude); !slices.Equal(selected, []string{"enp3s0", "wlp2s0"}) {
+		t.Fatalf("Wrong fallback interfaces: %v", selected)
+	}
+	if selected := checks.SelectInterfaces(all, []string{"wlp2s0"}, []string{"en*"}, exclude); !slices.Equal(selected, []string{"enp3s0"}) {
+		t.Fatalf("Include globs not applied: %v", selected)
+	}
+	// the default route goes over a VPN, sample the interfaces underneath it instead
+	if selected := checks.SelectInterfaces(all, []string{"tun0"}, nil, exclude); !slices.Equal(selected, []string{"enp3s0", "wlp2s0"}) {
+		t.Fatalf("Excluded default route interface was not replaced: %v", selected)
+	}
+	if selected := checks.SelectInterfaces(all, nil, []string{"tun*"}, exclude); len(selected) != 0 {
+		t.Fatalf("Excluded include was selected: %v", selected)
+	}
+}
+
+func TestReceiveRates(t *testing.T) {
+	before := []net.IOCountersStat{{Name: "enp3s0", BytesRecv: 1000}, {Name: "podman0", BytesRecv: 0}, {Name: "wlp2s0", BytesRecv: 500}}
+	after := []net.IOCountersStat{{Name: "enp3s0", BytesRecv: 11000}, {Name: "podman0", BytesRecv: 1 << 30}, {Name: "wlp2s0", BytesRecv: 100}}
+
+	rates := checks.ReceiveRates(before, after, []string{"enp3s0", "wlp2s0"}, 5*time.Second)
+	if rates["enp3s0"] != 2000 {
+		t.Fatalf("Wrong rate for enp3s0. Expected: 2000, Got: %d", rates["enp3s0"])
+	}
+	if _, exists := rates["podman0"]; exists {
+		t.Fatalf("Unselected interface was sampled")
+	}
+	if _, exists := rates["wlp2s0"]; exists {
+		t.Fatalf("Counter reset produced a rate: %d", rates["wlp2s0"])
+	}
+}
+
+func TestConnectionPolicy(t *testing.T) {
+	hotspot := checks.Connection{ID: "Pixel", ConnectionType: "802-11-wireless", DeviceType: "wifi", SSID: "Pixel_1234"}
+	office := checks.Connection{ID: "Office", ConnectionType: "802-11-wireless", DeviceType: "wifi", SSID: "corp"}
+	modem := checks.Connection{ID: "Mobile", ConnectionType: "gsm", DeviceType: "modem"}
+
+	policy := checks.ConnectionPolicy{Deny: []string{"type:modem", "ssid:Pixel*"}}
+	if err := policy.Permits(office); err != nil {
+		t.Fatalf("Connection denied without a matching deny rule: %v", err)
+	}
+	for _, connection := range []checks.Connection{hotspot, modem} {
+		if err := policy.Permits(connection); err == nil {
+			t.Fatalf("Connection %s permitted despite deny rules", connection.ID)
+		}
+	}
+
+	policy = checks.ConnectionPolicy{Allow: []string{"id:Office", "type:gsm"}, Deny: []string{"type:modem"}}
+	if err := policy.Permits(office); err != nil {
+		t.Fatalf("Allowed connection denied: %v", err)
+	}
+	if err := policy.Permits(hotspot); err == nil {
+		t.Fatalf("Connection permitted without a matching allow rule")
+	}
+	if err := policy.Permits(modem); err == nil {
+		t.Fatalf("Deny rules don't take precedence over allow rules")
+	}
+
+	if err := checks.ValidateConnectionRules([]string{"id:Home", "ssid:*", "type:wifi"}); err != nil {
+		t.Fatalf("Valid rules rejected: %v", err)
+	}
+	for _, rule := range []string{"Home", "name:Home", "ssid:[", ""} {
+		if err := checks.ValidateConnectionRules([]string{rule}); err == nil {
+			t.Fatalf("Invalid rule accepted: %q", rule)
+		}
+	}
+}
+
+func TestMetered(t *testing.T) {
+	checkInfo := []checks.Info{
+		{Name: "Battery", Status: checks.StatusPass},
+		{Name: "Network", Status: checks.StatusPass, Measured: map[string]any{"metered": true}},
+	}
+	if !checks.Metered(checkInfo) {
+		t.Fatalf("Metered connection not detected")
+	}
+	checkInfo[1].Measured["metered"] = false
+	if checks.Metered(checkInfo) {
+		t.Fatalf("Unmetered connection detected as metered")
+	}
+	if checks.Metered(nil) {
+		t.Fatalf("Metered without a network check")
+	}
+
+	for _, policy := range []string{checks.MeteredSkip, checks.MeteredCheckOnly, checks.MeteredAllow} {
+		if err := checks.ValidateMeteredPolicy(policy); err != nil {
+			t.Fatalf("Valid metered policy rejected: %v", err)
+		}
+	}
+	if err := checks.ValidateMeteredPolicy("sometimes"); err == nil {
+		t.Fatalf("Invalid metered policy accepted")
+	}
+
+	for _, onUnknown := range []string{checks.OnUnknownPass, checks.OnUnknownFail} {
+		if err := checks.ValidateOnUnknown(onUnknown); err != nil {
+			t.Fatalf("Valid on-unknown value rejected: %v", err)
+		}
+	}
+	if err := checks.ValidateOnUnknown("Fail"); err == nil {
+		t.Fatalf("Invalid on-unknown value accepted")
+	}
+}
@@ -0,0 +1,356 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/shirou/gopsutil/v4/net"
+	"github.com/ublue-os/uupd/pkg/config"
+)
+
+type networkConfig struct {
+	MaxBytes      uint64
+	Include       []string
+	Exclude       []string
+	SampleWindow  time.Duration
+	Retries       int
+	RetryInterval time.Duration
+	Probe         string
+	Policy        ConnectionPolicy
+}
+
+func networkConfigFrom(conf *config.Config) networkConfig {
+	hw := conf.Checks.Hardware
+	return networkConfig{
+		MaxBytes:      hw.NetMaxBytes,
+		Include:       hw.NetInterfacesInclude,
+		Exclude:       hw.NetInterfacesExclude,
+		SampleWindow:  hw.NetSampleWindow,
+		Retries:       hw.NetRetries,
+		RetryInterval: hw.NetRetryInterval,
+		Probe:         hw.ConnectivityProbe,
+		Policy: ConnectionPolicy{
+			Allow: hw.Connections.Allow,
+			Deny:  hw.Connections.Deny,
+		},
+	}
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectInterfaces picks the interfaces to sample out of every interface on the system.
+// The default route interfaces are used unless include globs are set, the exclude globs always apply.
+// Falls back to every interface if nothing told us where the default route is, or if the default route
+// only goes over excluded interfaces (e.g. a full-tunnel VPN).
+func SelectInterfaces(all []string, defaultRoute []string, include []string, exclude []string) []string {
+	var selected []string
+	for _, name := range all {
+		switch {
+		case len(include) > 0:
+			if !matchesAny(include, name) {
+				continue
+			}
+		case len(defaultRoute) > 0:
+			if !slices.Contains(defaultRoute, name) {
+				continue
+			}
+		}
+		if matchesAny(exclude, name) {
+			continue
+		}
+		selected = append(selected, name)
+	}
+	if len(selected) == 0 && len(include) == 0 && len(defaultRoute) > 0 {
+		return SelectInterfaces(all, nil, nil, exclude)
+	}
+	return selected
+}
+
+// upInterfaces leaves out the interfaces that are down, keeping all of them if the flags can't be read
+func upInterfaces(all []string) []string {
+	ifaces, err := stdnet.Interfaces()
+	if err != nil {
+		return all
+	}
+	var up []string
+	for _, name := range all {
+		for _, iface := range ifaces {
+			if iface.Name == name && iface.Flags&stdnet.FlagUp != 0 {
+				up = append(up, name)
+			}
+		}
+	}
+	return up
+}
+
+// ReceiveRates returns the bytes received per second by each of the interfaces between two samples
+func ReceiveRates(before []net.IOCountersStat, after []net.IOCountersStat, interfaces []string, window time.Duration) map[string]uint64 {
+	rates := map[string]uint64{}
+	seconds := window.Seconds()
+	if seconds <= 0 {
+		return rates
+	}
+	for _, end := range after {
+		if !slices.Contains(interfaces, end.Name) {
+			continue
+		}
+		for _, start := range before {
+			// counters can go backwards if the interface got recreated in between samples
+			if start.Name == end.Name && end.BytesRecv >= start.BytesRecv {
+				rates[end.Name] = uint64(float64(end.BytesRecv-start.BytesRecv) / seconds)
+			}
+		}
+	}
+	return rates
+}
+
+type networkSample struct {
+	Source      string
+	Metered     bool
+	Connections []string
+	Interfaces  []string
+	Rates       map[string]uint64
+	Total       uint64
+}
+
+var errUnknownConnectivity = errors.New("no NetworkManager, systemd-networkd or connectivity probe to check the network with")
+
+var errNoInterfaces = errors.New("no network interfaces left to sample after filtering")
+
+var errConnectionDenied = errors.New("connection policy")
+
+type connectivityState struct {
+	// What the state came from: networkmanager, networkd or probe
+	Source       string
+	Online       bool
+	Metered      bool
+	DefaultRoute []string
+	// Only known with NetworkManager
+	Connections []Connection
+}
+
+func networkManagerState(conn *dbus.Conn) (connectivityState, error) {
+	state := connectivityState{Source: "networkmanager"}
+	nm := conn.Object("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager")
+
+	variant, err := nm.GetProperty("org.freedesktop.NetworkManager.Metered")
+	if err != nil {
+		return state, err
+	}
+	metered, ok := variant.Value().(uint32)
+	if !ok {
+		return state, fmt.Errorf("Unable to determine if network connection is metered from: %v", variant)
+	}
+	// The possible values of "Metered" are documented here:
+	// https://networkmanager.dev/docs/api/latest/nm-dbus-types.html//NMMetered
+	//
+	//     NM_METERED_UNKNOWN   = 0 // The metered status is unknown
+	//     NM_METERED_YES       = 1 // Metered, the value was explicitly configured
+	//     NM_METERED_NO        = 2 // Not metered, the value was explicitly configured
+	//     NM_METERED_GUESS_YES = 3 // Metered, the value was guessed
+	//     NM_METERED_GUESS_NO  = 4 // Not metered, the value was guessed
+	//
+	state.Metered = metered == 1 || metered == 3
+
+	// check if user is connected to network
+	var connectivity uint32
+	err = nm.Call("org.freedesktop.NetworkManager.CheckConnectivity", 0).Store(&connectivity)
+	if err != nil {
+		return state, err
+	}
+
+	// 4 means fully connected: https://networkmanager.dev/docs/api/latest/nm-dbus-types.html#NMConnectivityState
+	state.Online = connectivity == 4
+
+	// Not knowing the default route isn't fatal, every interface left after the excludes gets sampled instead
+	state.Connections, _ = defaultConnections(conn)
+	for _, connection := range state.Connections {
+		for _, name := range connection.Interfaces {
+			if !slices.Contains(state.DefaultRoute, name) {
+				state.DefaultRoute = append(state.DefaultRoute, name)
+			}
+		}
+	}
+	return state, nil
+}
+
+// networkdState asks systemd-networkd, which has no notion of metered connections
+func networkdState(conn *dbus.Conn) (connectivityState, error) {
+	state := connectivityState{Source: "networkd"}
+	networkd := conn.Object("org.freedesktop.network1", "/org/freedesktop/network1")
+
+	// OnlineState only exists on newer systemd versions
+	variant, err := networkd.GetProperty("org.freedesktop.network1.Manager.OnlineState")
+	if err == nil {
+		onlineState, ok := variant.Value().(string)
+		if !ok {
+			return state, fmt.Errorf("unable to get online state from: %v", variant)
+		}
+		state.Online = onlineState == "online"
+		return state, nil
+	}
+	if serviceMissing(err) {
+		return state, err
+	}
+
+	variant, err = networkd.GetProperty("org.freedesktop.network1.Manager.OperationalState")
+	if err != nil {
+		return state, err
+	}
+	operationalState, ok := variant.Value().(string)
+	if !ok {
+		return state, fmt.Errorf("unable to get operational state from: %v", variant)
+	}
+	state.Online = operationalState == "routable"
+	return state, nil
+}
+
+// Probe checks connectivity by fetching an http(s) URL or resolving "dns:<hostname>"
+func Probe(target string, timeout time.Duration) error {
+	if hostname, isDns := strings.CutPrefix(target, "dns:"); isDns {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err := stdnet.DefaultResolver.LookupHost(ctx, hostname)
+		return err
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Head(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("probe returned status: %s", resp.Status)
+	}
+	return nil
+}
+
+// connectivity tries NetworkManager, then systemd-networkd and finally the configured probe
+func connectivity(conn *dbus.Conn, probe string) (connectivityState, error) {
+	state, err := networkManagerState(conn)
+	if !serviceMissing(err) {
+		return state, err
+	}
+	state, err = networkdState(conn)
+	if !serviceMissing(err) {
+		return state, err
+	}
+	if probe == "" {
+		return connectivityState{}, errUnknownConnectivity
+	}
+	state = connectivityState{Source: "probe"}
+	state.Online = Probe(probe, 10*time.Second) == nil
+	return state, nil
+}
+
+func network_once(conn *dbus.Conn, conf networkConfig) (networkSample, error) {
+	var sample networkSample
+
+	state, err := connectivity(conn, conf.Probe)
+	sample.Source = state.Source
+	if err != nil {
+		return sample, err
+	}
+	// metered connections are handled per module by the update, see Metered
+	sample.Metered = state.Metered
+	if !state.Online {
+		return sample, fmt.Errorf("network not online")
+	}
+	for _, connection := range state.Connections {
+		sample.Connections = append(sample.Connections, connection.ID)
+		if err := conf.Policy.Permits(connection); err != nil {
+			return sample, fmt.Errorf("%w: %w", errConnectionDenied, err)
+		}
+	}
+
+	// sample the network for the configured window
+	before, err := net.IOCounters(true)
+	if err != nil {
+		return sample, err
+	}
+	var all []string
+	for _, counters := range before {
+		all = append(all, counters.Name)
+	}
+	sample.Interfaces = SelectInterfaces(upInterfaces(all), state.DefaultRoute, conf.Include, conf.Exclude)
+	if len(sample.Interfaces) == 0 {
+		return sample, fmt.Errorf("%w: %v", errNoInterfaces, all)
+	}
+
+	time.Sleep(conf.SampleWindow)
+	after, err := net.IOCounters(true)
+	if err != nil {
+		return sample, err
+	}
+	sample.Rates = ReceiveRates(before, after, sample.Interfaces, conf.SampleWindow)
+	for _, rate := range sample.Rates {
+		sample.Total += rate
+	}
+
+	if sample.Total > conf.MaxBytes {
+		return sample, fmt.Errorf("network is busy, with above %d bytes received (%v)", conf.MaxBytes, sample.Total)
+	}
+	return sample, nil
+}
+
+func network(conn *dbus.Conn, conf networkConfig) Info {
+	const name string = "Network"
+
+	for _, rules := range [][]string{conf.Policy.Allow, conf.Policy.Deny} {
+		if err := ValidateConnectionRules(rules); err != nil {
+			return failed(name, err, nil)
+		}
+	}
+
+	retries := max(conf.Retries, 1)
+
+	var err error
+	var sample networkSample
+	for attempt := range retries {
+		if attempt > 0 {
+			time.Sleep(conf.RetryInterval)
+		}
+		sample, err = network_once(conn, conf)
+		// retrying won't make a network service or an interface appear, or change the connection in use
+		if err == nil || errors.Is(err, errUnknownConnectivity) || errors.Is(err, errNoInterfaces) || errors.Is(err, errConnectionDenied) {
+			break
+		}
+	}
+
+	// on-unknown decides, instead of blocking every run
+	if errors.Is(err, errUnknownConnectivity) || errors.Is(err, errNoInterfaces) {
+		return unknown(name, err, nil)
+	}
+
+	measured := map[string]any{
+		"source":               sample.Source,
+		"metered":              sample.Metered,
+		"connections":          sample.Connections,
+		"interfaces":           sample.Interfaces,
+		"bytes_per_second":     sample.Total,
+		"max_bytes_per_second": conf.MaxBytes,
+	}
+	for iface, rate := range sample.Rates {
+		measured["rate_"+iface] = rate
+	}
+	if err != nil {
+		return failed(name, err, measured)
+	}
+	return passed(name, measured)
+}
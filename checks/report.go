@@ -0,0 +1,106 @@
+package checks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/config"
+)
+
+const (
+	ModeFail = "fail"
+	ModeWait = "wait"
+
+	OnUnknownPass = "pass"
+	OnUnknownFail = "fail"
+)
+
+func ValidateOnUnknown(onUnknown string) error {
+	if onUnknown != OnUnknownPass && onUnknown != OnUnknownFail {
+		return fmt.Errorf("invalid on-unknown value: %q, expected %s or %s", onUnknown, OnUnknownPass, OnUnknownFail)
+	}
+	return nil
+}
+
+// Failure returns the error of the first failed check, unknown results count as failures if unknownFails is set
+func Failure(checkInfo []Info, unknownFails bool) error {
+	for _, info := range checkInfo {
+		if info.Status == StatusFail || (info.Status == StatusUnknown && unknownFails) {
+			return fmt.Errorf("%s, returned error: %v", info.Name, info.Err)
+		}
+	}
+	return nil
+}
+
+// WaitHwChecks polls the hardware checks every interval until they pass or the timeout runs out
+func WaitHwChecks(timeout time.Duration, interval time.Duration) ([]Info, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		checkInfo, err := RunHwChecks()
+		if err == nil {
+			return checkInfo, nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return checkInfo, fmt.Errorf("hardware checks did not pass within %v: %w", timeout, err)
+		}
+		slog.Info("Waiting for hardware checks to pass", slog.Any("error", err), slog.Duration("retry_in", interval), slog.Time("deadline", deadline))
+		time.Sleep(interval)
+	}
+}
+
+// RunHwChecksWithMode runs the hardware checks once in "fail" mode, or waits for them to pass in "wait" mode
+func RunHwChecksWithMode(mode string, timeout time.Duration, interval time.Duration) ([]Info, error) {
+	if err := ValidateOnUnknown(config.Get().Checks.Hardware.OnUnknown); err != nil {
+		return nil, err
+	}
+	switch mode {
+	case ModeWait:
+		return WaitHwChecks(timeout, interval)
+	case ModeFail, "":
+		return RunHwChecks()
+	default:
+		return nil, fmt.Errorf("unknown hardware check mode: %s, expected %s or %s", mode, ModeFail, ModeWait)
+	}
+}
+
+func formatMeasured(measured map[string]any) string {
+	var values []string
+	for _, key := range slices.Sorted(maps.Keys(measured)) {
+		value := measured[key]
+		if number, ok := value.(float64); ok {
+			value = fmt.Sprintf("%.1f", number)
+		}
+		values = append(values, fmt.Sprintf("%s=%v", key, value))
+	}
+	return strings.Join(values, " ")
+}
+
+// WriteReport writes the results of every check as a "table" or as "json"
+func WriteReport(w io.Writer, checkInfo []Info, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(checkInfo)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHECK\tSTATUS\tMEASURED\tERROR") //nolint:errcheck
+		for _, info := range checkInfo {
+			var errString string
+			if info.Err != nil {
+				errString = info.Err.Error()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", info.Name, info.Status, formatMeasured(info.Measured), errString) //nolint:errcheck
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown report format: %s, expected table or json", format)
+	}
+}
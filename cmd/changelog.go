@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/ublue-os/uupd/drv/generic"
+	"github.com/ublue-os/uupd/drv/system"
+	"github.com/ublue-os/uupd/pkg/changelog"
+)
+
+func Changelog(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		slog.Error("Failed to get format flag", "error", err)
+		return err
+	}
+
+	initConfiguration := generic.UpdaterInitConfiguration{}.New()
+	mainSystemDriver, _, _, err := system.InitializeSystemDriver(*initConfiguration)
+	if err != nil {
+		slog.Error("Failed initializing the system driver", slog.Any("error", err))
+		return err
+	}
+
+	log, err := mainSystemDriver.Changelog()
+	if err != nil {
+		slog.Error("Failed getting the changes of the staged update", slog.Any("error", err))
+		return err
+	}
+	return changelog.Write(os.Stdout, log, format)
+}
+
+// logChangelog summarizes what the staged system update changes at the end of a run
+func logChangelog(driver system.SystemUpdateDriver) {
+	log, err := driver.Changelog()
+	if err != nil {
+		slog.Debug("No changelog for the system update", slog.Any("error", err))
+		return
+	}
+	counts := log.Counts()
+	slog.Info("Staged system update, run uupd changelog for details",
+		slog.String("from", log.From),
+		slog.String("to", log.To),
+		slog.Int(changelog.ChangeUpgraded, counts[changelog.ChangeUpgraded]),
+		slog.Int(changelog.ChangeDowngraded, counts[changelog.ChangeDowngraded]),
+		slog.Int(changelog.ChangeAdded, counts[changelog.ChangeAdded]),
+		slog.Int(changelog.ChangeRemoved, counts[changelog.ChangeRemoved]),
+	)
+}
@@ -8,8 +8,37 @@ import (
 	"github.com/spf13/viper"
 )
 
+const redacted = "<redacted>"
+
+// redact hides the secrets of the notification sinks, config-dump runs without root
+func redact(value any, key string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(v))
+		for k, item := range v {
+			if key == "headers" {
+				ret[k] = redacted
+				continue
+			}
+			ret[k] = redact(item, k)
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(v))
+		for i, item := range v {
+			ret[i] = redact(item, key)
+		}
+		return ret
+	case string:
+		if v != "" && (key == "password" || key == "token") {
+			return redacted
+		}
+	}
+	return value
+}
+
 func ConfigDump(cmd *cobra.Command, args []string) error {
-	settings := viper.AllSettings()
+	settings := redact(viper.AllSettings(), "")
 	ret, err := json.MarshalIndent(settings, "", "    ")
 	if err != nil {
 		return err
@@ -2,14 +2,41 @@ package cmd
 
 import (
 	"log/slog"
+	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/ublue-os/uupd/checks"
+	"github.com/ublue-os/uupd/pkg/config"
 )
 
 func HwCheck(cmd *cobra.Command, args []string) error {
+	hw := config.Get().Checks.Hardware
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		slog.Error("Failed to get format flag", "error", err)
+		return err
+	}
+	wait, err := cmd.Flags().GetBool("wait")
+	if err != nil {
+		slog.Error("Failed to get wait flag", "error", err)
+		return err
+	}
+	mode := hw.Mode
+	if cmd.Flags().Changed("wait") {
+		mode = checks.ModeFail
+		if wait {
+			mode = checks.ModeWait
+		}
+	}
+
 	// (some hardware checks require dbus access)
-	err := checks.RunHwChecks()
+	checkInfo, err := checks.RunHwChecksWithMode(mode, hw.WaitTimeout, hw.WaitInterval)
+	if checkInfo != nil {
+		if reportErr := checks.WriteReport(os.Stdout, checkInfo, format); reportErr != nil {
+			slog.Error("Failed writing hardware check report", slog.Any("error", reportErr))
+			return reportErr
+		}
+	}
 	if err != nil {
 		slog.Error("Hardware checks failed", slog.Any("error", err))
 		return err
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/runlog"
+)
+
+// Logs lists the logged runs, the module logs of a run or prints the log of a module
+func Logs(cmd *cobra.Command, args []string) error {
+	conf := config.Get().Logs
+	store := runlog.Store{Dir: conf.Path, Keep: conf.Keep, MaxAge: conf.MaxAge}
+
+	if len(args) == 0 {
+		runs, err := store.Runs()
+		if err != nil {
+			slog.Error("Failed listing runs", slog.String("path", conf.Path), slog.Any("error", err))
+			return err
+		}
+		for _, id := range runs {
+			logs, err := store.Logs(id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%s\n", id, logNames(logs))
+		}
+		return nil
+	}
+
+	id, err := store.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		logs, err := store.Logs(id)
+		if err != nil {
+			return err
+		}
+		for _, log := range logs {
+			fmt.Printf("%s\t%s\n", log.Name, logStatus(log))
+		}
+		return nil
+	}
+
+	logs, err := store.Find(id, args[1])
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if len(logs) > 1 {
+			fmt.Printf("##### %s #####\n", log.Name)
+		}
+		file, err := os.Open(log.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, file)
+		file.Close() //nolint:errcheck
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logStatus(log runlog.Log) string {
+	if log.Failed {
+		return "failed"
+	}
+	return "ok"
+}
+
+// logNames lists the logs of a run, marking the failed ones
+func logNames(logs []runlog.Log) string {
+	var names []string
+	for _, log := range logs {
+		name := log.Name
+		if log.Failed {
+			name += " (failed)"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/notify"
+	"github.com/ublue-os/uupd/pkg/session"
+)
+
+// NotifyPending runs as the user at login, showing the notifications sent while they weren't logged in
+func NotifyPending(cmd *cobra.Command, args []string) error {
+	conf := config.Get().Notifications
+	if !conf.Pending.Enable {
+		return nil
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		slog.Error("Error fetching current user", slog.Any("error", err))
+		return err
+	}
+	uid, err := strconv.Atoi(current.Uid)
+	if err != nil {
+		return err
+	}
+	policy, err := notify.NewPolicy(conf)
+	if err != nil {
+		slog.Error("Invalid notification configuration", slog.Any("error", err))
+		return err
+	}
+	if len(policy.Recipients([]session.User{{UID: uid, Name: current.Username}})) == 0 {
+		slog.Debug("User opted out of notifications", slog.String("user", current.Username))
+		return nil
+	}
+
+	address := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if address == "" {
+		address = notify.UserBusAddress(uid)
+	}
+	notifier, err := notify.Dial(address)
+	if err != nil {
+		slog.Error("Failed connecting to the session bus", slog.Any("error", err))
+		return err
+	}
+	defer notifier.Close() //nolint:errcheck
+
+	statePath, err := notify.StatePath()
+	if err != nil {
+		return err
+	}
+	store := notify.PendingStore{Path: conf.Pending.Path, Expiry: conf.Pending.Expiry}
+	shown, err := notify.DeliverPending(notifier, store, current.Username, statePath, time.Now())
+	if err != nil {
+		slog.Error("Failed showing pending notifications", slog.Any("error", err))
+		return err
+	}
+	slog.Debug("Showed pending notifications", slog.Int("count", shown))
+	return nil
+}
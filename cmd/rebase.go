@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/ublue-os/uupd/drv/generic"
+	"github.com/ublue-os/uupd/drv/system"
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/filelock"
+	"github.com/ublue-os/uupd/pkg/imageref"
+	"github.com/ublue-os/uupd/pkg/percent"
+)
+
+func Rebase(cmd *cobra.Command, args []string) error {
+	lockfile, err := filelock.OpenLockfile(filelock.GetDefaultLockfile())
+	if err != nil {
+		slog.Error("Failed creating and opening lockfile. Is uupd already running?", slog.Any("error", err))
+		return err
+	}
+	defer func(lockfile *os.File) {
+		err := filelock.ReleaseLock(lockfile)
+		if err != nil {
+			slog.Error("Failed releasing lock", slog.Any("error", err))
+		}
+	}(lockfile)
+
+	if err := filelock.AcquireLock(lockfile, filelock.TimeoutConfig{Tries: 5}); err != nil {
+		slog.Error(fmt.Sprintf("%v, is uupd already running?", err))
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		slog.Error("Failed to get dry-run flag", "error", err)
+		return err
+	}
+	applySystem, err := cmd.Flags().GetBool("apply")
+	if err != nil {
+		slog.Error("Failed to get apply flag", "error", err)
+		return err
+	}
+
+	initConfiguration := generic.UpdaterInitConfiguration{}.New()
+	initConfiguration.DryRun = dryRun
+
+	mainSystemDriver, _, _, err := system.InitializeSystemDriver(*initConfiguration)
+	if err != nil {
+		slog.Error("Failed initializing the system driver", slog.Any("error", err))
+		return err
+	}
+
+	booted, err := mainSystemDriver.Image()
+	if err != nil {
+		slog.Error("Failed getting the booted image", slog.Any("error", err))
+		return err
+	}
+
+	var target string
+	channel := config.Get().Modules.System.Channel
+	switch {
+	case len(args) > 0:
+		target = imageref.StripTransport(args[0])
+	case channel != "":
+		target = imageref.WithChannel(booted, channel)
+	default:
+		err := fmt.Errorf("no image given and no update channel configured")
+		slog.Error("Nothing to rebase to", slog.Any("error", err))
+		return err
+	}
+
+	if target == booted {
+		slog.Info("Already on the requested image", slog.String("image", booted))
+		return nil
+	}
+
+	if config.Get().Modules.System.Signature.Enable && !dryRun {
+		if err := system.VerifyImage(mainSystemDriver, target, true); err != nil {
+			slog.Error("Refusing to rebase, image verification failed", slog.String("image", target), slog.Any("error", err))
+			return err
+		}
+	}
+
+	slog.Info("Rebasing", slog.String("from", booted), slog.String("to", target))
+	tracker := percent.NewIncrementer(percent.LogRenderer{}, 1)
+	outputs, err := mainSystemDriver.Rebase(&tracker, target)
+	if err != nil {
+		for _, output := range *outputs {
+			slog.Error("Rebase failed", slog.String("image", target), slog.Any("output", output))
+		}
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	slog.Info("Rebase Completed Successfully, reboot to boot into the new image", slog.String("image", target))
+
+	if applySystem {
+		slog.Info("Applying System Rebase")
+		cmd := exec.Command("/usr/bin/systemctl", "reboot")
+		err := cmd.Run()
+		if err != nil {
+			slog.Error("Failed rebooting machine for rebase", slog.Any("error", err))
+			return err
+		}
+	}
+	return nil
+}
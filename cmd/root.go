@@ -82,10 +82,48 @@ var (
 		SilenceUsage:  true,
 	}
 
+	rebaseCmd = &cobra.Command{
+		Use:           "rebase [image-ref]",
+		Short:         "Switch to another image, or to the configured update channel when no image is given",
+		Args:          cobra.MaximumNArgs(1),
+		PreRun:        assertRoot,
+		RunE:          Rebase,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	changelogCmd = &cobra.Command{
+		Use:           "changelog",
+		Short:         "Show the packages the staged system update changes",
+		PreRun:        assertRoot,
+		RunE:          Changelog,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	logsCmd = &cobra.Command{
+		Use:           "logs [run-id|latest] [module]",
+		Short:         "List the logged runs, the module logs of a run or show the full output of a module",
+		Args:          cobra.MaximumNArgs(2),
+		PreRun:        assertRoot,
+		RunE:          Logs,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	notifyPendingCmd = &cobra.Command{
+		Use:           "notify-pending",
+		Short:         "Show the notifications sent while the current user wasn't logged in, meant for the uupd-notify-pending user unit",
+		RunE:          NotifyPending,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
 	fLogFile    string
 	fLogLevel   string
 	fNoLogging  bool
 	fLogJson    bool
+	fLogFormat  string
 	fConfigPath string
 )
 
@@ -114,7 +152,18 @@ func initLogging() error {
 		return err
 	}
 
-	main_app_logger := slog.New(appLogging.SetupAppLogger(logWriter, logLevel, fLogFile != "-" || fLogJson))
+	handler, err := appLogging.SetupAppLogger(logWriter, logLevel, fLogFile != "-" || fLogJson, fLogFormat)
+	if err != nil {
+		return err
+	}
+	// under systemd the logs go to the journal natively, keeping their attrs as fields
+	if fLogFile == "-" && appLogging.JournalStream(os.Stdout) {
+		journal, err := appLogging.NewJournalHandler(appLogging.JournalSocket, &slog.HandlerOptions{Level: logLevel})
+		if err == nil {
+			handler = journal
+		}
+	}
+	main_app_logger := slog.New(handler)
 
 	if fNoLogging {
 		slog.SetDefault(appLogging.NewMuteLogger())
@@ -142,6 +191,19 @@ func init() {
 	rootCmd.AddCommand(hardwareCheckCmd)
 	rootCmd.AddCommand(imageOutdatedCmd)
 	rootCmd.AddCommand(configDumpCmd)
+	rootCmd.AddCommand(rebaseCmd)
+	rootCmd.AddCommand(changelogCmd)
+	rootCmd.AddCommand(notifyPendingCmd)
+	rootCmd.AddCommand(logsCmd)
+
+	hardwareCheckCmd.Flags().String("format", "table", "Report format: table or json")
+	hardwareCheckCmd.Flags().Bool("wait", false, "Wait for the checks to pass instead of failing right away")
+	hardwareCheckCmd.Flags().Duration("wait-timeout", 0, "How long to wait for the checks to pass")
+	_ = viper.BindPFlag("checks.hardware.wait-timeout", hardwareCheckCmd.Flags().Lookup("wait-timeout"))
+
+	changelogCmd.Flags().String("format", "table", "Output format: table or json")
+	rebaseCmd.Flags().BoolP("dry-run", "n", false, "Only print the image that would be switched to")
+	rebaseCmd.Flags().Bool("apply", false, "Reboot into the new image")
 
 	// config flags
 	rootCmd.Flags().Bool("disable-module-system", false, "Disable the System module")
@@ -149,16 +211,21 @@ func init() {
 	rootCmd.Flags().Bool("disable-module-distrobox", false, "Disable the Distrobox update module")
 	rootCmd.Flags().Bool("disable-module-brew", false, "Disable the Brew update module")
 	rootCmd.Flags().Bool("hw-check", false, "Enable hardware checks before updates (useful for running auto updates)")
+	rootCmd.Flags().IntP("jobs", "j", 1, "Amount of modules updated at the same time")
+	rootCmd.Flags().Bool("download-only", false, "Only download and stage the system update, a later run deploys it")
 
 	_ = viper.BindPFlag("modules.flatpak.disable", rootCmd.Flags().Lookup("disable-module-flatpak"))
 	_ = viper.BindPFlag("modules.brew.disable", rootCmd.Flags().Lookup("disable-module-brew"))
 	_ = viper.BindPFlag("modules.system.disable", rootCmd.Flags().Lookup("disable-module-system"))
 	_ = viper.BindPFlag("modules.distrobox.disable", rootCmd.Flags().Lookup("disable-module-distrobox"))
 	_ = viper.BindPFlag("checks.hardware.enable", rootCmd.Flags().Lookup("hw-check"))
+	_ = viper.BindPFlag("executor.concurrency", rootCmd.Flags().Lookup("jobs"))
+	_ = viper.BindPFlag("modules.system.download-only", rootCmd.Flags().Lookup("download-only"))
 
 	rootCmd.PersistentFlags().BoolVar(&fLogJson, "json", false, "Print logs as json")
 	rootCmd.PersistentFlags().StringVar(&fLogFile, "log-file", "-", "File where user-facing logs will be written to")
 	rootCmd.PersistentFlags().StringVar(&fLogLevel, "log-level", "info", "Log level for user-facing logs")
+	rootCmd.PersistentFlags().StringVar(&fLogFormat, "log-format", appLogging.FormatYAML, "Format of the attributes of user-facing logs: yaml or compact")
 	rootCmd.PersistentFlags().BoolVar(&fNoLogging, "quiet", false, "Make logs quiet")
 
 	// misc
@@ -169,5 +236,7 @@ func init() {
 	rootCmd.Flags().Bool("ci", false, "Makes some modifications to behavior if is running in CI")
 	isTerminal := term.IsTerminal(int(os.Stdout.Fd()))
 	rootCmd.Flags().Bool("disable-progress", !isTerminal, "Disable the GUI progress indicator, automatically disabled when loglevel is debug or in JSON")
+	rootCmd.Flags().String("progress", "auto", "Progress output: auto, fancy, plain (one line per step), osc-only (terminal tab progress) or none")
+	_ = viper.BindPFlag("progress.mode", rootCmd.Flags().Lookup("progress"))
 	rootCmd.Flags().Bool("apply", false, "Reboot if there's an update to the image")
 }
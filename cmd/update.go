@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,16 +18,49 @@ import (
 	drv "github.com/ublue-os/uupd/drv/generic"
 	"github.com/ublue-os/uupd/drv/system"
 
+	"github.com/ublue-os/uupd/pkg/changelog"
 	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/executor"
 	"github.com/ublue-os/uupd/pkg/filelock"
+	"github.com/ublue-os/uupd/pkg/logging"
+	"github.com/ublue-os/uupd/pkg/metrics"
+	"github.com/ublue-os/uupd/pkg/notify"
 	"github.com/ublue-os/uupd/pkg/percent"
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
+	"github.com/ublue-os/uupd/pkg/runlog"
+	"github.com/ublue-os/uupd/pkg/sdnotify"
 	"github.com/ublue-os/uupd/pkg/session"
 )
 
 func Update(cmd *cobra.Command, args []string) error {
+	started := time.Now()
 	conf := config.Get()
 	modules := conf.Modules
 
+	mode, err := progressMode(cmd, conf.Progress.Mode)
+	if err != nil {
+		slog.Error("Invalid progress mode", slog.Any("error", err))
+		return err
+	}
+	renderer, err := percent.NewRenderer(mode, os.Stdout)
+	if err != nil {
+		return err
+	}
+	// the terminal shows whatever the run waits on until the modules run, Stop resets it on every way out
+	defer renderer.Stop()
+
+	// runs that stop before the modules ran, e.g. on failed checks, an invalid configuration or a held lock, are failed runs too
+	metricsWritten := false
+	defer func() {
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); metricsWritten || !conf.Metrics.Enable || dryRun {
+			return
+		}
+		if err := metrics.Write(conf.Metrics.Path, metrics.Run{Finished: time.Now()}); err != nil {
+			slog.Warn("Failed writing metrics", slog.String("path", conf.Metrics.Path), slog.Any("error", err))
+		}
+	}()
+
 	lockfile, err := filelock.OpenLockfile(filelock.GetDefaultLockfile())
 	if err != nil {
 		slog.Error("Failed creating and opening lockfile. Is uupd already running?", slog.Any("error", err))
@@ -38,11 +73,25 @@ func Update(cmd *cobra.Command, args []string) error {
 		}
 	}(lockfile)
 
+	renderer.SetPhase(percent.PhaseWaiting)
 	if err := filelock.AcquireLock(lockfile, filelock.TimeoutConfig{Tries: 5}); err != nil {
 		slog.Error(fmt.Sprintf("%v, is uupd already running?", err))
 		return err
 	}
 
+	// the service counts as started once it holds the lock, the run itself can take hours
+	if err := sdnotify.Ready(); err != nil {
+		slog.Debug("Failed notifying systemd", slog.Any("error", err))
+	}
+	heartbeat := sdnotify.StartHeartbeat(conf.Systemd.StallTimeout)
+	defer heartbeat.Stop()
+	// long steps like upgrading many distroboxes of a user only report progress through their output
+	session.OnOutput = heartbeat.Touch
+	defer func() { session.OnOutput = nil }()
+	runID := runlog.NewRunID(started)
+	logStore := runlog.Store{Dir: conf.Logs.Path, Keep: conf.Logs.Keep, MaxAge: conf.Logs.MaxAge}
+	slog.Info("Starting update run", logging.MessageID(logging.MessageRunStarted), slog.String("run_id", runID))
+
 	hwCheck := conf.Checks.Hardware.Enable
 	dryRun, err := cmd.Flags().GetBool("dry-run")
 	if err != nil {
@@ -54,10 +103,6 @@ func Update(cmd *cobra.Command, args []string) error {
 		slog.Error("Failed to get verbose flag", "error", err)
 		return err
 	}
-	jsonLog := fLogJson
-	logLevel := fLogLevel
-	// We DONT want to display the progress bar when we have JSON logs or when are logs are cluttered/debug (prints out command output)
-	disableProgress := jsonLog || (logLevel != "info")
 	applySystem, err := cmd.Flags().GetBool("apply")
 	if err != nil {
 		slog.Error("Failed to get apply flag", "error", err)
@@ -69,18 +114,65 @@ func Update(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	notifications, err := notify.NewPolicy(conf.Notifications)
+	if err != nil {
+		slog.Error("Invalid notification configuration", slog.Any("error", err))
+		return err
+	}
+
+	for _, retryOn := range [][]string{modules.System.Retry.RetryOn, modules.Flatpak.Retry.RetryOn, modules.Brew.Retry.RetryOn, modules.Distrobox.Retry.RetryOn} {
+		if err := retry.ValidateRetryOn(retryOn); err != nil {
+			slog.Error("Invalid retry configuration", slog.Any("error", err))
+			return err
+		}
+	}
+
+	moduleNames := []string{"system", "brew", "flatpak", "distrobox"}
+	moduleAfter := [][]string{modules.System.After, modules.Brew.After, modules.Flatpak.After, modules.Distrobox.After}
+	for i, name := range moduleNames {
+		if err := executor.ValidateAfter(name, moduleAfter[i], moduleNames); err != nil {
+			slog.Error("Invalid module ordering", slog.Any("error", err))
+			return err
+		}
+	}
+
 	disableModuleSystem := modules.System.Disable
 	disableModuleFlatpak := modules.Flatpak.Disable
 	disableModuleBrew := modules.Brew.Disable
 	disableModuleDistrobox := modules.Distrobox.Disable
 
+	var hwCheckInfo []checks.Info
 	if hwCheck {
-		err := checks.RunHwChecks()
+		hw := conf.Checks.Hardware
+		for _, policy := range []string{hw.Metered.System, hw.Metered.Flatpak, hw.Metered.Distrobox, hw.Metered.Brew} {
+			if err := checks.ValidateMeteredPolicy(policy); err != nil {
+				slog.Error("Invalid hardware check configuration", slog.Any("error", err))
+				return err
+			}
+		}
+		if err := checks.ValidateOnUnknown(hw.OnUnknown); err != nil {
+			slog.Error("Invalid hardware check configuration", slog.Any("error", err))
+			return err
+		}
+		heartbeat.Status("Running hardware checks")
+		if hw.Mode == checks.ModeWait {
+			renderer.SetPhase(percent.PhaseWaiting)
+		} else {
+			renderer.SetPhase(percent.PhaseChecking)
+		}
+		hwCheckInfo, err = checks.RunHwChecksWithMode(hw.Mode, hw.WaitTimeout, hw.WaitInterval)
 		if err != nil {
 			slog.Error("Hardware checks failed", "error", err)
+			users, _ := session.ListUsers()
+			if err := notifications.Send(users, notify.EventChecksSkipped, notify.Data{Error: err.Error()}); err != nil {
+				slog.Debug("Failed showing checks skipped notification", slog.Any("error", err))
+			}
 			return err
 		}
 		slog.Info("Hardware checks passed")
+		if err := notifications.Clear(notify.EventChecksSkipped); err != nil {
+			slog.Warn("Failed clearing pending notifications", slog.Any("error", err))
+		}
 	}
 
 	users, err := session.ListUsers()
@@ -119,7 +211,28 @@ func Update(cmd *cobra.Command, args []string) error {
 	distroboxUpdater.SetUsers(users)
 
 	mainSystemDriver, mainSystemDriverConfig, _, _ := system.InitializeSystemDriver(*initConfiguration)
+	clearSystemNotifications(notifications, mainSystemDriver)
+
+	// moving to another channel happens through a rebase instead of an update
+	systemRebase := ""
+	if modules.System.Channel != "" && !dryRun {
+		current, target, err := system.ChannelImage(mainSystemDriver, modules.System.Channel)
+		switch {
+		case err != nil:
+			slog.Error("Failed resolving the update channel", slog.String("channel", modules.System.Channel), slog.Any("error", err))
+		case target == current:
+		case modules.System.DownloadOnly:
+			// switching deploys the new image right away, which download-only runs must not do
+			slog.Info("Not switching update channel in download-only mode, a later run switches", slog.String("from", current), slog.String("to", target))
+			mainSystemDriverConfig.Enabled = false
+		default:
+			slog.Info("Switching update channel", slog.String("from", current), slog.String("to", target))
+			systemRebase = target
+		}
+	}
 
+	heartbeat.Status("Checking for updates")
+	renderer.SetPhase(percent.PhaseChecking)
 	enableUpd, err := true, nil
 	// if there's no force flag, check for updates
 	if !force {
@@ -128,20 +241,94 @@ func Update(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		slog.Error("Failed checking for updates")
 	}
-	mainSystemDriverConfig.Enabled = mainSystemDriverConfig.Enabled && enableUpd && !disableModuleSystem
+	if !enableUpd && !modules.System.DownloadOnly {
+		pending, err := system.DownloadPending(mainSystemDriver)
+		if err != nil {
+			slog.Debug("Failed checking for downloaded system updates", slog.Any("error", err))
+		}
+		if pending {
+			slog.Info("Deploying the system update downloaded by an earlier run")
+			enableUpd = true
+		}
+	}
+	mainSystemDriverConfig.Enabled = mainSystemDriverConfig.Enabled && (enableUpd || systemRebase != "") && !disableModuleSystem
 
 	slog.Debug("System Updater module status", slog.Bool("enabled", mainSystemDriverConfig.Enabled))
 
+	if checks.Metered(hwCheckInfo) {
+		metered := conf.Checks.Hardware.Metered
+		meteredModules := []struct {
+			policy string
+			config *drv.DriverConfiguration
+			check  func() (bool, error)
+		}{
+			{metered.System, &mainSystemDriverConfig, mainSystemDriver.Check},
+			{metered.Brew, &brewUpdater.Config, brewUpdater.Check},
+			{metered.Flatpak, &flatpakUpdater.Config, flatpakUpdater.Check},
+			{metered.Distrobox, &distroboxUpdater.Config, distroboxUpdater.Check},
+		}
+		for _, module := range meteredModules {
+			if !module.config.Enabled || module.policy == checks.MeteredAllow {
+				continue
+			}
+			module.config.Enabled = false
+			if module.policy == checks.MeteredSkip {
+				slog.Info("Skipping module on metered connection", slog.String("module_name", module.config.Title))
+				continue
+			}
+			available, err := module.check()
+			if err != nil {
+				slog.Error("Failed checking for updates", slog.String("module_name", module.config.Title), slog.Any("error", err))
+				continue
+			}
+			slog.Info("Only checked for updates on metered connection", slog.String("module_name", module.config.Title), slog.Bool("updates_available", available))
+		}
+	}
+
 	totalSteps := brewUpdater.Steps() + flatpakUpdater.Steps() + distroboxUpdater.Steps()
 	if mainSystemDriverConfig.Enabled {
 		totalSteps += mainSystemDriver.Steps()
 	}
 
-	tracker := percent.NewIncrementer(!disableProgress, totalSteps)
-	if !disableProgress {
-		percent.ResetOscProgress()
-		go tracker.ProgressWriter.Render()
+	// the overall progress follows how much every module downloads, as far as the drivers can tell
+	estimators := []struct {
+		name     string
+		enabled  bool
+		estimate func() ([]float64, error)
+	}{
+		{"system", mainSystemDriverConfig.Enabled, mainSystemDriver.Estimate},
+		{"brew", brewUpdater.Config.Enabled, brewUpdater.Estimate},
+		{"flatpak", flatpakUpdater.Config.Enabled, flatpakUpdater.Estimate},
+		{"distrobox", distroboxUpdater.Config.Enabled, distroboxUpdater.Estimate},
 	}
+	var estimates [][]float64
+	for _, estimator := range estimators {
+		var weights []float64
+		if estimator.enabled {
+			var err error
+			if weights, err = estimator.estimate(); err != nil {
+				slog.Debug("No progress estimate", slog.String("module", estimator.name), slog.Any("error", err))
+			}
+		}
+		estimates = append(estimates, weights)
+	}
+	resolvedWeights, totalWeight := percent.ResolveWeights(estimates)
+	moduleWeights := map[string][]float64{}
+	for i, estimator := range estimators {
+		moduleWeights[estimator.name] = resolvedWeights[i]
+	}
+
+	tracker := percent.NewIncrementer(renderer, totalSteps)
+	tracker.TotalWeight = totalWeight
+	tracker.OnStatus = heartbeat.ModuleStatus
+	restoreLogs := func() {}
+	// log lines go above the progress bars instead of through them
+	if fancy, ok := renderer.(*percent.FancyRenderer); ok {
+		if handler, ok := slog.Default().Handler().(*logging.UserHandler); ok {
+			restoreLogs = handler.Redirect(fancy.Log)
+		}
+	}
+	renderer.Start()
 
 	var outputs = []drv.CommandOutput{}
 
@@ -151,56 +338,109 @@ func Update(cmd *cobra.Command, args []string) error {
 	}
 	if systemOutdated {
 		const OUTDATED_WARNING = "There hasn't been an update in over a month. Consider rebooting or running updates manually"
-		err := session.Notify(users, "System Warning", OUTDATED_WARNING, "critical")
+		err := notifications.Send(users, notify.EventImageOutdated, notify.Data{Modules: mainSystemDriverConfig.Title})
 		if err != nil {
-			slog.Error("Failed showing warning notification")
+			slog.Error("Failed showing warning notification", slog.Any("error", err))
 		}
 		slog.Warn(OUTDATED_WARNING)
+	} else if err == nil {
+		if err := notifications.Clear(notify.EventImageOutdated); err != nil {
+			slog.Warn("Failed clearing pending notifications", slog.Any("error", err))
+		}
+	}
+
+	if conf.Limits.Enable && !dryRun {
+		for _, limits := range []resources.Limits{mainSystemDriverConfig.Limits, brewUpdater.Config.Limits, flatpakUpdater.Config.Limits, distroboxUpdater.Config.Limits} {
+			if err := limits.Validate(); err != nil {
+				slog.Error("Invalid resource limits", slog.String("module", limits.Module), slog.Any("error", err))
+				return err
+			}
+		}
+		if conf.Limits.NetworkMaxBytes > 0 {
+			removeNetworkLimit, err := resources.LimitNetwork(conf.Limits.Slice, conf.Limits.NetworkMaxBytes)
+			if err != nil {
+				slog.Warn("Failed limiting network bandwidth, continuing without the limit", slog.Any("error", err))
+			}
+			defer removeNetworkLimit()
+		}
 	}
 
 	// This section is ugly but we cant really do much about it.
 	// Using interfaces doesn't preserve the "Config" struct state and I dont know any other way to make this work without cursed workarounds.
+	var jobs []executor.Job
+	var jobOutputs [][]drv.CommandOutput
+	var jobDurations []time.Duration
+
+	addJob := func(name string, after []string, config drv.DriverConfiguration, update func(tracker *percent.Incrementer) (*[]drv.CommandOutput, error)) {
+		index := len(jobOutputs)
+		jobOutputs = append(jobOutputs, nil)
+		jobDurations = append(jobDurations, 0)
+		jobs = append(jobs, executor.Job{
+			Name:  name,
+			After: after,
+			Run: func() error {
+				slog.Debug(fmt.Sprintf("%s module", config.Title), slog.String("module_name", config.Title), slog.Any("module_configuration", config))
+				moduleTracker := tracker.ForkWeighted(moduleWeights[name])
+				if !config.MultiUser {
+					moduleTracker.ReportStatusChange(config.Title, config.Description)
+				}
+				// Pass in the tracker manually because setting it in the config is less possible
+				started := time.Now()
+				out, err := update(moduleTracker)
+				jobDurations[index] = time.Since(started)
+				jobOutputs[index] = *out
+				if conf.Logs.Enable && !dryRun {
+					writeRunLogs(logStore, runID, name, *out)
+				}
+				moduleTracker.IncrementSection(err)
+				return err
+			},
+		})
+	}
 
 	if mainSystemDriverConfig.Enabled {
-		slog.Debug(fmt.Sprintf("%s module", mainSystemDriverConfig.Title), slog.String("module_name", mainSystemDriverConfig.Title), slog.Any("module_configuration", mainSystemDriverConfig))
-		tracker.ReportStatusChange(mainSystemDriverConfig.Title, mainSystemDriverConfig.Description)
-		var out *[]drv.CommandOutput
-		// Pass in the tracker manually because setting it in the config is less possible
-		out, err = mainSystemDriver.Update(&tracker)
-		outputs = append(outputs, *out...)
-		tracker.IncrementSection(err)
+		systemUpdate := mainSystemDriver.Update
+		if modules.System.DownloadOnly {
+			systemUpdate = mainSystemDriver.Fetch
+		}
+		if systemRebase != "" {
+			systemUpdate = func(tracker *percent.Incrementer) (*[]drv.CommandOutput, error) {
+				return mainSystemDriver.Rebase(tracker, systemRebase)
+			}
+		}
+		if modules.System.Signature.Enable && !dryRun {
+			systemUpdate = verifiedSystemUpdate(mainSystemDriver, systemRebase, systemUpdate)
+		}
+		addJob("system", modules.System.After, mainSystemDriverConfig, systemUpdate)
 	}
-
 	if brewUpdater.Config.Enabled {
-		slog.Debug(fmt.Sprintf("%s module", brewUpdater.Config.Title), slog.String("module_name", brewUpdater.Config.Title), slog.Any("module_configuration", brewUpdater.Config))
-		tracker.ReportStatusChange(brewUpdater.Config.Title, brewUpdater.Config.Description)
-		var out *[]drv.CommandOutput
-		out, err = brewUpdater.Update(&tracker)
-		outputs = append(outputs, *out...)
-		tracker.IncrementSection(err)
+		addJob("brew", modules.Brew.After, brewUpdater.Config, brewUpdater.Update)
 	}
-
 	if flatpakUpdater.Config.Enabled {
-		slog.Debug(fmt.Sprintf("%s module", flatpakUpdater.Config.Title), slog.String("module_name", flatpakUpdater.Config.Title), slog.Any("module_configuration", flatpakUpdater.Config))
-		var out *[]drv.CommandOutput
-		out, err = flatpakUpdater.Update(&tracker)
-		outputs = append(outputs, *out...)
-		tracker.IncrementSection(err)
+		addJob("flatpak", modules.Flatpak.After, flatpakUpdater.Config, flatpakUpdater.Update)
 	}
-
 	if distroboxUpdater.Config.Enabled {
-		slog.Debug(fmt.Sprintf("%s module", distroboxUpdater.Config.Title), slog.String("module_name", distroboxUpdater.Config.Title), slog.Any("module_configuration", distroboxUpdater.Config))
-		var out *[]drv.CommandOutput
-		out, err = distroboxUpdater.Update(&tracker)
-		outputs = append(outputs, *out...)
-		tracker.IncrementSection(err)
+		addJob("distrobox", modules.Distrobox.After, distroboxUpdater.Config, distroboxUpdater.Update)
 	}
 
-	if !disableProgress {
-		tracker.ProgressWriter.Stop()
-		time.Sleep(time.Millisecond * 100)
-		percent.ResetOscProgress()
+	jobErrors, err := executor.Run(jobs, conf.Executor.Concurrency)
+	if err != nil {
+		slog.Error("Invalid module ordering", slog.Any("error", err))
+		return err
 	}
+	for i := range jobs {
+		outputs = append(outputs, jobOutputs[i]...)
+		// keep the error of the last module around, like running them one after another would
+		err = jobErrors[i]
+	}
+	if conf.Logs.Enable && !dryRun {
+		if _, err := logStore.Prune(time.Now()); err != nil {
+			slog.Warn("Failed removing old module logs", slog.String("path", conf.Logs.Path), slog.Any("error", err))
+		}
+	}
+
+	renderer.Stop()
+	restoreLogs()
 	if verboseRun {
 		slog.Info("Verbose run requested")
 
@@ -211,31 +451,116 @@ func Update(cmd *cobra.Command, args []string) error {
 
 	var failures = []drv.CommandOutput{}
 	var contexts = []string{}
+	var failureErrors = []string{}
 	for _, output := range outputs {
 		if output.Failure {
 			failures = append(failures, output)
 			contexts = append(contexts, output.Context)
+			if output.Stderr != nil {
+				failureErrors = append(failureErrors, output.Stderr.Error())
+			}
+		}
+	}
+
+	report := runReport(started, outputs, dryRun)
+	if mainSystemDriverConfig.Enabled && !dryRun {
+		systemReport(&report, mainSystemDriver)
+	}
+	if err := notifications.Report(report); err != nil {
+		slog.Warn("Failed sending the run report", slog.Any("error", err))
+	}
+	metricsWritten = true
+	if conf.Metrics.Enable && !dryRun {
+		run := metrics.Run{Finished: time.Now(), Success: len(failures) == 0}
+		for i, job := range jobs {
+			success := jobErrors[i] == nil && !slices.ContainsFunc(jobOutputs[i], func(output drv.CommandOutput) bool { return output.Failure })
+			run.Modules = append(run.Modules, metrics.Module{Name: job.Name, Duration: jobDurations[i], Success: success})
+		}
+		systemMetrics(&run, mainSystemDriver)
+		if err := metrics.Write(conf.Metrics.Path, run); err != nil {
+			slog.Warn("Failed writing metrics", slog.String("path", conf.Metrics.Path), slog.Any("error", err))
 		}
 	}
 
 	if len(failures) > 0 {
+		heartbeat.Status(fmt.Sprintf("Updates failed: %s", strings.Join(contexts, ", ")))
 		slog.Warn("Exited with failed updates.")
 
 		for _, output := range failures {
 			slog.Error("module_fail",
+				logging.MessageID(logging.MessageModuleFailed),
 				slog.Any("output", output),
 				slog.String("module", output.Context),
 				slog.String("cli", strings.Join(output.Cli, " ")),
 			)
 		}
-		_ = session.Notify(users, "Some System Updates Failed", fmt.Sprintf("Systems Failed: %s", strings.Join(contexts, ", ")), "critical")
+		failed := notify.Data{Modules: strings.Join(contexts, ", "), Count: len(contexts), Error: strings.Join(failureErrors, "; ")}
+		if err := notifications.Send(users, notify.EventModuleFailed, failed); err != nil {
+			slog.Debug("Failed showing failure notification", slog.Any("error", err))
+		}
 
-		slog.Error("Updates finished with errors!")
+		if conf.Logs.Enable && !dryRun {
+			slog.Error("Updates finished with errors! Run uupd logs for the full output", slog.String("run_id", runID))
+		} else {
+			slog.Error("Updates finished with errors!")
+		}
 		return err
 	}
 
 	slog.Info("Updates Completed Successfully")
-	if applySystem && mainSystemDriverConfig.Enabled {
+	heartbeat.Status("Updates completed")
+	if err := notifications.Clear(notify.EventModuleFailed); err != nil {
+		slog.Warn("Failed clearing pending notifications", slog.Any("error", err))
+	}
+	if mainSystemDriverConfig.Enabled && !dryRun {
+		logChangelog(mainSystemDriver)
+		if !modules.System.DownloadOnly {
+			slog.Info("System update deployed, reboot to apply it", logging.MessageID(logging.MessageRebootRequired))
+		}
+	}
+
+	if mainSystemDriverConfig.Enabled && !dryRun && !applySystem && !modules.System.DownloadOnly && notifications.Enabled(notify.EventRebootPending) {
+		done := func() {}
+		// the prompt can outlast the stall timeout, without that meaning the run is stuck
+		if conf.Notifications.ActionTimeout > 0 {
+			done = heartbeat.Wait("Waiting for users to answer the reboot prompt")
+		}
+		applySystem = promptReboot(notifications, users, mainSystemDriver, conf.Notifications.ActionTimeout)
+		done()
+	}
+	if !applySystem && !modules.System.DownloadOnly {
+		return nil
+	}
+	systemStaged, err := mainSystemDriver.Staged()
+	if err != nil {
+		slog.Error("Failed checking for staged system updates", slog.Any("error", err))
+	}
+	if modules.System.DownloadOnly {
+		if applySystem {
+			slog.Warn("Not applying the system update in download-only mode")
+		}
+		if systemStaged {
+			slog.Info("System update downloaded, run without download-only to deploy it", logging.MessageID(logging.MessageUpdateStaged))
+		} else {
+			slog.Info("No system update downloaded")
+		}
+		if mainSystemDriverConfig.Enabled && systemStaged && !dryRun && notifications.Enabled(notify.EventUpdateStaged) {
+			if err := notifications.Send(users, notify.EventUpdateStaged, updateData(mainSystemDriver)); err != nil {
+				slog.Debug("Failed showing staged update notification", slog.Any("error", err))
+			}
+		}
+		return nil
+	}
+
+	if !applySystem {
+		return nil
+	}
+	// download-only deployments don't get applied on reboot, only deployed ones (from this run or an earlier one) do
+	rebootRequired, err := mainSystemDriver.RebootRequired()
+	if err != nil {
+		slog.Error("Failed checking for pending deployments", slog.Any("error", err))
+	}
+	if rebootRequired {
 		slog.Info("Applying System Update")
 		cmd := exec.Command("/usr/bin/systemctl", "reboot")
 		err := cmd.Run()
@@ -246,3 +571,194 @@ func Update(cmd *cobra.Command, args []string) error {
 	}
 	return nil
 }
+
+// writeRunLogs keeps the full output of a module, in one file per user for multi-user modules
+func writeRunLogs(store runlog.Store, id string, module string, outputs []drv.CommandOutput) {
+	for _, output := range outputs {
+		entry := runlog.Entry{Context: output.Context, Cli: output.Cli, Failure: output.Failure, Error: output.Stderr, Output: output.Stdout}
+		if err := store.Write(id, module, output.User, entry); err != nil {
+			slog.Warn("Failed writing module log", slog.String("module", module), slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// progressMode resolves the auto mode: progress bars on terminals, nothing when the logs are JSON or full of command output
+func progressMode(cmd *cobra.Command, mode string) (string, error) {
+	if err := percent.ValidateMode(mode); err != nil {
+		return "", err
+	}
+	disableProgress, err := cmd.Flags().GetBool("disable-progress")
+	if err != nil {
+		return "", err
+	}
+	if cmd.Flags().Changed("disable-progress") && disableProgress {
+		return percent.ModeNone, nil
+	}
+	if mode != percent.ModeAuto {
+		return mode, nil
+	}
+	if disableProgress || fLogJson || fLogLevel != "info" {
+		return percent.ModeNone, nil
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return percent.ModePlain, nil
+	}
+	return percent.ModeFancy, nil
+}
+
+// runReport describes the outcome of every module for the webhook and push sinks
+func runReport(started time.Time, outputs []drv.CommandOutput, dryRun bool) notify.Report {
+	hostname, _ := os.Hostname()
+	report := notify.Report{Hostname: hostname, Started: started, Finished: time.Now(), DryRun: dryRun, Success: true}
+	for _, output := range outputs {
+		result := notify.ModuleResult{Context: output.Context, Failure: output.Failure, Cli: output.Cli, Output: output.Stdout}
+		if output.Stderr != nil {
+			result.Error = output.Stderr.Error()
+		}
+		report.Success = report.Success && !output.Failure
+		report.Modules = append(report.Modules, result)
+	}
+	return report
+}
+
+// systemMetrics adds the state of the system image to the metrics, leaving out what can't be determined
+func systemMetrics(run *metrics.Run, driver system.SystemUpdateDriver) {
+	var err error
+	if run.ImageTimestamp, err = driver.ImageTimestamp(); err != nil {
+		slog.Debug("No booted image timestamp for metrics", slog.Any("error", err))
+	}
+	if run.Staged, err = driver.Staged(); err != nil {
+		slog.Debug("Failed checking for staged system updates", slog.Any("error", err))
+	}
+	if run.RebootRequired, err = driver.RebootRequired(); err != nil {
+		slog.Debug("Failed checking for pending deployments", slog.Any("error", err))
+	}
+}
+
+// clearSystemNotifications drops the pending reboot and staged notifications once the system booted into the update
+func clearSystemNotifications(notifications notify.Policy, driver system.SystemUpdateDriver) {
+	var events []string
+	if required, err := driver.RebootRequired(); err == nil && !required {
+		events = append(events, notify.EventRebootPending)
+	}
+	if staged, err := driver.Staged(); err == nil && !staged {
+		events = append(events, notify.EventUpdateStaged)
+	}
+	if len(events) == 0 {
+		return
+	}
+	if err := notifications.Clear(events...); err != nil {
+		slog.Warn("Failed clearing pending notifications", slog.Any("error", err))
+	}
+}
+
+// systemReport adds the booted image and the staged update to the report
+func systemReport(report *notify.Report, driver system.SystemUpdateDriver) {
+	var err error
+	if report.Image, err = driver.Image(); err != nil {
+		slog.Debug("No booted image for the run report", slog.Any("error", err))
+	}
+	if report.Staged, err = driver.Staged(); err != nil || !report.Staged {
+		return
+	}
+	log, err := driver.Changelog()
+	if err != nil {
+		slog.Debug("No changelog for the run report", slog.Any("error", err))
+		return
+	}
+	report.Update, report.Changes = log.To, len(log.Packages)
+}
+
+// verifiedSystemUpdate refuses to run the system update if the image it pulls can't be verified, which notifies like any failed module.
+// The pull itself is only protected by the signature policy, see system.VerifyImage
+func verifiedSystemUpdate(driver system.SystemUpdateDriver, rebase string, update func(tracker *percent.Incrementer) (*[]drv.CommandOutput, error)) func(tracker *percent.Incrementer) (*[]drv.CommandOutput, error) {
+	return func(tracker *percent.Incrementer) (*[]drv.CommandOutput, error) {
+		image := rebase
+		var err error
+		if image == "" {
+			image, err = driver.Image()
+		}
+		if err == nil {
+			err = system.VerifyImage(driver, image, rebase != "")
+		}
+		if err != nil {
+			slog.Error("Refusing to update the system, image verification failed", slog.String("image", image), slog.Any("error", err))
+			return &[]drv.CommandOutput{{Context: "System Signature Verification", Failure: true, Stderr: err}}, err
+		}
+		return update(tracker)
+	}
+}
+
+// updateData describes the staged system update for notifications, leaving out what the changelog can't tell
+func updateData(driver system.SystemUpdateDriver) notify.Data {
+	data := notify.Data{Modules: "System"}
+	log, err := driver.Changelog()
+	if err != nil {
+		slog.Debug("No changelog for the update notification", slog.Any("error", err))
+		return data
+	}
+	data.From, data.To, data.Count = log.From, log.To, len(log.Packages)
+	return data
+}
+
+// promptReboot tells the users about the update waiting for a reboot. With a timeout it asks them to reboot and returns whether one of them chose to
+func promptReboot(notifications notify.Policy, users []session.User, driver system.SystemUpdateDriver, timeout time.Duration) bool {
+	prompt, recipients, err := notifications.Prepare(users, notify.EventRebootPending, updateData(driver), time.Now())
+	if err != nil {
+		slog.Warn("Failed rendering reboot notification", slog.Any("error", err))
+		return false
+	}
+	var names []string
+	for _, user := range recipients {
+		names = append(names, user.Name)
+	}
+	// users logging in later still learn about the reboot, just without being asked
+	if err := notifications.Defer(notify.EventRebootPending, prompt, names); err != nil {
+		slog.Warn("Failed deferring reboot notification", slog.Any("error", err))
+	}
+	if len(recipients) == 0 {
+		return false
+	}
+	if timeout <= 0 {
+		if err := notify.Send(recipients, prompt); err != nil {
+			slog.Debug("Failed showing reboot notification", slog.Any("error", err))
+		}
+		return false
+	}
+
+	prompt.Actions = []notify.Action{
+		{Key: notify.ActionReboot, Label: "Reboot now"},
+		{Key: notify.ActionLater, Label: "Remind me later"},
+		{Key: notify.ActionDetails, Label: "Show details"},
+	}
+	// the details still ask for the reboot, so showing them keeps the prompt going
+	details := func(action string) *notify.Notification {
+		if action != notify.ActionDetails {
+			return nil
+		}
+		next := prompt
+		next.Actions = prompt.Actions[:2]
+		next.Body = "No details available for this update"
+		if log, err := driver.Changelog(); err == nil {
+			counts := log.Counts()
+			next.Body = fmt.Sprintf("%s → %s\n%d upgraded, %d added, %d removed, %d downgraded packages. Run uupd changelog for the full list.",
+				log.From, log.To, counts[changelog.ChangeUpgraded], counts[changelog.ChangeAdded], counts[changelog.ChangeRemoved], counts[changelog.ChangeDowngraded])
+		}
+		return &next
+	}
+
+	action, err := notify.Prompt(recipients, prompt, timeout, details)
+	if err != nil {
+		slog.Warn("Failed prompting for reboot", slog.Any("error", err))
+	}
+	slog.Debug("Reboot prompt answered", slog.String("action", action))
+	if action == notify.ActionLater {
+		// everyone gets reminded with uupd notify-pending the next time they log in, including who already saw it
+		err := errors.Join(notifications.Clear(notify.EventRebootPending), notifications.Defer(notify.EventRebootPending, prompt, nil))
+		if err != nil {
+			slog.Warn("Failed deferring reboot notification", slog.Any("error", err))
+		}
+	}
+	return action == notify.ActionReboot
+}
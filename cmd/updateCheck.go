@@ -26,7 +26,12 @@ func UpdateCheck(cmd *cobra.Command, args []string) error {
 		slog.Error("Failed checking for updates", slog.Any("error", err))
 		return err
 	}
-	slog.Info("Update Check", slog.Bool("update_available", updateAvailable))
+	staged, err := mainSystemDriver.Staged()
+	if err != nil {
+		slog.Error("Failed checking for staged updates", slog.Any("error", err))
+		return err
+	}
+	slog.Info("Update Check", slog.Bool("update_available", updateAvailable), slog.Bool("update_staged", staged))
 	if !updateAvailable {
 		os.Exit(77)
 	}
@@ -10,9 +10,14 @@ import (
 	. "github.com/ublue-os/uupd/drv/generic"
 	appConfig "github.com/ublue-os/uupd/pkg/config"
 	"github.com/ublue-os/uupd/pkg/percent"
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
 	"github.com/ublue-os/uupd/pkg/session"
 )
 
+// Rough size of a bottle, to weigh brew against the modules that know their download size
+const bottleSize = 20e6
+
 func (up BrewUpdater) GetBrewUID() (int, error) {
 	inf, err := os.Stat(up.BrewPrefix)
 	if err != nil {
@@ -36,8 +41,40 @@ func (up BrewUpdater) Steps() int {
 	return 0
 }
 
+// Check lists outdated formulae and casks without downloading anything
 func (up BrewUpdater) Check() (bool, error) {
-	return true, nil
+	if up.Config.DryRun {
+		return true, nil
+	}
+
+	cli := []string{up.BrewPath, "outdated", "--quiet"}
+	out, err := session.RunUID(up.Config.Logger, slog.LevelDebug, up.BaseUser, cli, up.Config.Environment, nil)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// Estimate counts the outdated formulae and casks, brew doesn't know the size of the bottles before downloading them
+func (up BrewUpdater) Estimate() ([]float64, error) {
+	weights := make([]float64, up.Steps())
+	if up.Config.DryRun || len(weights) == 0 {
+		return weights, nil
+	}
+
+	cli := []string{up.BrewPath, "outdated", "--quiet"}
+	out, err := session.RunUID(up.Config.Logger, slog.LevelDebug, up.BaseUser, cli, up.Config.Environment, nil)
+	if err != nil {
+		return weights, err
+	}
+	outdated := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			outdated++
+		}
+	}
+	weights[0] = max(float64(outdated)*bottleSize, 1)
+	return weights, nil
 }
 
 func (up BrewUpdater) Update(_tracker *percent.Incrementer) (*[]CommandOutput, error) {
@@ -48,7 +85,9 @@ func (up BrewUpdater) Update(_tracker *percent.Incrementer) (*[]CommandOutput, e
 	}
 
 	cli := []string{up.BrewPath, "update"}
-	out, err := session.RunUID(up.Config.Logger, slog.LevelDebug, up.BaseUser, cli, up.Config.Environment)
+	out, err := retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		return session.RunUID(up.Config.Logger, slog.LevelDebug, up.BaseUser, cli, up.Config.Environment, up.Config.Limits.Wrap)
+	})
 	tmpout := CommandOutput{}.New(out, err)
 	tmpout.Context = "Brew Update"
 	tmpout.Cli = cli
@@ -61,7 +100,9 @@ func (up BrewUpdater) Update(_tracker *percent.Incrementer) (*[]CommandOutput, e
 	}
 
 	cli = []string{up.BrewPath, "upgrade", "-y"}
-	out, err = session.RunUID(up.Config.Logger, slog.LevelDebug, up.BaseUser, cli, up.Config.Environment)
+	out, err = retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		return session.RunUID(up.Config.Logger, slog.LevelDebug, up.BaseUser, cli, up.Config.Environment, up.Config.Limits.Wrap)
+	})
 	tmpout = CommandOutput{}.New(out, err)
 	tmpout.Context = "Brew Upgrade"
 	tmpout.Cli = cli
@@ -88,6 +129,8 @@ func (up BrewUpdater) New(config UpdaterInitConfiguration) (BrewUpdater, error)
 		MultiUser:   false,
 		DryRun:      config.DryRun,
 		Environment: config.Environment,
+		Retry:       retry.NewPolicy(conf.Retry),
+		Limits:      resources.NewLimits("brew", conf.Limits),
 	}
 	up.Config.Logger = config.Logger.With(slog.String("module", strings.ToLower(up.Config.Title)))
 
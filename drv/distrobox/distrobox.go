@@ -7,7 +7,10 @@ import (
 
 	. "github.com/ublue-os/uupd/drv/generic"
 	appConfig "github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/executor"
 	"github.com/ublue-os/uupd/pkg/percent"
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
 	"github.com/ublue-os/uupd/pkg/session"
 )
 
@@ -40,6 +43,9 @@ func (up DistroboxUpdater) New(config UpdaterInitConfiguration) (DistroboxUpdate
 		MultiUser:       true,
 		DryRun:          config.DryRun,
 		Environment:     config.Environment,
+		Retry:           retry.NewPolicy(conf.Retry),
+		Limits:          resources.NewLimits("distrobox", conf.Limits),
+		UserConcurrency: appConfig.Get().Executor.UserConcurrency,
 	}
 	up.Config.Logger = config.Logger.With(slog.String("module", strings.ToLower(up.Config.Title)))
 	up.usersEnabled = false
@@ -69,42 +75,57 @@ func (up DistroboxUpdater) Check() (bool, error) {
 	return true, nil
 }
 
+// Estimate can't tell anything, the package managers of the containers only know once they run
+func (up DistroboxUpdater) Estimate() ([]float64, error) {
+	return make([]float64, up.Steps()), nil
+}
+
 func (up DistroboxUpdater) Update(tracker *percent.Incrementer) (*[]CommandOutput, error) {
 	var finalOutput = []CommandOutput{}
 
 	if up.Config.DryRun {
-		tracker.IncrementSection(nil)
 		tracker.ReportStatusChange(up.Config.Title, up.Config.Description)
+		tracker.SectionPercent(100)
 
-		var err error = nil
-		for _, user := range up.users {
-			tracker.IncrementSection(err)
-			tracker.ReportStatusChange(up.Config.Title, *up.Config.UserDescription+" "+user.Name)
-		}
+		executor.ForEach(len(up.users), up.Config.UserConcurrency, func(i int) {
+			userTracker := tracker.Fork()
+			userTracker.ReportStatusChange(up.Config.Title, *up.Config.UserDescription+" "+up.users[i].Name)
+			userTracker.IncrementSection(nil)
+		})
 		return &finalOutput, nil
 	}
 
 	tracker.ReportStatusChange(up.Config.Title, up.Config.Description)
 	cli := []string{up.binaryPath, "upgrade", "-a"}
-	out, err := session.RunUID(up.Config.Logger, slog.LevelDebug, 0, cli, nil)
+	out, err := retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		return session.RunUID(up.Config.Logger, slog.LevelDebug, 0, cli, nil, up.Config.Limits.Wrap)
+	})
 	tmpout := CommandOutput{}.New(out, err)
 	tmpout.Context = up.Config.Description
 	tmpout.Cli = cli
 	tmpout.Failure = err != nil
 	finalOutput = append(finalOutput, *tmpout)
+	// the caller closes this section once we return, users get their own
+	tracker.SectionPercent(100)
 
-	err = nil
-	for _, user := range up.users {
-		tracker.IncrementSection(err)
+	userOutputs := make([]CommandOutput, len(up.users))
+	executor.ForEach(len(up.users), up.Config.UserConcurrency, func(i int) {
+		user := up.users[i]
+		userTracker := tracker.Fork()
 		context := *up.Config.UserDescription + " " + user.Name
-		tracker.ReportStatusChange(up.Config.Title, *up.Config.UserDescription+" "+user.Name)
+		userTracker.ReportStatusChange(up.Config.Title, context)
 		cli := []string{up.binaryPath, "upgrade", "-a"}
-		out, err := session.RunUID(up.Config.Logger, slog.LevelDebug, user.UID, cli, nil)
-		tmpout = CommandOutput{}.New(out, err)
+		out, err := retry.Run(up.Config.Logger.With(slog.String("user", user.Name)), up.Config.Retry, func() ([]byte, error) {
+			return session.RunUID(up.Config.Logger, slog.LevelDebug, user.UID, cli, nil, up.Config.Limits.Wrap)
+		})
+		tmpout := CommandOutput{}.New(out, err)
 		tmpout.Context = context
 		tmpout.Cli = cli
+		tmpout.User = user.Name
 		tmpout.Failure = err != nil
-		finalOutput = append(finalOutput, *tmpout)
-	}
+		userOutputs[i] = *tmpout
+		userTracker.IncrementSection(err)
+	})
+	finalOutput = append(finalOutput, userOutputs...)
 	return &finalOutput, nil
 }
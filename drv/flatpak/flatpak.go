@@ -7,7 +7,10 @@ import (
 
 	. "github.com/ublue-os/uupd/drv/generic"
 	appConfig "github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/executor"
 	"github.com/ublue-os/uupd/pkg/percent"
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
 	"github.com/ublue-os/uupd/pkg/session"
 )
 
@@ -40,6 +43,9 @@ func (up FlatpakUpdater) New(config UpdaterInitConfiguration) (FlatpakUpdater, e
 		MultiUser:       true,
 		DryRun:          config.DryRun,
 		Environment:     config.Environment,
+		Retry:           retry.NewPolicy(conf.Retry),
+		Limits:          resources.NewLimits("flatpak", conf.Limits),
+		UserConcurrency: appConfig.Get().Executor.UserConcurrency,
 	}
 	up.Config.Logger = config.Logger.With(slog.String("module", strings.ToLower(up.Config.Title)))
 	up.usersEnabled = false
@@ -54,8 +60,46 @@ func (up *FlatpakUpdater) SetUsers(users []session.User) {
 	up.usersEnabled = true
 }
 
+// Check lists the updates of the system installation, only the remote metadata gets downloaded
 func (up FlatpakUpdater) Check() (bool, error) {
-	return true, nil
+	if up.Config.DryRun {
+		return true, nil
+	}
+
+	cmd := exec.Command(up.binaryPath, "remote-ls", "--system", "--updates", "--columns=application")
+	out, err := session.RunLog(up.Config.Logger, slog.LevelDebug, cmd)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// Estimate returns the download size of the updates of the system installation, the ones of the users are unknown
+func (up FlatpakUpdater) Estimate() ([]float64, error) {
+	weights := make([]float64, up.Steps())
+	if up.Config.DryRun || len(weights) == 0 {
+		return weights, nil
+	}
+
+	cmd := exec.Command(up.binaryPath, "remote-ls", "--system", "--updates", "--columns=download-size")
+	out, err := session.RunLog(up.Config.Logger, slog.LevelDebug, cmd)
+	if err != nil {
+		return weights, err
+	}
+	size := 0.0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parsed, err := ParseSize(line)
+		if err != nil {
+			return weights, err
+		}
+		size += parsed
+	}
+	// known to be next to nothing, unlike the unknown 0
+	weights[0] = max(size, 1)
+	return weights, nil
 }
 
 func (up FlatpakUpdater) Update(tracker *percent.Incrementer) (*[]CommandOutput, error) {
@@ -63,38 +107,48 @@ func (up FlatpakUpdater) Update(tracker *percent.Incrementer) (*[]CommandOutput,
 
 	if up.Config.DryRun {
 		tracker.ReportStatusChange(up.Config.Title, up.Config.Description)
-		tracker.IncrementSection(nil)
+		tracker.SectionPercent(100)
 
-		var err error = nil
-		for _, user := range up.users {
-			tracker.IncrementSection(err)
-			tracker.ReportStatusChange(up.Config.Title, *up.Config.UserDescription+" "+user.Name)
-		}
+		executor.ForEach(len(up.users), up.Config.UserConcurrency, func(i int) {
+			userTracker := tracker.Fork()
+			userTracker.ReportStatusChange(up.Config.Title, *up.Config.UserDescription+" "+up.users[i].Name)
+			userTracker.IncrementSection(nil)
+		})
 		return &finalOutput, nil
 	}
 
 	tracker.ReportStatusChange(up.Config.Title, up.Config.Description)
 	cli := []string{up.binaryPath, "update", "-y", "--noninteractive"}
-	flatpakCmd := exec.Command(cli[0], cli[1:]...)
-	out, err := session.RunLog(up.Config.Logger, slog.LevelDebug, flatpakCmd)
+	out, err := retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		flatpakCmd := up.Config.Limits.Command(cli)
+		return session.RunLog(up.Config.Logger, slog.LevelDebug, flatpakCmd)
+	})
 	tmpout := CommandOutput{}.New(out, err)
 	tmpout.Context = up.Config.Description
 	tmpout.Cli = cli
 	tmpout.Failure = err != nil
 	finalOutput = append(finalOutput, *tmpout)
+	// the caller closes this section once we return, users get their own
+	tracker.SectionPercent(100)
 
-	err = nil
-	for _, user := range up.users {
-		tracker.IncrementSection(err)
+	userOutputs := make([]CommandOutput, len(up.users))
+	executor.ForEach(len(up.users), up.Config.UserConcurrency, func(i int) {
+		user := up.users[i]
+		userTracker := tracker.Fork()
 		context := *up.Config.UserDescription + " " + user.Name
-		tracker.ReportStatusChange(up.Config.Title, context)
+		userTracker.ReportStatusChange(up.Config.Title, context)
 		cli := []string{up.binaryPath, "update", "-y"}
-		out, err := session.RunUID(up.Config.Logger, slog.LevelDebug, user.UID, cli, nil)
-		tmpout = CommandOutput{}.New(out, err)
+		out, err := retry.Run(up.Config.Logger.With(slog.String("user", user.Name)), up.Config.Retry, func() ([]byte, error) {
+			return session.RunUID(up.Config.Logger, slog.LevelDebug, user.UID, cli, nil, up.Config.Limits.Wrap)
+		})
+		tmpout := CommandOutput{}.New(out, err)
 		tmpout.Context = context
 		tmpout.Cli = cli
+		tmpout.User = user.Name
 		tmpout.Failure = err != nil
-		finalOutput = append(finalOutput, *tmpout)
-	}
+		userOutputs[i] = *tmpout
+		userTracker.IncrementSection(err)
+	})
+	finalOutput = append(finalOutput, userOutputs...)
 	return &finalOutput, nil
 }
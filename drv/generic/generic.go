@@ -1,10 +1,14 @@
 package generic
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
 	"github.com/ublue-os/uupd/pkg/session"
 )
 
@@ -36,12 +40,34 @@ func (up UpdaterInitConfiguration) New() *UpdaterInitConfiguration {
 	return &up
 }
 
+var sizeUnits = map[string]float64{
+	"byte": 1, "bytes": 1, "B": 1,
+	"kB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+	"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40,
+}
+
+// ParseSize parses sizes the way GLib formats them (e.g. "1.2 MB" or "512 bytes"), like flatpak and bootc print them
+func ParseSize(size string) (float64, error) {
+	value, unit, _ := strings.Cut(strings.TrimSpace(strings.ReplaceAll(size, "\u00a0", " ")), " ")
+	multiplier, ok := sizeUnits[strings.TrimSpace(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit in %q", size)
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	return parsed * multiplier, nil
+}
+
 type CommandOutput struct {
 	Stdout  string
 	Failure bool
 	Stderr  error
 	Context string
 	Cli     []string
+	// Set by multi-user drivers for the per-user steps
+	User string
 }
 
 func (output CommandOutput) New(out []byte, err error) *CommandOutput {
@@ -62,6 +88,10 @@ type DriverConfiguration struct {
 	Environment     EnvironmentMap `json:"-"`
 	Logger          *slog.Logger   `json:"-"`
 	UserDescription *string
+	Retry           retry.Policy
+	// Amount of users updated at the same time by multi-user drivers
+	UserConcurrency int
+	Limits          resources.Limits
 }
 
 type UpdateDriver interface {
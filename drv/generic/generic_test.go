@@ -26,3 +26,25 @@ func TestProperEnvironment(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]float64{
+		"512 bytes":    512,
+		"12.5 kB":      12500,
+		"1.2 MB":       1200000,
+		" 3.0 GB":      3e9,
+		"1.5\u00a0MiB": 1.5 * 1024 * 1024,
+	}
+	for size, expected := range sizes {
+		parsed, err := generic.ParseSize(size)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %v", size, err)
+		}
+		if parsed != expected {
+			t.Fatalf("Parsed %q as %v, expected %v", size, parsed, expected)
+		}
+	}
+	if _, err := generic.ParseSize("12 parsecs"); err == nil {
+		t.Fatalf("Expected an unknown unit to fail")
+	}
+}
@@ -12,17 +12,29 @@ import (
 	"time"
 
 	. "github.com/ublue-os/uupd/drv/generic"
+	"github.com/ublue-os/uupd/pkg/changelog"
 	appConfig "github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/imageref"
 	"github.com/ublue-os/uupd/pkg/percent"
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
 	"github.com/ublue-os/uupd/pkg/session"
+	"github.com/ublue-os/uupd/pkg/signature"
 )
 
+const rpmOstreeDaemon = "rpm-ostreed.service"
+
 type rpmOstreeStatus struct {
 	Deployments []struct {
+		Version   string         `json:"version"`
 		Timestamp int64          `json:"timestamp"`
 		Meta      BaseCommitMeta `json:"base-commit-meta"`
 		Reference string         `json:"container-image-reference"`
+		Booted    bool           `json:"booted"`
+		Staged    bool           `json:"staged"`
 	} `json:"deployments"`
+	// Set once an update got downloaded (e.g. with --download-only) but not deployed
+	CachedUpdate json.RawMessage `json:"cached-update"`
 }
 
 type BaseCommitMeta struct {
@@ -39,41 +51,208 @@ type RpmOstreeUpdater struct {
 	SkopeoPath string
 }
 
-func (up RpmOstreeUpdater) Outdated() (bool, error) {
+func (up RpmOstreeUpdater) ImageTimestamp() (time.Time, error) {
 	if up.Config.DryRun {
-		return false, nil
+		return time.Time{}, nil
 	}
-	var timestamp time.Time
 
 	cmd := exec.Command(up.BinaryPath, "status", "--json", "--booted")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return false, err
+		return time.Time{}, err
 	}
 	var status rpmOstreeStatus
 	err = json.Unmarshal(out, &status)
 	if err != nil {
+		return time.Time{}, err
+	}
+	if len(status.Deployments) == 0 {
+		return time.Time{}, fmt.Errorf("no booted deployment")
+	}
+	return time.Unix(status.Deployments[0].Timestamp, 0).UTC(), nil
+}
+
+func (up RpmOstreeUpdater) Outdated() (bool, error) {
+	timestamp, err := up.ImageTimestamp()
+	if err != nil || timestamp.IsZero() {
 		return false, err
 	}
-	timestamp = time.Unix(status.Deployments[0].Timestamp, 0).UTC()
 	oneMonthAgo := time.Now().AddDate(0, -1, 0).UTC()
 
 	return timestamp.UTC().Before(oneMonthAgo), nil
 }
 
 func (up RpmOstreeUpdater) Update(_tracker *percent.Incrementer) (*[]CommandOutput, error) {
-	var finalOutput = []CommandOutput{}
-	binaryPath := up.BinaryPath
+	return up.upgrade([]string{up.BinaryPath, "upgrade"}, "System Update")
+}
+
+// Estimate can't tell anything, rpm-ostree only knows the size of an update once it pulls it
+func (up RpmOstreeUpdater) Estimate() ([]float64, error) {
+	return make([]float64, up.Steps()), nil
+}
+
+// Fetch only downloads the update, the next Update deploys it from the cache
+func (up RpmOstreeUpdater) Fetch(_tracker *percent.Incrementer) (*[]CommandOutput, error) {
+	return up.upgrade([]string{up.BinaryPath, "upgrade", "--download-only"}, "System Download")
+}
+
+func (up RpmOstreeUpdater) Staged() (bool, error) {
+	if up.Config.DryRun {
+		return false, nil
+	}
+
+	cmd := exec.Command(up.BinaryPath, "status", "--json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, err
+	}
+	var status rpmOstreeStatus
+	err = json.Unmarshal(out, &status)
+	if err != nil {
+		return false, err
+	}
+
+	if len(status.CachedUpdate) > 0 && string(status.CachedUpdate) != "null" {
+		return true, nil
+	}
+	return status.pendingDeployment(), nil
+}
+
+// pendingDeployment returns whether a deployment waits for the next reboot, deployments are sorted newest first
+func (status rpmOstreeStatus) pendingDeployment() bool {
+	return len(status.Deployments) > 0 && (status.Deployments[0].Staged || !status.Deployments[0].Booted)
+}
+
+func (up RpmOstreeUpdater) RebootRequired() (bool, error) {
+	if up.Config.DryRun {
+		return false, nil
+	}
+
+	cmd := exec.Command(up.BinaryPath, "status", "--json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, err
+	}
+	var status rpmOstreeStatus
+	if err := json.Unmarshal(out, &status); err != nil {
+		return false, err
+	}
+	return status.pendingDeployment(), nil
+}
+
+// bootedReference returns the container image reference of the booted deployment, including the transport
+func (up RpmOstreeUpdater) bootedReference() (string, error) {
+	cmd := exec.Command(up.BinaryPath, "status", "--json", "--booted")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	var status rpmOstreeStatus
+	err = json.Unmarshal(out, &status)
+	if err != nil {
+		return "", err
+	}
+	if len(status.Deployments) == 0 || status.Deployments[0].Reference == "" {
+		return "", fmt.Errorf("booted deployment isn't a container image")
+	}
+	return status.Deployments[0].Reference, nil
+}
+
+func (up RpmOstreeUpdater) Image() (string, error) {
+	ref, err := up.bootedReference()
+	if err != nil {
+		return "", err
+	}
+	return imageref.StripTransport(ref), nil
+}
+
+func (up RpmOstreeUpdater) PendingImage() (string, error) {
+	cmd := exec.Command(up.BinaryPath, "status", "--json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	var status rpmOstreeStatus
+	if err := json.Unmarshal(out, &status); err != nil {
+		return "", err
+	}
+	if !status.pendingDeployment() {
+		return "", nil
+	}
+	return imageref.StripTransport(status.Deployments[0].Reference), nil
+}
+
+func (up RpmOstreeUpdater) SignedTransport() (bool, error) {
+	ref, err := up.bootedReference()
+	if err != nil {
+		return false, err
+	}
+	return signature.SignedTransport(ref), nil
+}
+
+func (up RpmOstreeUpdater) Rebase(_tracker *percent.Incrementer, image string) (*[]CommandOutput, error) {
+	cli := []string{up.BinaryPath, "rebase", "ostree-image-signed:docker://" + image}
+	if up.Config.DryRun {
+		return &[]CommandOutput{{Context: "System Rebase", Cli: cli}}, nil
+	}
+	if err := imageref.Exists(up.SkopeoPath, image); err != nil {
+		return &[]CommandOutput{{Context: "System Rebase", Cli: cli, Failure: true, Stderr: err}}, err
+	}
+	return up.upgrade(cli, "System Rebase")
+}
+
+func (up RpmOstreeUpdater) Changelog() (changelog.Changelog, error) {
+	var log changelog.Changelog
 
-	cli := []string{binaryPath, "upgrade"}
+	cmd := exec.Command(up.BinaryPath, "status", "--json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return log, err
+	}
+	var status rpmOstreeStatus
+	err = json.Unmarshal(out, &status)
+	if err != nil {
+		return log, err
+	}
+	// deployments are sorted newest first, a pending one waits for the next reboot
+	if len(status.Deployments) < 2 || status.Deployments[0].Booted {
+		return log, fmt.Errorf("no staged update")
+	}
+	log.To = status.Deployments[0].Version
+	for _, deployment := range status.Deployments {
+		if deployment.Booted {
+			log.From = deployment.Version
+		}
+	}
+
+	// without arguments the booted deployment gets compared to the pending one
+	cmd = exec.Command(up.BinaryPath, "db", "diff", "--format=json")
+	out, err = cmd.Output()
+	if err != nil {
+		return log, fmt.Errorf("rpm-ostree db diff failed: %v", err)
+	}
+	log.Packages, err = changelog.ParseRpmOstreeDiff(out)
+	return log, err
+}
+
+func (up RpmOstreeUpdater) upgrade(cli []string, outputContext string) (*[]CommandOutput, error) {
+	var finalOutput = []CommandOutput{}
 	up.Config.Logger.Debug("Executing update", slog.Any("cli", cli))
-	cmd := exec.Command(cli[0], cli[1:]...)
-	out, err := session.RunLog(up.Config.Logger, slog.LevelDebug, cmd)
+	// rpm-ostree only asks rpm-ostreed to pull and deploy the update, a scope around the client wouldn't limit anything
+	resetLimits, err := up.Config.Limits.LimitService(rpmOstreeDaemon)
+	if err != nil {
+		up.Config.Logger.Warn("Failed applying resource limits to rpm-ostreed", slog.Any("error", err))
+	}
+	defer resetLimits()
+	out, err := retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		cmd := exec.Command(cli[0], cli[1:]...)
+		return session.RunLog(up.Config.Logger, slog.LevelDebug, cmd)
+	})
 
 	tmpout := CommandOutput{}.New(out, err)
 	tmpout.Cli = cli
 	tmpout.Failure = err != nil
-	tmpout.Context = "System Update"
+	tmpout.Context = outputContext
 	finalOutput = append(finalOutput, *tmpout)
 	return &finalOutput, err
 }
@@ -93,8 +272,13 @@ func (up RpmOstreeUpdater) New(config UpdaterInitConfiguration) (RpmOstreeUpdate
 		Enabled:     !config.Ci,
 		DryRun:      config.DryRun,
 		Environment: config.Environment,
+		Retry:       retry.NewPolicy(conf.Retry),
+		Limits:      resources.NewLimits("system", conf.Limits),
 	}
 	up.Config.Logger = config.Logger.With(slog.String("module", strings.ToLower(up.Config.Title)))
+	if limits := up.Config.Limits; limits.Enabled && (limits.Nice != 0 || limits.IOClass != "" || appConfig.Get().Limits.NetworkMaxBytes != 0) {
+		up.Config.Logger.Warn("nice, io-class and network-max-bytes-per-sec don't apply to rpm-ostree updates, they run in rpm-ostreed.service")
+	}
 	up.BinaryPath = conf.RpmOstreeBinary
 	up.SkopeoPath = conf.SkopeoBinary
 
@@ -33,3 +33,15 @@ func TestProperSteps(t *testing.T) {
 		t.Fatalf("Expected steps to be added")
 	}
 }
+
+func TestStagedDryRun(t *testing.T) {
+	rpmostreeUpdater := InitBaseConfig()
+
+	staged, err := rpmostreeUpdater.Staged()
+	if err != nil {
+		t.Fatalf("Failed checking for staged updates: %v", err)
+	}
+	if staged {
+		t.Fatalf("Expected nothing to be staged on a dry run")
+	}
+}
@@ -5,17 +5,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
 	. "github.com/ublue-os/uupd/drv/generic"
 	"github.com/ublue-os/uupd/drv/rpmostree"
+	"github.com/ublue-os/uupd/pkg/changelog"
 	appConfig "github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/imageref"
 	"github.com/ublue-os/uupd/pkg/percent"
+	"github.com/ublue-os/uupd/pkg/resources"
+	"github.com/ublue-os/uupd/pkg/retry"
+	"github.com/ublue-os/uupd/pkg/session"
+	"github.com/ublue-os/uupd/pkg/signature"
 )
 
 type bootcStatus struct {
@@ -23,15 +31,33 @@ type bootcStatus struct {
 		Booted struct {
 			Incompatible bool `json:"incompatible"`
 			Image        struct {
+				Image struct {
+					Image string `json:"image"`
+					// "containerPolicy", {"ostreeRemote": "<remote>"}, "insecure" or null
+					Signature json.RawMessage `json:"signature"`
+				} `json:"image"`
+				Version   string `json:"version"`
 				Timestamp string `json:"timestamp"`
 			} `json:"image"`
 		} `json:"booted"`
 		Staged struct {
 			Incompatible bool `json:"incompatible"`
+			// Staged with upgrade --download-only, it doesn't get applied on reboot
+			DownloadOnly bool `json:"downloadOnly"`
 			Image        struct {
-				Timestamp string `json:"timestamp"`
+				Image struct {
+					Image string `json:"image"`
+				} `json:"image"`
+				Version     string `json:"version"`
+				Timestamp   string `json:"timestamp"`
+				ImageDigest string `json:"imageDigest"`
 			} `json:"image"`
-		}
+			Ostree struct {
+				Checksum     string `json:"checksum"`
+				DeploySerial int    `json:"deploySerial"`
+				Stateroot    string `json:"stateroot"`
+			} `json:"ostree"`
+		} `json:"staged"`
 	} `json:"status"`
 }
 
@@ -40,13 +66,38 @@ type bootcStatus struct {
 type SystemUpdateDriver interface {
 	Steps() int
 	Outdated() (bool, error)
+	// Build time of the booted image, zero in dry runs
+	ImageTimestamp() (time.Time, error)
 	Check() (bool, error)
 	Update(tracker *percent.Incrementer) (*[]CommandOutput, error)
+	// Estimated bytes the steps download, 0 when the driver can't tell
+	Estimate() ([]float64, error)
+	// Downloads (and stages, where the driver can) the update without deploying it
+	Fetch(tracker *percent.Incrementer) (*[]CommandOutput, error)
+	// Whether an update got downloaded but isn't deployed yet
+	Staged() (bool, error)
+	// Whether a deployment is waiting for the next reboot
+	RebootRequired() (bool, error)
+	// Image reference of the booted deployment, without the transport
+	Image() (string, error)
+	// Image reference of the deployment waiting for the next reboot, empty when there's none
+	PendingImage() (string, error)
+	// Switches to another image, after making sure it exists
+	Rebase(tracker *percent.Incrementer, image string) (*[]CommandOutput, error)
+	// Whether the booted deployment verifies images when pulling them
+	SignedTransport() (bool, error)
+	// Packages that differ between the booted and the staged deployment
+	Changelog() (changelog.Changelog, error)
 }
 
 type SystemUpdater struct {
 	Config     DriverConfiguration
 	BinaryPath string
+	SkopeoPath string
+	// Switch images with signature verification
+	EnforceSignatures bool
+	// Output of the last update check, shared by the copies of the updater
+	checked *[]byte
 }
 
 // Bootc Progress
@@ -73,65 +124,234 @@ type BootcProgress struct {
 	BytesTotal  int    `json:"bytesTotal"`
 }
 
+func (up SystemUpdater) ImageTimestamp() (time.Time, error) {
+	if up.Config.DryRun {
+		return time.Time{}, nil
+	}
+
+	status, err := up.status()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, status.Status.Booted.Image.Timestamp)
+}
+
 func (up SystemUpdater) Outdated() (bool, error) {
+	timestamp, err := up.ImageTimestamp()
+	if _, isParseErr := err.(*time.ParseError); isParseErr {
+		return false, nil
+	}
+	if err != nil || timestamp.IsZero() {
+		return false, err
+	}
+	oneMonthAgo := time.Now().AddDate(0, -1, 0).UTC()
+
+	return timestamp.UTC().Before(oneMonthAgo), nil
+}
+
+// Update deploys the update, or the one an earlier Fetch downloaded
+func (up SystemUpdater) Update(tracker *percent.Incrementer) (*[]CommandOutput, error) {
+	if !up.Config.DryRun {
+		if status, err := up.status(); err == nil && status.Status.Staged.DownloadOnly {
+			return up.upgrade(tracker, "System Update", "--from-downloaded")
+		}
+	}
+	return up.upgrade(tracker, "System Update")
+}
+
+// Fetch stages the update without deploying it where bootc supports upgrade --download-only.
+// Older versions of bootc apply whatever is staged on the next reboot, so there it's the same as Update
+func (up SystemUpdater) Fetch(tracker *percent.Incrementer) (*[]CommandOutput, error) {
+	if up.supports("upgrade", "--download-only") {
+		return up.upgrade(tracker, "System Download", "--download-only")
+	}
+	up.Config.Logger.Warn("bootc can't download updates without deploying them, the update gets applied on the next reboot")
+	return up.upgrade(tracker, "System Download")
+}
+
+// supports returns whether the help of the bootc command lists the flag
+func (up SystemUpdater) supports(command string, flag string) bool {
+	out, err := exec.Command(up.BinaryPath, command, "--help").CombinedOutput()
+	return err == nil && strings.Contains(string(out), flag)
+}
+
+func (up SystemUpdater) Staged() (bool, error) {
 	if up.Config.DryRun {
 		return false, nil
 	}
 
-	cmd := exec.Command(up.BinaryPath, "status", "--format=json")
-	out, err := cmd.CombinedOutput()
+	status, err := up.status()
+	if err != nil {
+		return false, err
+	}
+	return status.Status.Staged.Image.ImageDigest != "", nil
+}
+
+// RebootRequired is whether a staged deployment gets applied on the next reboot, which download-only ones don't
+func (up SystemUpdater) RebootRequired() (bool, error) {
+	if up.Config.DryRun {
+		return false, nil
+	}
+
+	status, err := up.status()
 	if err != nil {
 		return false, err
 	}
+	return status.Status.Staged.Image.ImageDigest != "" && !status.Status.Staged.DownloadOnly, nil
+}
 
+func (up SystemUpdater) status() (bootcStatus, error) {
 	var status bootcStatus
+	cmd := exec.Command(up.BinaryPath, "status", "--format=json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return status, err
+	}
 	err = json.Unmarshal(out, &status)
+	return status, err
+}
+
+func (up SystemUpdater) Image() (string, error) {
+	status, err := up.status()
 	if err != nil {
-		return false, err
+		return "", err
+	}
+	if status.Status.Booted.Image.Image.Image == "" {
+		return "", fmt.Errorf("bootc status has no booted image")
 	}
+	return status.Status.Booted.Image.Image.Image, nil
+}
 
-	timestamp, err := time.Parse(time.RFC3339Nano, status.Status.Booted.Image.Timestamp)
+func (up SystemUpdater) PendingImage() (string, error) {
+	status, err := up.status()
 	if err != nil {
+		return "", err
+	}
+	if status.Status.Staged.DownloadOnly {
+		return "", nil
+	}
+	return status.Status.Staged.Image.Image.Image, nil
+}
+
+func (up SystemUpdater) SignedTransport() (bool, error) {
+	status, err := up.status()
+	if err != nil {
+		return false, err
+	}
+	switch signature := strings.TrimSpace(string(status.Status.Booted.Image.Image.Signature)); signature {
+	case "", "null", `"insecure"`:
 		return false, nil
 	}
-	oneMonthAgo := time.Now().AddDate(0, -1, 0).UTC()
+	return true, nil
+}
 
-	return timestamp.UTC().Before(oneMonthAgo), nil
+func (up SystemUpdater) Rebase(_tracker *percent.Incrementer, image string) (*[]CommandOutput, error) {
+	cli := []string{up.BinaryPath, "switch", image}
+	if up.EnforceSignatures {
+		cli = []string{up.BinaryPath, "switch", "--enforce-container-sigpolicy", image}
+	}
+	if up.Config.DryRun {
+		return &[]CommandOutput{{Context: "System Rebase", Cli: cli}}, nil
+	}
+	if err := imageref.Exists(up.SkopeoPath, image); err != nil {
+		return &[]CommandOutput{{Context: "System Rebase", Cli: cli, Failure: true, Stderr: err}}, err
+	}
+
+	up.Config.Logger.Debug("Executing rebase", slog.Any("cli", cli))
+	out, err := retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		cmd := up.Config.Limits.Command(cli)
+		return session.RunLog(up.Config.Logger, slog.LevelDebug, cmd)
+	})
+	tmpout := CommandOutput{}.New(out, err)
+	tmpout.Context = "System Rebase"
+	tmpout.Cli = cli
+	return &[]CommandOutput{*tmpout}, err
 }
 
-func (up SystemUpdater) Update(tracker *percent.Incrementer) (*[]CommandOutput, error) {
+// rpmPackages lists the packages installed in the deployment checked out at root
+func rpmPackages(root string) (map[string][]string, error) {
+	for _, dbPath := range []string{"usr/share/rpm", "usr/lib/sysimage/rpm"} {
+		dbPath = filepath.Join(root, dbPath)
+		if _, err := os.Stat(dbPath); err != nil {
+			continue
+		}
+		cmd := exec.Command("rpm", "-qa", "--dbpath", dbPath, "--qf", "%{NAME}\t%{ARCH}\t%{EPOCHNUM}:%{VERSION}-%{RELEASE}\n")
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list packages in %s: %v", dbPath, err)
+		}
+		return changelog.ParseRpmList(out), nil
+	}
+	return nil, fmt.Errorf("no rpm database found in %s", root)
+}
+
+func (up SystemUpdater) Changelog() (changelog.Changelog, error) {
+	var log changelog.Changelog
+	status, err := up.status()
+	if err != nil {
+		return log, err
+	}
+	staged := status.Status.Staged
+	if staged.Ostree.Checksum == "" {
+		return log, fmt.Errorf("no staged update")
+	}
+	log.From = status.Status.Booted.Image.Version
+	log.To = staged.Image.Version
+
+	before, err := rpmPackages("/")
+	if err != nil {
+		return log, err
+	}
+	deployment := fmt.Sprintf("/ostree/deploy/%s/deploy/%s.%d", staged.Ostree.Stateroot, staged.Ostree.Checksum, staged.Ostree.DeploySerial)
+	after, err := rpmPackages(deployment)
+	if err != nil {
+		return log, err
+	}
+	log.Packages = changelog.Diff(before, after)
+	return log, nil
+}
+
+func (up SystemUpdater) upgrade(tracker *percent.Incrementer, outputContext string, args ...string) (*[]CommandOutput, error) {
 	var finalOutput = []CommandOutput{}
-	var cmd *exec.Cmd
 	binaryPath := up.BinaryPath
 
-	cli := []string{binaryPath, "upgrade", "--quiet", "--progress-fd", "3"}
+	cli := append([]string{binaryPath, "upgrade", "--quiet", "--progress-fd", "3"}, args...)
 
 	up.Config.Logger.Debug("Executing update", slog.Any("cli", cli))
 
-	cmd = exec.Command(cli[0], cli[1:]...)
+	out, err := retry.Run(up.Config.Logger, up.Config.Retry, func() ([]byte, error) {
+		cmd := up.Config.Limits.Command(cli)
 
-	r, w, err := os.Pipe()
-	if err != nil {
-		return &finalOutput, err
-	}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return []byte{}, err
+		}
 
-	var outb, errb bytes.Buffer
-	cmd.Stdout = &outb
-	cmd.Stderr = &errb
-	cmd.ExtraFiles = []*os.File{w}
+		var outb, errb bytes.Buffer
+		cmd.Stdout = &outb
+		cmd.Stderr = &errb
+		cmd.ExtraFiles = []*os.File{w}
 
-	err = cmd.Start()
-	if err != nil {
-		return &finalOutput, err
-	}
+		err = cmd.Start()
+		// the child has its own copy of the write end now
+		w.Close() //nolint:errcheck
+		if err != nil {
+			r.Close() //nolint:errcheck
+			return []byte{}, err
+		}
 
-	scanner := bufio.NewScanner(r)
-	go bootcScan(scanner, tracker, up.Config.Logger, slog.LevelDebug)
-	err = cmd.Wait()
+		go func() {
+			bootcScan(bufio.NewScanner(r), tracker, up.Config.Logger, slog.LevelDebug)
+			r.Close() //nolint:errcheck
+		}()
+		err = cmd.Wait()
+		return errb.Bytes(), err
+	})
 
-	tmpout := CommandOutput{}.New(errb.Bytes(), err)
+	tmpout := CommandOutput{}.New(out, err)
+	tmpout.Cli = cli
 	tmpout.Failure = err != nil
-	tmpout.Context = "System Update"
+	tmpout.Context = outputContext
 	finalOutput = append(finalOutput, *tmpout)
 	return &finalOutput, err
 }
@@ -189,9 +409,14 @@ func (up SystemUpdater) New(config UpdaterInitConfiguration) (SystemUpdater, err
 		Enabled:     !config.Ci,
 		DryRun:      config.DryRun,
 		Environment: config.Environment,
+		Retry:       retry.NewPolicy(conf.Retry),
+		Limits:      resources.NewLimits("system", conf.Limits),
 	}
 	up.Config.Logger = config.Logger.With(slog.String("module", strings.ToLower(up.Config.Title)))
 	up.BinaryPath = conf.BootcBinary
+	up.SkopeoPath = conf.SkopeoBinary
+	up.EnforceSignatures = conf.Signature.Enable
+	up.checked = new([]byte)
 
 	return up, nil
 }
@@ -206,12 +431,122 @@ func (up SystemUpdater) Check() (bool, error) {
 	if err != nil {
 		return true, err
 	}
+	if up.checked != nil {
+		*up.checked = out
+	}
 
 	updateNecessary := !strings.Contains(string(out), "No changes in:")
 	up.Config.Logger.Debug("Executed update check", slog.String("output", string(out)), slog.Bool("update", updateNecessary))
 	return updateNecessary, nil
 }
 
+// Estimate returns what the update downloads, from the layers bootc upgrade --check reports as added.
+// The output of an earlier Check gets reused, only forced updates check again
+func (up SystemUpdater) Estimate() ([]float64, error) {
+	weights := make([]float64, up.Steps())
+	if up.Config.DryRun || len(weights) == 0 {
+		return weights, nil
+	}
+
+	var out []byte
+	if up.checked != nil {
+		out = *up.checked
+	}
+	if len(out) == 0 {
+		var err error
+		cmd := exec.Command(up.BinaryPath, "upgrade", "--check")
+		if out, err = cmd.CombinedOutput(); err != nil {
+			return weights, err
+		}
+	}
+	if strings.Contains(string(out), "No changes in:") {
+		weights[0] = 1
+		return weights, nil
+	}
+	// e.g. "Added layers:     3     Size: 169.5 MB"
+	for _, line := range strings.Split(string(out), "\n") {
+		rest, found := strings.CutPrefix(strings.TrimSpace(line), "Added layers:")
+		if !found {
+			continue
+		}
+		_, size, found := strings.Cut(rest, "Size:")
+		if !found {
+			break
+		}
+		parsed, err := ParseSize(size)
+		if err != nil {
+			return weights, err
+		}
+		weights[0] = max(parsed, 1)
+		return weights, nil
+	}
+	return weights, fmt.Errorf("no added layers in the update check")
+}
+
+// VerifyImage makes sure the image gets verified when it's pulled: the booted deployment needs to use a signed transport
+// (unless switching to the image) and policy.json has to require sigstore signatures for it.
+// With a public key configured the cosign signature of what the image currently points to gets checked as well.
+// That check is advisory: the update pulls by tag and doesn't get pinned to the checked digest, as that would keep the
+// deployment on the digest instead of following the tag. The policy.json requirement is what protects the pull itself.
+func VerifyImage(driver SystemUpdateDriver, image string, rebase bool) error {
+	conf := appConfig.Get().Modules.System
+
+	if !rebase {
+		signed, err := driver.SignedTransport()
+		if err != nil {
+			return err
+		}
+		if !signed {
+			return fmt.Errorf("booted image %s doesn't use a signed transport", image)
+		}
+	}
+
+	policy, err := signature.ReadPolicy(conf.Signature.Policy)
+	if err != nil {
+		return err
+	}
+	if enforced, _ := policy.SigstoreKeys(image); !enforced {
+		return fmt.Errorf("%s doesn't require sigstore signatures for %s", conf.Signature.Policy, image)
+	}
+
+	if conf.Signature.PublicKey == "" {
+		return nil
+	}
+	digest, err := imageref.Digest(conf.SkopeoBinary, image)
+	if err != nil {
+		return err
+	}
+	return signature.VerifyCosign(conf.SkopeoBinary, image, digest, conf.Signature.PublicKey)
+}
+
+// DownloadPending returns whether an earlier download-only run left an update to deploy.
+// Update checks don't report it anymore, as the image is already there
+func DownloadPending(driver SystemUpdateDriver) (bool, error) {
+	staged, err := driver.Staged()
+	if err != nil || !staged {
+		return false, err
+	}
+	required, err := driver.RebootRequired()
+	return !required, err
+}
+
+// ChannelImage returns the current image and the image of the given channel, which are the same if it's already on that channel.
+// The current image is the one of the deployment waiting for the reboot if there's one, so a switch only happens once
+func ChannelImage(driver SystemUpdateDriver, channel string) (string, string, error) {
+	booted, err := driver.Image()
+	if err != nil {
+		return "", "", err
+	}
+	current, err := driver.PendingImage()
+	if err != nil {
+		return "", "", err
+	}
+	if current == "" {
+		current = booted
+	}
+	return current, imageref.WithChannel(booted, channel), nil
+}
+
 func BootcCompatible(binaryPath string) bool {
 	cmd := exec.Command(binaryPath, "status", "--format=json")
 	out, err := cmd.CombinedOutput()
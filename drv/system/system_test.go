@@ -1,11 +1,15 @@
 package system_test
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/ublue-os/uupd/drv/generic"
 	"github.com/ublue-os/uupd/drv/system"
 	appLogging "github.com/ublue-os/uupd/pkg/logging"
+	"github.com/ublue-os/uupd/pkg/percent"
 )
 
 func InitBaseConfig() system.SystemUpdater {
@@ -33,3 +37,138 @@ func TestProperSteps(t *testing.T) {
 		t.Fatalf("Expected steps to be added")
 	}
 }
+
+func TestStagedDryRun(t *testing.T) {
+	systemUpdater := InitBaseConfig()
+
+	staged, err := systemUpdater.Staged()
+	if err != nil {
+		t.Fatalf("Failed checking for staged updates: %v", err)
+	}
+	if staged {
+		t.Fatalf("Expected nothing to be staged on a dry run")
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	systemUpdater := InitBaseConfig()
+	systemUpdater.Config.Enabled = true
+	if weights, err := systemUpdater.Estimate(); err != nil || len(weights) != 1 || weights[0] != 0 {
+		t.Fatalf("Expected no estimate on a dry run, got: %v %v", weights, err)
+	}
+
+	// bootc upgrade --check printing the manifest diff of the update
+	bootc := filepath.Join(t.TempDir(), "bootc")
+	script := `#!/bin/sh
+cat <<EOF
+Update available for: docker://ghcr.io/ublue-os/bluefin:stable
+  Version: 41.20250101.0
+  Digest: sha256:0123
+Total new layers: 65    Size: 1.1 GB
+Removed layers:   2     Size: 169.5 MB
+Added layers:     3     Size: 170.2 MB
+EOF
+`
+	if err := os.WriteFile(bootc, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake bootc: %v", err)
+	}
+	systemUpdater.Config.DryRun = false
+	systemUpdater.BinaryPath = bootc
+	weights, err := systemUpdater.Estimate()
+	if err != nil {
+		t.Fatalf("unable to estimate: %v", err)
+	}
+	if len(weights) != 1 || weights[0] != 170.2e6 {
+		t.Fatalf("Expected the size of the added layers, got: %v", weights)
+	}
+
+	// the estimate reuses the output of the update check instead of asking the registry again
+	if _, err := systemUpdater.Check(); err != nil {
+		t.Fatalf("unable to check: %v", err)
+	}
+	if err := os.WriteFile(bootc, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("unable to write fake bootc: %v", err)
+	}
+	if weights, err := systemUpdater.Estimate(); err != nil || weights[0] != 170.2e6 {
+		t.Fatalf("Expected the estimate of the checked update, got: %v %v", weights, err)
+	}
+}
+
+// fakeBootc keeps the state of its staged deployment in a file next to it
+const fakeBootc = `#!/bin/sh
+state="$(dirname "$0")/state"
+booted='{"image":{"image":{"image":"ghcr.io/ublue-os/bluefin:stable"}}}'
+case "$1 $2" in
+"upgrade --help")
+	echo "      --download-only  Download and stage the update without applying it"
+	;;
+"upgrade --check")
+	if [ -s "$state" ]; then echo "No changes in: docker://ghcr.io/ublue-os/bluefin:stable"; else echo "Update available"; fi
+	;;
+"status --format=json")
+	case "$(cat "$state")" in
+	downloaded) echo '{"status":{"booted":'"$booted"',"staged":{"downloadOnly":true,"image":{"image":{"image":"ghcr.io/ublue-os/bluefin:stable"},"imageDigest":"sha256:0123"}}}}' ;;
+	deployed) echo '{"status":{"booted":'"$booted"',"staged":{"downloadOnly":false,"image":{"image":{"image":"ghcr.io/ublue-os/bluefin:testing"},"imageDigest":"sha256:0123"}}}}' ;;
+	*) echo '{"status":{"booted":'"$booted"'}}' ;;
+	esac
+	;;
+upgrade*)
+	case "$*" in
+	*--download-only*) echo downloaded >"$state" ;;
+	*) echo deployed >"$state" ;;
+	esac
+	;;
+esac
+`
+
+func TestDownloadOnly(t *testing.T) {
+	dir := t.TempDir()
+	bootc := filepath.Join(dir, "bootc")
+	if err := os.WriteFile(bootc, []byte(fakeBootc), 0755); err != nil {
+		t.Fatalf("unable to write fake bootc: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "state"), nil, 0644); err != nil {
+		t.Fatalf("unable to write fake bootc state: %v", err)
+	}
+	systemUpdater := InitBaseConfig()
+	systemUpdater.Config.DryRun = false
+	systemUpdater.BinaryPath = bootc
+	tracker := percent.NewIncrementer(nil, 1)
+
+	if _, err := systemUpdater.Fetch(&tracker); err != nil {
+		t.Fatalf("unable to fetch: %v", err)
+	}
+	if required, err := systemUpdater.RebootRequired(); err != nil || required {
+		t.Fatalf("Expected a download-only update to not need a reboot, got: %v %v", required, err)
+	}
+	// the next update check doesn't see the downloaded update
+	if available, err := systemUpdater.Check(); err != nil || available {
+		t.Fatalf("Expected no update to be available after downloading it, got: %v %v", available, err)
+	}
+	if pending, err := system.DownloadPending(systemUpdater); err != nil || !pending {
+		t.Fatalf("Expected the downloaded update to be pending, got: %v %v", pending, err)
+	}
+
+	out, err := systemUpdater.Update(&tracker)
+	if err != nil {
+		t.Fatalf("unable to update: %v", err)
+	}
+	if cli := (*out)[0].Cli; !slices.Contains(cli, "--from-downloaded") {
+		t.Fatalf("Expected the downloaded update to be deployed, got: %v", cli)
+	}
+	if required, err := systemUpdater.RebootRequired(); err != nil || !required {
+		t.Fatalf("Expected the deployed update to need a reboot, got: %v %v", required, err)
+	}
+	if pending, _ := system.DownloadPending(systemUpdater); pending {
+		t.Fatalf("Expected nothing left to deploy")
+	}
+
+	// the deployed update already switched channels, the next run doesn't switch again
+	current, target, err := system.ChannelImage(systemUpdater, "testing")
+	if err != nil || current != target {
+		t.Fatalf("Expected the pending deployment to be on the channel, got: %s %s %v", current, target, err)
+	}
+	if current, target, _ := system.ChannelImage(systemUpdater, "latest"); current == target || target != "ghcr.io/ublue-os/bluefin:latest" {
+		t.Fatalf("Expected a switch to another channel, got: %s %s", current, target)
+	}
+}
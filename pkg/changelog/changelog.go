@@ -0,0 +1,165 @@
+package changelog
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	ChangeAdded      = "added"
+	ChangeRemoved    = "removed"
+	ChangeUpgraded   = "upgraded"
+	ChangeDowngraded = "downgraded"
+)
+
+// Change is a package that differs between the booted and the staged deployment
+type Change struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// Changelog is what a pending system update changes
+type Changelog struct {
+	// Image version (or commit) of the booted and staged deployments
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Packages []Change `json:"packages"`
+}
+
+// Counts returns how many packages got added, removed, upgraded and downgraded
+func (c Changelog) Counts() map[string]int {
+	counts := map[string]int{}
+	for _, change := range c.Packages {
+		counts[change.Change] += 1
+	}
+	return counts
+}
+
+func change(name string, from string, to string) Change {
+	switch {
+	case from == "":
+		return Change{Name: name, Change: ChangeAdded, To: to}
+	case to == "":
+		return Change{Name: name, Change: ChangeRemoved, From: from}
+	case CompareEVR(from, to) > 0:
+		return Change{Name: name, Change: ChangeDowngraded, From: from, To: to}
+	}
+	return Change{Name: name, Change: ChangeUpgraded, From: from, To: to}
+}
+
+// Diff compares two package lists (name.arch to every installed [epoch:]version-release), sorted by name
+// Packages installed more than once (kernels, gpg-pubkey) only show the versions that differ, oldest removed ones paired with the oldest added ones
+func Diff(before map[string][]string, after map[string][]string) []Change {
+	var changes []Change
+	names := slices.Collect(maps.Keys(before))
+	for name := range after {
+		if _, exists := before[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		removed := slices.DeleteFunc(slices.Clone(before[name]), func(evr string) bool { return slices.Contains(after[name], evr) })
+		added := slices.DeleteFunc(slices.Clone(after[name]), func(evr string) bool { return slices.Contains(before[name], evr) })
+		for i := range max(len(removed), len(added)) {
+			var from, to string
+			if i < len(removed) {
+				from = removed[i]
+			}
+			if i < len(added) {
+				to = added[i]
+			}
+			changes = append(changes, change(name, from, to))
+		}
+	}
+	slices.SortFunc(changes, func(a, b Change) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), CompareEVR(a.From, b.From), CompareEVR(a.To, b.To))
+	})
+	return changes
+}
+
+// ParseRpmList parses "rpm -qa --qf '%{NAME}\t%{ARCH}\t%{EPOCHNUM}:%{VERSION}-%{RELEASE}\n'" into name.arch and every version of it, oldest first,
+// leaving out zero epochs. Packages without an arch (gpg-pubkey) are only keyed by name
+func ParseRpmList(data []byte) map[string][]string {
+	packages := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(fields) != 3 || fields[0] == "" {
+			continue
+		}
+		name, arch, evr := fields[0], fields[1], fields[2]
+		if arch != "" && arch != "(none)" {
+			name += "." + arch
+		}
+		packages[name] = append(packages[name], strings.TrimPrefix(evr, "0:"))
+	}
+	for _, evrs := range packages {
+		slices.SortFunc(evrs, CompareEVR)
+	}
+	return packages
+}
+
+// ParseRpmOstreeDiff parses the package diff of "rpm-ostree db diff --format=json"
+func ParseRpmOstreeDiff(data []byte) ([]Change, error) {
+	var diff struct {
+		PkgDiff [][]json.RawMessage `json:"pkgdiff"`
+	}
+	if err := json.Unmarshal(data, &diff); err != nil {
+		return nil, fmt.Errorf("unable to parse rpm-ostree db diff: %w", err)
+	}
+
+	var changes []Change
+	for _, entry := range diff.PkgDiff {
+		// [name, type, {"PreviousPackage": [name, evr, arch], "NewPackage": [name, evr, arch]}]
+		if len(entry) < 3 {
+			return nil, fmt.Errorf("unexpected package diff entry: %v", entry)
+		}
+		var name string
+		var packages map[string][]string
+		if err := json.Unmarshal(entry[0], &name); err != nil {
+			return nil, fmt.Errorf("unexpected package name: %s", entry[0])
+		}
+		if err := json.Unmarshal(entry[2], &packages); err != nil {
+			return nil, fmt.Errorf("unexpected package diff details: %s", entry[2])
+		}
+		evr := func(key string) string {
+			if nevra := packages[key]; len(nevra) >= 2 {
+				return nevra[1]
+			}
+			return ""
+		}
+		changes = append(changes, change(name, evr("PreviousPackage"), evr("NewPackage")))
+	}
+	slices.SortFunc(changes, func(a, b Change) int { return strings.Compare(a.Name, b.Name) })
+	return changes, nil
+}
+
+// Write writes the changelog as a "table" or as "json"
+func Write(w io.Writer, changelog Changelog, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(changelog)
+	case "table":
+		fmt.Fprintf(w, "%s -> %s\n\n", changelog.From, changelog.To) //nolint:errcheck
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PACKAGE\tCHANGE\tFROM\tTO") //nolint:errcheck
+		for _, change := range changelog.Packages {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", change.Name, change.Change, change.From, change.To) //nolint:errcheck
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown changelog format: %s, expected table or json", format)
+	}
+}
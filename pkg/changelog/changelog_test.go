@@ -0,0 +1,124 @@
+package changelog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ublue-os/uupd/pkg/changelog"
+)
+
+func TestCompareEVR(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0-1", "1.0-1", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1.10-1", "1.9-1", 1},
+		{"1.0-1", "1.0.1-1", -1},
+		{"1:1.0-1", "2.0-1", 1},
+		{"1.0~rc1-1", "1.0-1", -1},
+		{"1.0^git1-1", "1.0-1", 1},
+		{"1.0^git1-1", "1.0.1-1", -1},
+		{"6.11.3-300.fc41", "6.11.10-200.fc41", -1},
+		{"1.0a-1", "1.0-1", 1},
+		{"1.0a-1", "1.0.1-1", -1},
+		{"001-1", "1-1", 0},
+	}
+	for _, c := range cases {
+		if result := changelog.CompareEVR(c.a, c.b); result != c.expected {
+			t.Fatalf("Comparing %s to %s returned %d, expected %d", c.a, c.b, result, c.expected)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := changelog.ParseRpmList([]byte("kernel\tx86_64\t0:6.11.3-300.fc41\nmesa-dri-drivers\tx86_64\t0:24.2.4-1.fc41\nfoo\tnoarch\t1:1.0-1.fc41\nbar\tx86_64\t0:2.0-1.fc41\n"))
+	after := changelog.ParseRpmList([]byte("kernel\tx86_64\t0:6.11.4-301.fc41\nmesa-dri-drivers\tx86_64\t0:24.2.4-1.fc41\nfoo\tnoarch\t1:0.9-1.fc41\nbaz\tx86_64\t0:1.0-1.fc41\n"))
+
+	expected := []changelog.Change{
+		{Name: "bar.x86_64", Change: changelog.ChangeRemoved, From: "2.0-1.fc41"},
+		{Name: "baz.x86_64", Change: changelog.ChangeAdded, To: "1.0-1.fc41"},
+		{Name: "foo.noarch", Change: changelog.ChangeDowngraded, From: "1:1.0-1.fc41", To: "1:0.9-1.fc41"},
+		{Name: "kernel.x86_64", Change: changelog.ChangeUpgraded, From: "6.11.3-300.fc41", To: "6.11.4-301.fc41"},
+	}
+	if changes := changelog.Diff(before, after); !slices.Equal(changes, expected) {
+		t.Fatalf("Unexpected diff: %v, expected %v", changes, expected)
+	}
+}
+
+func TestDiffInstalledTwice(t *testing.T) {
+	before := changelog.ParseRpmList([]byte("kernel\tx86_64\t0:6.11.4-301.fc41\nkernel\tx86_64\t0:6.11.3-300.fc41\nglibc\tx86_64\t0:2.40-1.fc41\nglibc\ti686\t0:2.40-1.fc41\ngpg-pubkey\t(none)\t0:aaaa-1\ngpg-pubkey\t(none)\t0:bbbb-1\n"))
+	after := changelog.ParseRpmList([]byte("kernel\tx86_64\t0:6.11.5-300.fc41\nkernel\tx86_64\t0:6.11.4-301.fc41\nglibc\tx86_64\t0:2.40-2.fc41\nglibc\ti686\t0:2.40-1.fc41\ngpg-pubkey\t(none)\t0:bbbb-1\ngpg-pubkey\t(none)\t0:aaaa-1\n"))
+
+	expected := []changelog.Change{
+		{Name: "glibc.x86_64", Change: changelog.ChangeUpgraded, From: "2.40-1.fc41", To: "2.40-2.fc41"},
+		{Name: "kernel.x86_64", Change: changelog.ChangeUpgraded, From: "6.11.3-300.fc41", To: "6.11.5-300.fc41"},
+	}
+	if changes := changelog.Diff(before, after); !slices.Equal(changes, expected) {
+		t.Fatalf("Unexpected diff: %v, expected %v", changes, expected)
+	}
+}
+
+func TestParseRpmOstreeDiff(t *testing.T) {
+	data := []byte(`{
+		"ostree-commit-from": "a1",
+		"ostree-commit-to": "b2",
+		"pkgdiff": [
+			["kernel", 3, {"PreviousPackage": ["kernel", "6.11.3-300.fc41", "x86_64"], "NewPackage": ["kernel", "6.11.4-301.fc41", "x86_64"]}],
+			["foo", 2, {"NewPackage": ["foo", "1.0-1.fc41", "x86_64"]}],
+			["bar", 1, {"PreviousPackage": ["bar", "2.0-1.fc41", "noarch"]}]
+		]
+	}`)
+	changes, err := changelog.ParseRpmOstreeDiff(data)
+	if err != nil {
+		t.Fatalf("Failed parsing diff: %v", err)
+	}
+	expected := []changelog.Change{
+		{Name: "bar", Change: changelog.ChangeRemoved, From: "2.0-1.fc41"},
+		{Name: "foo", Change: changelog.ChangeAdded, To: "1.0-1.fc41"},
+		{Name: "kernel", Change: changelog.ChangeUpgraded, From: "6.11.3-300.fc41", To: "6.11.4-301.fc41"},
+	}
+	if !slices.Equal(changes, expected) {
+		t.Fatalf("Unexpected diff: %v, expected %v", changes, expected)
+	}
+
+	if _, err := changelog.ParseRpmOstreeDiff([]byte(`{"pkgdiff": [["kernel"]]}`)); err == nil {
+		t.Fatalf("Malformed diff accepted")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	log := changelog.Changelog{
+		From:     "41.20250101",
+		To:       "41.20250102",
+		Packages: []changelog.Change{{Name: "kernel", Change: changelog.ChangeUpgraded, From: "6.11.3", To: "6.11.4"}},
+	}
+
+	var table bytes.Buffer
+	if err := changelog.Write(&table, log, "table"); err != nil {
+		t.Fatalf("Failed writing table: %v", err)
+	}
+	if !strings.Contains(table.String(), "41.20250101 -> 41.20250102") || !strings.Contains(table.String(), "kernel") {
+		t.Fatalf("Unexpected table: %s", table.String())
+	}
+
+	var out bytes.Buffer
+	if err := changelog.Write(&out, log, "json"); err != nil {
+		t.Fatalf("Failed writing json: %v", err)
+	}
+	var decoded changelog.Changelog
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed decoding json: %v", err)
+	}
+	if decoded.To != log.To || !slices.Equal(decoded.Packages, log.Packages) {
+		t.Fatalf("Unexpected json: %s", out.String())
+	}
+
+	if err := changelog.Write(&out, log, "yaml"); err == nil {
+		t.Fatalf("Unknown format accepted")
+	}
+}
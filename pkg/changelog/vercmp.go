@@ -0,0 +1,115 @@
+package changelog
+
+import (
+	"strings"
+	"unicode"
+)
+
+func splitEVR(evr string) (string, string, string) {
+	epoch, rest, found := strings.Cut(evr, ":")
+	if !found {
+		epoch, rest = "0", evr
+	}
+	version, release, _ := strings.Cut(rest, "-")
+	return epoch, version, release
+}
+
+// CompareEVR compares two [epoch:]version-release strings like rpm does
+func CompareEVR(a string, b string) int {
+	aEpoch, aVersion, aRelease := splitEVR(a)
+	bEpoch, bVersion, bRelease := splitEVR(b)
+	if result := rpmvercmp(aEpoch, bEpoch); result != 0 {
+		return result
+	}
+	if result := rpmvercmp(aVersion, bVersion); result != 0 {
+		return result
+	}
+	return rpmvercmp(aRelease, bRelease)
+}
+
+func isSeparator(r byte) bool {
+	return !(r < 128 && (unicode.IsLetter(rune(r)) || unicode.IsDigit(rune(r)))) && r != '~' && r != '^'
+}
+
+// rpmvercmp follows rpmvercmp() from rpm: alphanumeric segments are compared one by one,
+// "~" sorts before everything and "^" after the end of a version but before anything else
+func rpmvercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	for len(a) > 0 || len(b) > 0 {
+		// anything that isn't alphanumeric ASCII, "~" or "^" separates segments
+		separator := func(r rune) bool { return r >= 128 || isSeparator(byte(r)) }
+		a = strings.TrimLeftFunc(a, separator)
+		b = strings.TrimLeftFunc(b, separator)
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			switch {
+			case len(a) == 0:
+				return -1
+			case len(b) == 0:
+				return 1
+			case !strings.HasPrefix(a, "^"):
+				return 1
+			case !strings.HasPrefix(b, "^"):
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		numeric := unicode.IsDigit(rune(a[0]))
+		segment := func(s string) (string, string) {
+			i := 0
+			for i < len(s) && s[i] < 128 && !isSeparator(s[i]) && s[i] != '~' && s[i] != '^' && unicode.IsDigit(rune(s[i])) == numeric {
+				i++
+			}
+			return s[:i], s[i:]
+		}
+		aSegment, aRest := segment(a)
+		bSegment, bRest := segment(b)
+		if len(bSegment) == 0 {
+			// numeric segments are newer than alphabetic ones
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			aSegment = strings.TrimLeft(aSegment, "0")
+			bSegment = strings.TrimLeft(bSegment, "0")
+			if len(aSegment) != len(bSegment) {
+				if len(aSegment) > len(bSegment) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if result := strings.Compare(aSegment, bSegment); result != 0 {
+			return result
+		}
+		a, b = aRest, bRest
+	}
+
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	}
+	return 1
+}
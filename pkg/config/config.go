@@ -3,45 +3,263 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+type Notifications struct {
+	// How long to wait for users to answer the reboot prompt, 0 doesn't wait
+	ActionTimeout time.Duration `mapstructure:"action-timeout"`
+	// "HH:MM" range in which no notifications get shown, can wrap around midnight
+	QuietHours struct {
+		Start string `mapstructure:"start"`
+		End   string `mapstructure:"end"`
+	} `mapstructure:"quiet-hours"`
+	// Names of users that never get notified
+	OptOut []string `mapstructure:"opt-out"`
+	// Notifications kept for users that log in later
+	Pending struct {
+		Enable bool          `mapstructure:"enable"`
+		Expiry time.Duration `mapstructure:"expiry"`
+		Path   string        `mapstructure:"path"`
+	} `mapstructure:"pending"`
+	Events struct {
+		UpdateStaged  NotificationEvent `mapstructure:"update-staged"`
+		RebootPending NotificationEvent `mapstructure:"reboot-pending"`
+		ModuleFailed  NotificationEvent `mapstructure:"module-failed"`
+		ChecksSkipped NotificationEvent `mapstructure:"checks-skipped"`
+		ImageOutdated NotificationEvent `mapstructure:"image-outdated"`
+	} `mapstructure:"events"`
+	// Sinks getting the report at the end of every run, for machines nobody logs into
+	Webhooks []Webhook `mapstructure:"webhooks"`
+	Push     []Push    `mapstructure:"push"`
+	Email    Email     `mapstructure:"email"`
+}
+
+// Email sends the run report, or a digest of several runs, to the admins
+type Email struct {
+	Enable bool     `mapstructure:"enable"`
+	From   string   `mapstructure:"from"`
+	To     []string `mapstructure:"to"`
+	// "always", "failure" or "digest"
+	When           string        `mapstructure:"when"`
+	DigestInterval time.Duration `mapstructure:"digest-interval"`
+	// Runs waiting for the next digest
+	State string `mapstructure:"state"`
+	// "smtp" or "sendmail"
+	Transport string `mapstructure:"transport"`
+	Sendmail  string `mapstructure:"sendmail"`
+	SMTP      struct {
+		Host     string `mapstructure:"host"`
+		Port     int    `mapstructure:"port"`
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+		// Root-only file with the password, see ReadSecret
+		PasswordFile string `mapstructure:"password-file"`
+		// "starttls", "tls" or "none"
+		Security string        `mapstructure:"security"`
+		Timeout  time.Duration `mapstructure:"timeout"`
+	} `mapstructure:"smtp"`
+}
+
+// Webhook gets the run report POSTed as json
+type Webhook struct {
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	// Root-only file with more headers, one "Name: value" per line, see ReadSecret
+	HeadersFile string `mapstructure:"headers-file"`
+	// "always" or "failure"
+	When    string        `mapstructure:"when"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// Push sends a short summary of the run to an ntfy topic or a Gotify server
+type Push struct {
+	// "ntfy" or "gotify"
+	Service string `mapstructure:"service"`
+	URL     string `mapstructure:"url"`
+	// ntfy access token or Gotify application token
+	Token string `mapstructure:"token"`
+	// Root-only file with the token, see ReadSecret
+	TokenFile string        `mapstructure:"token-file"`
+	When      string        `mapstructure:"when"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+}
+
+type NotificationEvent struct {
+	Enable  bool   `mapstructure:"enable"`
+	Urgency string `mapstructure:"urgency"`
+	Icon    string `mapstructure:"icon"`
+	// text/template strings, see the notify package for the available fields
+	Summary string `mapstructure:"summary"`
+	Body    string `mapstructure:"body"`
+}
+
+type Retry struct {
+	Attempts   int           `mapstructure:"attempts"`
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max-backoff"`
+	RetryOn    []string      `mapstructure:"retry-on"`
+}
+
+// Per-module overrides of the global limits, unset ones inherit them
+type ModuleLimits struct {
+	Nice      *int    `mapstructure:"nice"`
+	IOClass   *string `mapstructure:"io-class"`
+	CpuWeight *int    `mapstructure:"cpu-weight"`
+	IoWeight  *int    `mapstructure:"io-weight"`
+}
+
 type Config struct {
 	Modules struct {
 		Flatpak struct {
-			Disable    bool   `mapstructure:"disable"`
-			BinaryPath string `mapstructure:"binary-path"`
+			Disable    bool         `mapstructure:"disable"`
+			BinaryPath string       `mapstructure:"binary-path"`
+			Retry      Retry        `mapstructure:"retry"`
+			After      []string     `mapstructure:"after"`
+			Limits     ModuleLimits `mapstructure:"limits"`
 		} `mapstructure:"flatpak"`
 
 		Brew struct {
-			Disable    bool   `mapstructure:"disable"`
-			Prefix     string `mapstructure:"prefix"`
-			Repository string `mapstructure:"repository"`
-			Cellar     string `mapstructure:"cellar"`
-			Path       string `mapstructure:"path"`
+			Disable    bool         `mapstructure:"disable"`
+			Prefix     string       `mapstructure:"prefix"`
+			Repository string       `mapstructure:"repository"`
+			Cellar     string       `mapstructure:"cellar"`
+			Path       string       `mapstructure:"path"`
+			Retry      Retry        `mapstructure:"retry"`
+			After      []string     `mapstructure:"after"`
+			Limits     ModuleLimits `mapstructure:"limits"`
 		} `mapstructure:"brew"`
 
 		System struct {
-			Disable         bool   `mapstructure:"disable"`
-			RpmOstreeBinary string `mapstructure:"rpm-ostree-binary"`
-			BootcBinary     string `mapstructure:"bootc-binary"`
-			SkopeoBinary    string `mapstructure:"skopeo-binary"`
+			Disable         bool         `mapstructure:"disable"`
+			RpmOstreeBinary string       `mapstructure:"rpm-ostree-binary"`
+			BootcBinary     string       `mapstructure:"bootc-binary"`
+			SkopeoBinary    string       `mapstructure:"skopeo-binary"`
+			Retry           Retry        `mapstructure:"retry"`
+			After           []string     `mapstructure:"after"`
+			Limits          ModuleLimits `mapstructure:"limits"`
+			// Only download (and stage) system updates, a later run without it deploys them
+			DownloadOnly bool `mapstructure:"download-only"`
+			// Tag (e.g. "stable", "testing", a dated tag) or "sha256:" digest of the booted image to follow
+			Channel   string `mapstructure:"channel"`
+			Signature struct {
+				// Refuse system updates unless the image is verified on pull
+				Enable bool   `mapstructure:"enable"`
+				Policy string `mapstructure:"policy"`
+				// Optional cosign public key the new image gets checked against before updating
+				PublicKey string `mapstructure:"public-key"`
+			} `mapstructure:"signature"`
 		} `mapstructure:"system"`
 
 		Distrobox struct {
-			Disable    bool   `mapstructure:"disable"`
-			BinaryPath string `mapstructure:"binary-path"`
+			Disable    bool         `mapstructure:"disable"`
+			BinaryPath string       `mapstructure:"binary-path"`
+			Retry      Retry        `mapstructure:"retry"`
+			After      []string     `mapstructure:"after"`
+			Limits     ModuleLimits `mapstructure:"limits"`
 		} `mapstructure:"distrobox"`
 	} `mapstructure:"modules"`
 
+	Limits struct {
+		Enable              bool     `mapstructure:"enable"`
+		Slice               string   `mapstructure:"slice"`
+		NetworkMaxBytes     uint64   `mapstructure:"network-max-bytes-per-sec"`
+		Nice                int      `mapstructure:"nice"`
+		IOClass             string   `mapstructure:"io-class"`
+		CpuWeight           int      `mapstructure:"cpu-weight"`
+		IoWeight            int      `mapstructure:"io-weight"`
+		IoReadBandwidthMax  []string `mapstructure:"io-read-bandwidth-max"`
+		IoWriteBandwidthMax []string `mapstructure:"io-write-bandwidth-max"`
+	} `mapstructure:"limits"`
+
+	Systemd struct {
+		// How long a run may go without reporting progress before the watchdog stops getting pinged
+		StallTimeout time.Duration `mapstructure:"stall-timeout"`
+	} `mapstructure:"systemd"`
+
+	Progress struct {
+		// "auto", "fancy", "plain", "osc-only" or "none"
+		Mode string `mapstructure:"mode"`
+	} `mapstructure:"progress"`
+
+	// Full output of every module, one directory per run
+	Logs struct {
+		Enable bool   `mapstructure:"enable"`
+		Path   string `mapstructure:"path"`
+		// Amount of runs kept
+		Keep   int           `mapstructure:"keep"`
+		MaxAge time.Duration `mapstructure:"max-age"`
+	} `mapstructure:"logs"`
+
+	// node_exporter textfile collector metrics
+	Metrics struct {
+		Enable bool   `mapstructure:"enable"`
+		Path   string `mapstructure:"path"`
+	} `mapstructure:"metrics"`
+
+	Executor struct {
+		Concurrency     int `mapstructure:"concurrency"`
+		UserConcurrency int `mapstructure:"user-concurrency"`
+	} `mapstructure:"executor"`
+
+	Notifications Notifications `mapstructure:"notifications"`
+
 	Checks struct {
 		Hardware struct {
 			Enable            bool   `mapstructure:"enable"`
 			BatteryMinPercent int    `mapstructure:"bat-min-percent"`
 			NetMaxBytes       uint64 `mapstructure:"net-max-bytes"`
-			MemMaxPercent     int    `mapstructure:"mem-max-percent"`
-			CpuMaxPercent     int    `mapstructure:"cpu-max-percent"`
+			// Interfaces to sample, defaults to the ones NetworkManager uses for the default route
+			NetInterfacesInclude []string      `mapstructure:"net-interfaces-include"`
+			NetInterfacesExclude []string      `mapstructure:"net-interfaces-exclude"`
+			NetSampleWindow      time.Duration `mapstructure:"net-sample-window"`
+			NetRetries           int           `mapstructure:"net-retries"`
+			NetRetryInterval     time.Duration `mapstructure:"net-retry-interval"`
+			MemMaxPercent        int           `mapstructure:"mem-max-percent"`
+			CpuMaxPercent        int           `mapstructure:"cpu-max-percent"`
+			RequireAc            bool          `mapstructure:"require-ac"`
+			ThermalMaxCelsius    int           `mapstructure:"thermal-max-celsius"`
+			RequireIdle          bool          `mapstructure:"require-idle"`
+			IdleMinSeconds       int           `mapstructure:"idle-min-seconds"`
+			// Estimated free space (in bytes) each module needs to update
+			DiskEstimates struct {
+				System    uint64 `mapstructure:"system"`
+				Flatpak   uint64 `mapstructure:"flatpak"`
+				Distrobox uint64 `mapstructure:"distrobox"`
+				Brew      uint64 `mapstructure:"brew"`
+			} `mapstructure:"disk-estimates"`
+			EnabledChecks struct {
+				Battery bool `mapstructure:"battery"`
+				Network bool `mapstructure:"network"`
+				Cpu     bool `mapstructure:"cpu"`
+				Memory  bool `mapstructure:"memory"`
+				Ac      bool `mapstructure:"ac"`
+				Thermal bool `mapstructure:"thermal"`
+				Idle    bool `mapstructure:"idle"`
+				Disk    bool `mapstructure:"disk"`
+			} `mapstructure:"enabled-checks"`
+			// Rules for the connections updates may run on, "id:<glob>", "ssid:<glob>" or "type:<glob>"
+			Connections struct {
+				Allow []string `mapstructure:"allow"`
+				Deny  []string `mapstructure:"deny"`
+			} `mapstructure:"connections"`
+			// What each module does on metered connections: "skip", "check-only" or "allow"
+			Metered struct {
+				System    string `mapstructure:"system"`
+				Flatpak   string `mapstructure:"flatpak"`
+				Distrobox string `mapstructure:"distrobox"`
+				Brew      string `mapstructure:"brew"`
+			} `mapstructure:"metered"`
+			// How "unknown" results (e.g. no UPower or network service to ask) count: "pass" or "fail"
+			OnUnknown string `mapstructure:"on-unknown"`
+			// URL (http/https) or "dns:<hostname>" probed for connectivity when neither NetworkManager nor systemd-networkd are running
+			ConnectivityProbe string `mapstructure:"connectivity-probe"`
+			// "fail" fails right away, "wait" polls the checks until they pass or WaitTimeout runs out
+			Mode         string        `mapstructure:"mode"`
+			WaitTimeout  time.Duration `mapstructure:"wait-timeout"`
+			WaitInterval time.Duration `mapstructure:"wait-interval"`
 		} `mapstructure:"hardware"`
 	} `mapstructure:"checks"`
 }
@@ -63,25 +281,162 @@ func defaults() {
 	d("modules.system.rpm-ostree-binary", "/usr/bin/rpm-ostree")
 	d("modules.system.bootc-binary", "/usr/bin/bootc")
 	d("modules.system.skopeo-binary", "/usr/bin/skopeo")
+	d("modules.system.download-only", false)
+	d("modules.system.channel", "")
+	d("modules.system.signature.enable", false)
+	d("modules.system.signature.policy", "/etc/containers/policy.json")
+	d("modules.system.signature.public-key", "")
 
 	d("modules.distrobox.disable", false)
 	d("modules.distrobox.binary-path", "/usr/bin/distrobox")
 
+	// retries for transient failures, applied per module (and per user for multi-user modules)
+	for _, module := range []string{"flatpak", "brew", "system", "distrobox"} {
+		d("modules."+module+".retry.attempts", 3)
+		d("modules."+module+".retry.backoff", "15s")
+		d("modules."+module+".retry.max-backoff", "2m")
+		d("modules."+module+".retry.retry-on", []string{"network", "lock"})
+	}
+
+	// modules that need to finish before a module starts
+	d("modules.system.after", []string{})
+	d("modules.brew.after", []string{"system"})
+	d("modules.flatpak.after", []string{"system"})
+	d("modules.distrobox.after", []string{"flatpak"})
+
+	// watchdog of the systemd service
+	d("systemd.stall-timeout", "2h")
+
+	// how the progress of a run is shown
+	d("progress.mode", "auto")
+	_ = e("progress.mode", "UUPD_PROGRESS")
+
+	// full output of every module per run
+	d("logs.enable", true)
+	d("logs.path", "/var/log/uupd")
+	d("logs.keep", 10)
+	d("logs.max-age", "720h")
+
+	// node_exporter textfile collector metrics
+	d("metrics.enable", false)
+	d("metrics.path", "/var/lib/node_exporter/textfile_collector/uupd.prom")
+
+	// amount of modules and per-user steps ran at the same time
+	d("executor.concurrency", 1)
+	d("executor.user-concurrency", 1)
+
+	_ = e("executor.concurrency", "UUPD_CONCURRENCY")
+	_ = e("executor.user-concurrency", "UUPD_USER_CONCURRENCY")
+
+	d("notifications.action-timeout", "0s")
+	d("notifications.quiet-hours.start", "")
+	d("notifications.quiet-hours.end", "")
+	d("notifications.opt-out", []string{})
+	d("notifications.webhooks", []Webhook{})
+	d("notifications.push", []Push{})
+	d("notifications.email.enable", false)
+	d("notifications.email.from", "")
+	d("notifications.email.to", []string{})
+	d("notifications.email.when", "failure")
+	d("notifications.email.digest-interval", "168h")
+	d("notifications.email.state", "/var/lib/uupd/email-digest.json")
+	d("notifications.email.transport", "sendmail")
+	d("notifications.email.sendmail", "/usr/sbin/sendmail")
+	d("notifications.email.smtp.host", "localhost")
+	d("notifications.email.smtp.port", 587)
+	d("notifications.email.smtp.username", "")
+	d("notifications.email.smtp.password", "")
+	d("notifications.email.smtp.password-file", "")
+	d("notifications.email.smtp.security", "starttls")
+	d("notifications.email.smtp.timeout", "30s")
+	d("notifications.pending.enable", true)
+	d("notifications.pending.expiry", "72h")
+	d("notifications.pending.path", "/var/lib/uupd/notifications.json")
+	events := []struct {
+		name    string
+		enable  bool
+		urgency string
+		icon    string
+		summary string
+		body    string
+	}{
+		{"update-staged", false, "normal", "system-software-update", "System Update Downloaded", "The update to {{.To}} is staged and gets installed on the next run"},
+		{"reboot-pending", false, "normal", "system-reboot", "System Update Ready", "Reboot to finish installing the update to {{.To}}"},
+		{"module-failed", true, "critical", "dialog-error", "Some System Updates Failed", "Systems Failed: {{.Modules}}"},
+		{"checks-skipped", false, "low", "dialog-information", "Updates Skipped", "Updates didn't run: {{.Error}}"},
+		{"image-outdated", true, "critical", "dialog-warning", "System Warning", "There hasn't been an update in over a month. Consider rebooting or running updates manually"},
+	}
+	for _, event := range events {
+		d("notifications.events."+event.name+".enable", event.enable)
+		d("notifications.events."+event.name+".urgency", event.urgency)
+		d("notifications.events."+event.name+".icon", event.icon)
+		d("notifications.events."+event.name+".summary", event.summary)
+		d("notifications.events."+event.name+".body", event.body)
+	}
+
+	// resource limits for update commands
+	d("limits.enable", false)
+	d("limits.slice", "uupd.slice")
+	d("limits.network-max-bytes-per-sec", 0)
+	d("limits.nice", 0)
+	d("limits.io-class", "")
+	d("limits.cpu-weight", 0)
+	d("limits.io-weight", 0)
+	d("limits.io-read-bandwidth-max", []string{})
+	d("limits.io-write-bandwidth-max", []string{})
+
+	_ = e("limits.network-max-bytes-per-sec", "UUPD_NETWORK_MAX_BYTES_PER_SEC")
+
 	// checks
 	d("checks.hardware.enable", true)
 	d("checks.hardware.bat-min-percent", 20)
 	d("checks.hardware.net-max-bytes", 700000)
 	d("checks.hardware.mem-max-percent", 90)
 	d("checks.hardware.cpu-max-percent", 50)
+	d("checks.hardware.net-interfaces-include", []string{})
+	d("checks.hardware.net-interfaces-exclude", []string{"lo", "podman*", "veth*", "docker*", "virbr*", "br-*", "cni*", "tun*", "tap*", "wg*"})
+	d("checks.hardware.net-sample-window", "5s")
+	d("checks.hardware.net-retries", 6)
+	d("checks.hardware.net-retry-interval", "3s")
+	d("checks.hardware.require-ac", false)
+	// off until set, so existing installs don't start skipping runs
+	d("checks.hardware.thermal-max-celsius", 0)
+	d("checks.hardware.require-idle", false)
+	d("checks.hardware.idle-min-seconds", 300)
+	d("checks.hardware.disk-estimates.system", 2*1024*1024*1024)
+	d("checks.hardware.disk-estimates.flatpak", 1024*1024*1024)
+	d("checks.hardware.disk-estimates.distrobox", 512*1024*1024)
+	d("checks.hardware.disk-estimates.brew", 256*1024*1024)
+	for _, check := range []string{"battery", "network", "cpu", "memory", "ac", "thermal", "idle"} {
+		d("checks.hardware.enabled-checks."+check, true)
+	}
+	d("checks.hardware.enabled-checks.disk", false)
+	d("checks.hardware.connections.allow", []string{})
+	d("checks.hardware.connections.deny", []string{})
+	for _, module := range []string{"system", "flatpak", "distrobox", "brew"} {
+		d("checks.hardware.metered."+module, "skip")
+	}
+	d("checks.hardware.mode", "fail")
+	d("checks.hardware.on-unknown", "pass")
+	d("checks.hardware.connectivity-probe", "")
+	d("checks.hardware.wait-timeout", "1h")
+	d("checks.hardware.wait-interval", "1m")
 
 	_ = e("checks.hardware.bat-min-percent", "UUPD_BATTERY_MIN_PERCENT")
 	_ = e("checks.hardware.net-max-bytes", "UUPD_NETWORK_MAX_BYTES")
 	_ = e("checks.hardware.mem-max-percent", "UUPD_MEMORY_MAX_PERCENT")
 	_ = e("checks.hardware.cpu-max-percent", "UUPD_CPU_MAX_LOAD_PERCENT")
+	_ = e("checks.hardware.require-ac", "UUPD_REQUIRE_AC")
+	_ = e("checks.hardware.thermal-max-celsius", "UUPD_THERMAL_MAX_CELSIUS")
+	_ = e("checks.hardware.require-idle", "UUPD_REQUIRE_IDLE")
+	_ = e("checks.hardware.mode", "UUPD_HW_CHECK_MODE")
 
 	_ = e("modules.system.bootc-binary", "UUPD_BOOTC_BINARY")
 	_ = e("modules.system.rpm-ostree-binary", "UUPD_RPMOSTREE_BINARY")
 	_ = e("modules.system.skopeo-binary", "UUPD_SKOPEO_BINARY")
+	_ = e("modules.system.download-only", "UUPD_DOWNLOAD_ONLY")
+	_ = e("modules.system.channel", "UUPD_CHANNEL")
+	_ = e("modules.system.signature.enable", "UUPD_VERIFY_SIGNATURES")
 	_ = e("modules.flatpak.binary-path", "UUPD_FLATPAK_BINARY")
 	_ = e("modules.distrobox.binary-path", "UUPD_DISTROBOX_BINARY")
 
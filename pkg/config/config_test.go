@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/ublue-os/uupd/pkg/config"
 )
@@ -64,6 +65,10 @@ func TestConfigLocation(t *testing.T) {
 	if conf.Checks.Hardware.BatteryMinPercent != 20 {
 		t.Fatalf("BatteryMinPercent is not 20: %d", conf.Checks.Hardware.BatteryMinPercent)
 	}
+	// newer checks stay off until configured
+	if conf.Checks.Hardware.ThermalMaxCelsius != 0 || conf.Checks.Hardware.EnabledChecks.Disk {
+		t.Fatalf("Thermal or disk check enabled by default: %d, %v", conf.Checks.Hardware.ThermalMaxCelsius, conf.Checks.Hardware.EnabledChecks.Disk)
+	}
 }
 
 func TestConfigInvalidConfig(t *testing.T) {
@@ -95,3 +100,73 @@ func TestConfigInvalidConfigPath(t *testing.T) {
 		t.Fatalf("bad config file path went through")
 	}
 }
+
+func TestRetryConfig(t *testing.T) {
+	newConfig := `{
+			"modules": {
+				"system": {
+					"retry": {
+						"attempts": 5,
+						"backoff": "1m",
+						"retry-on": ["any"]
+					}
+				}
+			}
+		}
+	`
+
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "config.json")
+	if err := os.WriteFile(path, []byte(newConfig), 0644); err != nil {
+		t.Fatalf("unable to write file: %s, %v", path, err)
+	}
+
+	if err := config.InitConfig(path); err != nil {
+		t.Fatalf("unable to init config: %v", err)
+	}
+
+	conf := config.Get()
+	if conf.Modules.System.Retry.Attempts != 5 {
+		t.Fatalf("Retry attempts not overridden: %d", conf.Modules.System.Retry.Attempts)
+	}
+	if conf.Modules.System.Retry.Backoff != time.Minute {
+		t.Fatalf("Retry backoff not parsed: %v", conf.Modules.System.Retry.Backoff)
+	}
+	if len(conf.Modules.System.Retry.RetryOn) != 1 || conf.Modules.System.Retry.RetryOn[0] != "any" {
+		t.Fatalf("Retry classes not overridden: %v", conf.Modules.System.Retry.RetryOn)
+	}
+	// other modules keep the defaults
+	if conf.Modules.Flatpak.Retry.Attempts != 3 {
+		t.Fatalf("Flatpak retry attempts is not 3: %d", conf.Modules.Flatpak.Retry.Attempts)
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	secret, err := config.ReadSecret("inline", "")
+	if err != nil || secret != "inline" {
+		t.Fatalf("inline secret not used: %s, %v", secret, err)
+	}
+
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "password")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("unable to write file: %s, %v", path, err)
+	}
+	secret, err = config.ReadSecret("inline", path)
+	if err != nil || secret != "hunter2" {
+		t.Fatalf("secret file not read: %s, %v", secret, err)
+	}
+
+	t.Setenv("CREDENTIALS_DIRECTORY", tempDir)
+	secret, err = config.ReadSecret("", "password")
+	if err != nil || secret != "hunter2" {
+		t.Fatalf("credential not read: %s, %v", secret, err)
+	}
+
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("unable to chmod file: %s, %v", path, err)
+	}
+	if _, err := config.ReadSecret("", path); err == nil {
+		t.Fatalf("world readable secret file went through")
+	}
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadSecret returns the secret read from file, or the one set in the configuration without a file.
+// Relative files are systemd credentials of the service (LoadCredential=). The configuration is readable
+// by every user, so the file has to be readable by its owner only.
+func ReadSecret(inline string, file string) (string, error) {
+	if file == "" {
+		return inline, nil
+	}
+	if !filepath.IsAbs(file) {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("secret file %s is relative, but the service has no credentials", file)
+		}
+		file = filepath.Join(dir, file)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("secret file %s is readable by other users (mode %v)", file, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Job struct {
+	Name string
+	// Names of the jobs that need to finish before this one starts, names without a job (e.g. disabled modules) are ignored
+	After []string
+	Run   func() error
+}
+
+// ValidateAfter makes sure a job only waits for known job names, so typos don't get skipped like disabled jobs
+func ValidateAfter(name string, after []string, known []string) error {
+	for _, dep := range after {
+		if !slices.Contains(known, dep) {
+			return fmt.Errorf("unknown module in %s after: %q, expected one of: %s", name, dep, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// Validate makes sure job names are unique and that the ordering constraints don't form a cycle
+func Validate(jobs []Job) error {
+	names := map[string]int{}
+	for i, job := range jobs {
+		if _, exists := names[job.Name]; exists {
+			return fmt.Errorf("duplicate job: %s", job.Name)
+		}
+		names[job.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(jobs))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("ordering cycle: %v", append(path, jobs[i].Name))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, dep := range jobs[i].After {
+			j, exists := names[dep]
+			if !exists {
+				continue
+			}
+			if err := visit(j, append(path, jobs[i].Name)); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range jobs {
+		if err := visit(i, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run executes the jobs with at most `concurrency` of them at the same time, starting them in the given order as soon as their dependencies finished.
+// Dependencies only constrain ordering, a failed job doesn't prevent the jobs after it from running.
+// Returns the error of every job, indexed like jobs.
+func Run(jobs []Job, concurrency int) ([]error, error) {
+	if err := Validate(jobs); err != nil {
+		return nil, err
+	}
+	concurrency = max(concurrency, 1)
+
+	names := map[string]bool{}
+	for _, job := range jobs {
+		names[job.Name] = true
+	}
+
+	errs := make([]error, len(jobs))
+	started := make([]bool, len(jobs))
+	finished := map[string]bool{}
+	done := make(chan int)
+	running := 0
+
+	ready := func(job Job) bool {
+		for _, dep := range job.After {
+			if names[dep] && !finished[dep] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for remaining := len(jobs); remaining > 0; {
+		for i, job := range jobs {
+			if running >= concurrency {
+				break
+			}
+			if started[i] || !ready(job) {
+				continue
+			}
+			started[i] = true
+			running++
+			go func() {
+				errs[i] = job.Run()
+				done <- i
+			}()
+		}
+
+		i := <-done
+		running--
+		remaining--
+		finished[jobs[i].Name] = true
+	}
+	return errs, nil
+}
+
+// ForEach calls fn for every index in [0, n) with at most `concurrency` calls running at the same time
+func ForEach(n int, concurrency int, fn func(i int)) {
+	concurrency = max(concurrency, 1)
+	if concurrency == 1 {
+		for i := range n {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package executor_test
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/executor"
+)
+
+func TestOrdering(t *testing.T) {
+	var m sync.Mutex
+	var order []string
+	record := func(name string) func() error {
+		return func() error {
+			time.Sleep(10 * time.Millisecond)
+			m.Lock()
+			order = append(order, name)
+			m.Unlock()
+			return nil
+		}
+	}
+
+	jobs := []executor.Job{
+		{Name: "distrobox", After: []string{"flatpak"}, Run: record("distrobox")},
+		{Name: "flatpak", After: []string{"system"}, Run: record("flatpak")},
+		{Name: "brew", After: []string{"system"}, Run: record("brew")},
+		{Name: "system", Run: record("system")},
+	}
+	if _, err := executor.Run(jobs, 4); err != nil {
+		t.Fatalf("Failed running jobs: %v", err)
+	}
+
+	index := func(name string) int { return slices.Index(order, name) }
+	if index("system") != 0 {
+		t.Fatalf("System did not run first: %v", order)
+	}
+	if index("distrobox") < index("flatpak") {
+		t.Fatalf("Distrobox ran before flatpak: %v", order)
+	}
+}
+
+func TestSequentialKeepsOrder(t *testing.T) {
+	var order []string
+	jobs := []executor.Job{}
+	for _, name := range []string{"system", "brew", "flatpak", "distrobox"} {
+		jobs = append(jobs, executor.Job{Name: name, Run: func() error {
+			order = append(order, name)
+			return nil
+		}})
+	}
+	if _, err := executor.Run(jobs, 1); err != nil {
+		t.Fatalf("Failed running jobs: %v", err)
+	}
+	if !slices.Equal(order, []string{"system", "brew", "flatpak", "distrobox"}) {
+		t.Fatalf("Jobs ran out of order: %v", order)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	var current, peak atomic.Int32
+	job := func() error {
+		now := current.Add(1)
+		for {
+			old := peak.Load()
+			if now <= old || peak.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		current.Add(-1)
+		return nil
+	}
+
+	jobs := []executor.Job{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		jobs = append(jobs, executor.Job{Name: name, Run: job})
+	}
+	if _, err := executor.Run(jobs, 2); err != nil {
+		t.Fatalf("Failed running jobs: %v", err)
+	}
+	if peak.Load() > 2 {
+		t.Fatalf("Concurrency limit exceeded: %d", peak.Load())
+	}
+}
+
+func TestFailureDoesNotBlockDependents(t *testing.T) {
+	ran := false
+	jobs := []executor.Job{
+		{Name: "flatpak", Run: func() error { return errors.New("failed") }},
+		{Name: "distrobox", After: []string{"flatpak", "disabled"}, Run: func() error {
+			ran = true
+			return nil
+		}},
+	}
+	errs, err := executor.Run(jobs, 1)
+	if err != nil {
+		t.Fatalf("Failed running jobs: %v", err)
+	}
+	if errs[0] == nil || errs[1] != nil {
+		t.Fatalf("Wrong job errors: %v", errs)
+	}
+	if !ran {
+		t.Fatalf("Dependent job did not run after failure")
+	}
+}
+
+func TestCycle(t *testing.T) {
+	jobs := []executor.Job{
+		{Name: "flatpak", After: []string{"distrobox"}, Run: func() error { return nil }},
+		{Name: "distrobox", After: []string{"flatpak"}, Run: func() error { return nil }},
+	}
+	if _, err := executor.Run(jobs, 2); err == nil {
+		t.Fatalf("Ordering cycle went through")
+	}
+}
+
+func TestForEach(t *testing.T) {
+	results := make([]int, 10)
+	executor.ForEach(len(results), 3, func(i int) {
+		results[i] = i * i
+	})
+	for i, result := range results {
+		if result != i*i {
+			t.Fatalf("Wrong result at %d: %d", i, result)
+		}
+	}
+}
+
+func TestValidateAfter(t *testing.T) {
+	known := []string{"system", "brew", "flatpak", "distrobox"}
+	if err := executor.ValidateAfter("distrobox", []string{"flatpak", "system"}, known); err != nil {
+		t.Fatalf("Known modules were rejected: %v", err)
+	}
+	if err := executor.ValidateAfter("distrobox", []string{"flatpack"}, known); err == nil {
+		t.Fatalf("Unknown module went through")
+	}
+}
@@ -0,0 +1,89 @@
+package imageref
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// StripTransport turns ostree container references (e.g. "ostree-image-signed:docker://ghcr.io/ublue-os/bluefin:stable")
+// into plain image references, references without a transport are returned as is
+func StripTransport(ref string) string {
+	if _, image, found := strings.Cut(ref, "docker://"); found {
+		return image
+	}
+	if image, found := strings.CutPrefix(ref, "ostree-unverified-registry:"); found {
+		return image
+	}
+	if remote, found := strings.CutPrefix(ref, "ostree-remote-registry:"); found {
+		// the name of the ostree remote comes first
+		if _, image, found := strings.Cut(remote, ":"); found {
+			return image
+		}
+	}
+	return ref
+}
+
+// split returns the repository and the tag (or digest, including the separator) of an image reference
+func split(ref string) (string, string) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return ref[:i], ref[i:]
+	}
+	// a colon before the last slash belongs to the registry port
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i:]
+	}
+	return ref, ""
+}
+
+// Repository strips the tag and digest from an image reference
+func Repository(ref string) string {
+	repository, _ := split(ref)
+	return repository
+}
+
+// Tag returns the tag of an image reference, "latest" if it doesn't have one and "" if it's pinned to a digest
+func Tag(ref string) string {
+	_, tag := split(ref)
+	switch {
+	case tag == "":
+		return "latest"
+	case strings.HasPrefix(tag, "@"):
+		return ""
+	}
+	return tag[1:]
+}
+
+// WithChannel points an image reference at a channel: a tag (e.g. "stable", "testing" or a dated tag) or a "sha256:" digest
+func WithChannel(ref string, channel string) string {
+	if strings.HasPrefix(channel, "sha256:") {
+		return Repository(ref) + "@" + channel
+	}
+	return Repository(ref) + ":" + channel
+}
+
+// Exists checks that the image can be found in its registry
+func Exists(skopeoPath string, ref string) error {
+	_, err := Digest(skopeoPath, ref)
+	return err
+}
+
+// Digest returns the manifest digest the image reference currently points to in its registry
+func Digest(skopeoPath string, ref string) (string, error) {
+	cmd := exec.Command(skopeoPath, "inspect", "--no-tags", "docker://"+ref)
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("image %s not found: %v, %s", ref, err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return "", fmt.Errorf("image %s not found: %v", ref, err)
+	}
+	var inspect struct {
+		Digest string `json:"Digest"`
+	}
+	if err := json.Unmarshal(out, &inspect); err != nil {
+		return "", fmt.Errorf("couldn't unmarshal skopeo inspect: %v", err)
+	}
+	return inspect.Digest, nil
+}
@@ -0,0 +1,46 @@
+package imageref_test
+
+import (
+	"testing"
+
+	"github.com/ublue-os/uupd/pkg/imageref"
+)
+
+func TestStripTransport(t *testing.T) {
+	refs := map[string]string{
+		"ostree-image-signed:docker://ghcr.io/ublue-os/bluefin:stable": "ghcr.io/ublue-os/bluefin:stable",
+		"ostree-unverified-registry:ghcr.io/ublue-os/aurora:latest":    "ghcr.io/ublue-os/aurora:latest",
+		"ostree-remote-registry:fedora:quay.io/fedora/fedora-bootc:41": "quay.io/fedora/fedora-bootc:41",
+		"ostree-unverified-image:docker://localhost:5000/test:latest":  "localhost:5000/test:latest",
+		"ghcr.io/ublue-os/bazzite:testing":                             "ghcr.io/ublue-os/bazzite:testing",
+	}
+	for ref, expected := range refs {
+		if image := imageref.StripTransport(ref); image != expected {
+			t.Fatalf("Stripping %s returned %s, expected %s", ref, image, expected)
+		}
+	}
+}
+
+func TestChannel(t *testing.T) {
+	cases := []struct {
+		ref, channel, expected, tag string
+	}{
+		{"ghcr.io/ublue-os/bluefin:stable", "testing", "ghcr.io/ublue-os/bluefin:testing", "testing"},
+		{"ghcr.io/ublue-os/bluefin", "stable-20250101", "ghcr.io/ublue-os/bluefin:stable-20250101", "stable-20250101"},
+		{"localhost:5000/test", "gts", "localhost:5000/test:gts", "gts"},
+		{"ghcr.io/ublue-os/bluefin@sha256:1234", "stable", "ghcr.io/ublue-os/bluefin:stable", "stable"},
+		{"ghcr.io/ublue-os/bluefin:stable", "sha256:abcd", "ghcr.io/ublue-os/bluefin@sha256:abcd", ""},
+	}
+	for _, c := range cases {
+		image := imageref.WithChannel(c.ref, c.channel)
+		if image != c.expected {
+			t.Fatalf("Switching %s to %s returned %s, expected %s", c.ref, c.channel, image, c.expected)
+		}
+		if tag := imageref.Tag(image); tag != c.tag {
+			t.Fatalf("Tag of %s returned %s, expected %s", image, tag, c.tag)
+		}
+	}
+	if tag := imageref.Tag("localhost:5000/test"); tag != "latest" {
+		t.Fatalf("Expected latest as the implicit tag, got: %s", tag)
+	}
+}
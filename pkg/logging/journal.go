@@ -0,0 +1,235 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	JournalSocket = "/run/systemd/journal/socket"
+	messageIDKey  = "message_id"
+)
+
+// Stable MESSAGE_IDs of the events admins look for across machines, documented in uupd.catalog
+const (
+	MessageRunStarted     = "1f6a3c2e9b8d4e7f8a5c0d3b6e9f2a41"
+	MessageModuleFailed   = "7c2d9e4f1a3b4c5d8e6f0a2b4c6d8e03"
+	MessageUpdateStaged   = "a4e8c1d7f2b94a6e9c3d5f7b1e8a0c52"
+	MessageRebootRequired = "d93b5f2a7e1c4b8d9f6a3e5c7b2d4f16"
+)
+
+// MessageID tags a log record with one of the MESSAGE_IDs, it's a plain attr for the other handlers
+func MessageID(id string) slog.Attr {
+	return slog.String(messageIDKey, id)
+}
+
+// JournalStream returns whether the file is the stream systemd connected to the journal, see systemd.exec(5)
+func JournalStream(file *os.File) bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+// JournalHandler writes records to the journal with the native protocol, every attr becomes a field
+type JournalHandler struct {
+	opts   slog.HandlerOptions
+	conn   *net.UnixConn
+	addr   *net.UnixAddr
+	m      *sync.Mutex
+	prefix string
+	attrs  []slog.Attr
+}
+
+func NewJournalHandler(socket string, opts *slog.HandlerOptions) (*JournalHandler, error) {
+	if opts == nil {
+		opts = &slog.HandlerOptions{}
+	}
+	// fail early if there's no journal to write to
+	if _, err := os.Stat(socket); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournalHandler{opts: *opts, conn: conn, addr: &net.UnixAddr{Name: socket, Net: "unixgram"}, m: &sync.Mutex{}}, nil
+}
+
+func (h *JournalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = append(append([]slog.Attr{}, h.attrs...), prefixed(h.prefix, attrs)...)
+	return &next
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	next := *h
+	next.prefix = h.prefix + name + "_"
+	return &next
+}
+
+func prefixed(prefix string, attrs []slog.Attr) []slog.Attr {
+	if prefix == "" {
+		return attrs
+	}
+	var out []slog.Attr
+	for _, attr := range attrs {
+		out = append(out, slog.Attr{Key: prefix + attr.Key, Value: attr.Value})
+	}
+	return out
+}
+
+// fieldName turns an attr key into a valid journal field name: uppercase letters, digits and underscores, not starting with an underscore
+func fieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func fieldValue(value slog.Value) string {
+	value = value.Resolve()
+	if value.Kind() != slog.KindAny {
+		return value.String()
+	}
+	switch v := value.Any().(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if encoded, err := json.Marshal(value.Any()); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprintf("%+v", value.Any())
+}
+
+func priority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// appendField encodes a field, values with newlines need the binary length-prefixed form
+func appendField(b *bytes.Buffer, name string, value string) {
+	if name == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func appendAttr(b *bytes.Buffer, prefix string, attr slog.Attr) {
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, member := range attr.Value.Group() {
+			appendAttr(b, prefix+attr.Key+"_", member)
+		}
+		return
+	}
+	appendField(b, fieldName(prefix+attr.Key), fieldValue(attr.Value))
+}
+
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	appendField(&b, "MESSAGE", r.Message)
+	appendField(&b, "PRIORITY", fmt.Sprint(priority(r.Level)))
+	appendField(&b, "SYSLOG_IDENTIFIER", "uupd")
+
+	attrs := append([]slog.Attr{}, h.attrs...)
+	r.Attrs(func(attr slog.Attr) bool {
+		// the MESSAGE_ID stays a top level field whatever the group
+		if attr.Key == messageIDKey {
+			appendField(&b, "MESSAGE_ID", attr.Value.String())
+			return true
+		}
+		attrs = append(attrs, prefixed(h.prefix, []slog.Attr{attr})...)
+		return true
+	})
+	for _, attr := range attrs {
+		if h.opts.ReplaceAttr != nil {
+			attr = h.opts.ReplaceAttr(nil, attr)
+		}
+		appendAttr(&b, "", attr)
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	_, err := h.conn.WriteToUnix(b.Bytes(), h.addr)
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		return h.sendLarge(b.Bytes())
+	}
+	return err
+}
+
+// sendLarge passes entries too big for a datagram as a file descriptor, like sd_journal_send does
+func (h *JournalHandler) sendLarge(entry []byte) error {
+	file, err := os.CreateTemp("/dev/shm", "uupd-journal-")
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), h.addr)
+	return err
+}
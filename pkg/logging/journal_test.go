@@ -0,0 +1,92 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/logging"
+)
+
+// parseEntry decodes the native journal protocol, see systemd-journald.socket(8)
+func parseEntry(t *testing.T, entry []byte) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for len(entry) > 0 {
+		line, rest, _ := bytes.Cut(entry, []byte("\n"))
+		if name, value, found := bytes.Cut(line, []byte("=")); found {
+			fields[string(name)] = string(value)
+			entry = rest
+			continue
+		}
+		if len(rest) < 8 {
+			t.Fatalf("Truncated binary field %q", line)
+		}
+		size := binary.LittleEndian.Uint64(rest[:8])
+		fields[string(line)] = string(rest[8 : 8+size])
+		entry = rest[8+size+1:]
+	}
+	return fields
+}
+
+func TestJournalHandler(t *testing.T) {
+	if _, err := logging.NewJournalHandler(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Fatalf("Expected a missing journal socket to fail")
+	}
+
+	socket := filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	handler, err := logging.NewJournalHandler(socket, &slog.HandlerOptions{Level: slog.LevelInfo})
+	if err != nil {
+		t.Fatalf("unable to create handler: %v", err)
+	}
+	logger := slog.New(handler).With(slog.String("user", "alice"))
+	logger.Debug("Hidden")
+	logger.WithGroup("progress").Error("module_fail",
+		logging.MessageID(logging.MessageModuleFailed),
+		slog.String("module", "Flatpak"),
+		slog.Any("error", errors.New("exit status 1")),
+		slog.String("output", "line one\nline two"),
+		slog.Group("step", slog.Int("current", 2)),
+	)
+
+	buf := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Nothing sent to the journal: %v", err)
+	}
+	fields := parseEntry(t, buf[:n])
+	expected := map[string]string{
+		"MESSAGE":               "module_fail",
+		"PRIORITY":              "3",
+		"SYSLOG_IDENTIFIER":     "uupd",
+		"MESSAGE_ID":            logging.MessageModuleFailed,
+		"USER":                  "alice",
+		"PROGRESS_MODULE":       "Flatpak",
+		"PROGRESS_ERROR":        "exit status 1",
+		"PROGRESS_OUTPUT":       "line one\nline two",
+		"PROGRESS_STEP_CURRENT": "2",
+	}
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Fatalf("Expected %s=%q, got: %v", name, value, fields)
+		}
+	}
+
+	// the debug record got filtered, so this is the only entry
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("Unexpected entry: %q", buf[:n])
+	}
+}
@@ -26,7 +26,7 @@ func StrToLogLevel(logLevel string) (slog.Leveler, error) {
 	return logLevels[logLevel], nil
 }
 
-func SetupAppLogger(writer *os.File, logLevel slog.Leveler, verbose bool) slog.Handler {
+func SetupAppLogger(writer *os.File, logLevel slog.Leveler, verbose bool, format string) (slog.Handler, error) {
 	if verbose {
 		return slog.NewJSONHandler(writer, &slog.HandlerOptions{
 			Level: logLevel,
@@ -36,7 +36,10 @@ func SetupAppLogger(writer *os.File, logLevel slog.Leveler, verbose bool) slog.H
 				}
 				return a
 			},
-		})
+		}), nil
 	}
-	return NewUserHandler(&slog.HandlerOptions{Level: logLevel})
+	if err := ValidateFormat(format); err != nil {
+		return nil, err
+	}
+	return NewUserHandler(writer, format, UseColor(writer), &slog.HandlerOptions{Level: logLevel}), nil
 }
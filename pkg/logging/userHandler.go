@@ -5,11 +5,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
@@ -36,75 +39,127 @@ const (
 	white        = 97
 )
 
-func (h *UserHandler) computeAttrs(
-	ctx context.Context,
-	r slog.Record,
-) (map[string]any, error) {
-	h.m.Lock()
-	defer func() {
-		h.b.Reset()
-		h.m.Unlock()
-	}()
-	if err := h.h.Handle(ctx, r); err != nil {
-		return nil, fmt.Errorf("error when calling inner handler's Handle: %w", err)
+const (
+	// Attrs as a YAML block under the message
+	FormatYAML = "yaml"
+	// Attrs as key=value pairs on the line of the message
+	FormatCompact = "compact"
+)
+
+func ValidateFormat(format string) error {
+	if format != FormatYAML && format != FormatCompact {
+		return fmt.Errorf("invalid log format %q, expected %q or %q", format, FormatYAML, FormatCompact)
 	}
+	return nil
+}
 
-	var attrs map[string]any
-	err := json.Unmarshal(h.b.Bytes(), &attrs)
-	if err != nil {
-		return nil, fmt.Errorf("error when unmarshaling inner handler's Handle result: %w", err)
+// UseColor returns whether the file is a terminal that wants colours, see https://no-color.org
+func UseColor(file *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
 	}
-	return attrs, nil
+	return term.IsTerminal(int(file.Fd()))
 }
 
 func colorize(colorCode int, v string) string {
 	return fmt.Sprintf("\033[%sm%s%s", strconv.Itoa(colorCode), v, reset)
 }
 
+// userOutput is shared by a handler and the handlers derived from it, so lines never interleave
+type userOutput struct {
+	m sync.Mutex
+	b bytes.Buffer
+	w io.Writer
+	// Lines go here instead of the writer while something else draws on the terminal
+	redirect func(line string)
+}
+
 type UserHandler struct {
-	h slog.Handler
-	b *bytes.Buffer
-	m *sync.Mutex
+	h      slog.Handler
+	out    *userOutput
+	format string
+	color  bool
+}
+
+func (h *UserHandler) colorize(colorCode int, v string) string {
+	if !h.color {
+		return v
+	}
+	return colorize(colorCode, v)
+}
+
+// formatAttrs turns what the inner handler wrote for the record into the attrs part of the line, callers need to hold the output lock
+func (h *UserHandler) formatAttrs(ctx context.Context, r slog.Record) (string, error) {
+	defer h.out.b.Reset()
+	if err := h.h.Handle(ctx, r); err != nil {
+		return "", fmt.Errorf("error when calling inner handler's Handle: %w", err)
+	}
+	if h.format == FormatCompact {
+		return strings.TrimSpace(h.out.b.String()), nil
+	}
+
+	var attrs map[string]any
+	if err := json.Unmarshal(h.out.b.Bytes(), &attrs); err != nil {
+		return "", fmt.Errorf("error when unmarshaling inner handler's Handle result: %w", err)
+	}
+	if len(attrs) == 0 {
+		return "", nil
+	}
+	bytes, err := yaml.Marshal(attrs)
+	if err != nil {
+		return "", fmt.Errorf("error when marshaling attrs: %w", err)
+	}
+	return strings.TrimSpace(string(bytes)), nil
 }
 
 func (h *UserHandler) Handle(ctx context.Context, r slog.Record) error {
 	level := r.Level.String() + ":"
 
-	switch r.Level {
-	case slog.LevelDebug:
-		level = colorize(darkGray, level)
-	case slog.LevelInfo:
-		level = colorize(cyan, level)
-	case slog.LevelWarn:
-		level = colorize(lightYellow, level)
-	case slog.LevelError:
-		level = colorize(lightRed, level)
+	switch {
+	case r.Level >= slog.LevelError:
+		level = h.colorize(lightRed, level)
+	case r.Level >= slog.LevelWarn:
+		level = h.colorize(lightYellow, level)
+	case r.Level >= slog.LevelInfo:
+		level = h.colorize(cyan, level)
+	default:
+		level = h.colorize(darkGray, level)
 	}
 
-	attrs, err := h.computeAttrs(ctx, r)
+	h.out.m.Lock()
+	defer h.out.m.Unlock()
+	attrs, err := h.formatAttrs(ctx, r)
 	if err != nil {
 		return err
 	}
 
-	bytes, err := yaml.Marshal(attrs)
-	if err != nil {
-		return fmt.Errorf("error when marshaling attrs: %w", err)
-	}
-	trimmedBytes := strings.TrimSpace(string(bytes))
-
-	fmt.Println(
-		level,
-		colorize(white, r.Message),
-		colorize(darkGray,
-			func() string {
-				if len(trimmedBytes) > 0 && trimmedBytes != "{}" {
-					return colorize(darkGray, "\n"+trimmedBytes)
-				}
-				return ""
-			}()),
-	)
+	line := level + " " + h.colorize(white, r.Message)
+	if attrs != "" {
+		separator := "\n"
+		if h.format == FormatCompact {
+			separator = " "
+		}
+		line += separator + h.colorize(darkGray, attrs)
+	}
 
-	return nil
+	if h.out.redirect != nil {
+		h.out.redirect(line)
+		return nil
+	}
+	_, err = io.WriteString(h.out.w, line+"\n")
+	return err
+}
+
+// Redirect hands the lines to log until the returned function gets called, e.g. for the progress bar to print them above itself
+func (h *UserHandler) Redirect(log func(line string)) (restore func()) {
+	h.out.m.Lock()
+	defer h.out.m.Unlock()
+	h.out.redirect = log
+	return func() {
+		h.out.m.Lock()
+		defer h.out.m.Unlock()
+		h.out.redirect = nil
+	}
 }
 
 func (h *UserHandler) Enabled(ctx context.Context, level slog.Level) bool {
@@ -112,11 +167,11 @@ func (h *UserHandler) Enabled(ctx context.Context, level slog.Level) bool {
 }
 
 func (h *UserHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &UserHandler{h: h.h.WithAttrs(attrs), b: h.b, m: h.m}
+	return &UserHandler{h: h.h.WithAttrs(attrs), out: h.out, format: h.format, color: h.color}
 }
 
 func (h *UserHandler) WithGroup(name string) slog.Handler {
-	return &UserHandler{h: h.h.WithGroup(name), b: h.b, m: h.m}
+	return &UserHandler{h: h.h.WithGroup(name), out: h.out, format: h.format, color: h.color}
 }
 
 func suppressDefaults(
@@ -135,18 +190,20 @@ func suppressDefaults(
 	}
 }
 
-func NewUserHandler(opts *slog.HandlerOptions) *UserHandler {
+// NewUserHandler writes human readable lines to w, the attrs formatted as FormatYAML or FormatCompact
+func NewUserHandler(w io.Writer, format string, color bool, opts *slog.HandlerOptions) *UserHandler {
 	if opts == nil {
 		opts = &slog.HandlerOptions{}
 	}
-	b := &bytes.Buffer{}
-	return &UserHandler{
-		b: b,
-		h: slog.NewJSONHandler(b, &slog.HandlerOptions{
-			Level:       opts.Level,
-			AddSource:   opts.AddSource,
-			ReplaceAttr: suppressDefaults(opts.ReplaceAttr),
-		}),
-		m: &sync.Mutex{},
+	out := &userOutput{w: w}
+	innerOpts := &slog.HandlerOptions{
+		Level:       opts.Level,
+		AddSource:   opts.AddSource,
+		ReplaceAttr: suppressDefaults(opts.ReplaceAttr),
+	}
+	var inner slog.Handler = slog.NewJSONHandler(&out.b, innerOpts)
+	if format == FormatCompact {
+		inner = slog.NewTextHandler(&out.b, innerOpts)
 	}
+	return &UserHandler{h: inner, out: out, format: format, color: color}
 }
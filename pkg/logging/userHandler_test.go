@@ -0,0 +1,61 @@
+package logging_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ublue-os/uupd/pkg/logging"
+)
+
+func TestUserHandler(t *testing.T) {
+	var b bytes.Buffer
+	logger := slog.New(logging.NewUserHandler(&b, logging.FormatCompact, false, nil)).With(slog.String("module", "flatpak"))
+	logger.WithGroup("progress").Info("Updating", slog.Int("step", 2), slog.String("title", "System Apps"))
+	logger.Debug("Hidden")
+	if line := b.String(); line != "INFO: Updating module=flatpak progress.step=2 progress.title=\"System Apps\"\n" {
+		t.Fatalf("Unexpected compact line: %q", line)
+	}
+
+	b.Reset()
+	slog.New(logging.NewUserHandler(&b, logging.FormatYAML, false, nil)).Warn("Transient failure", slog.Int("attempt", 2))
+	if text := b.String(); text != "WARN: Transient failure\nattempt: 2\n" {
+		t.Fatalf("Unexpected yaml lines: %q", text)
+	}
+
+	b.Reset()
+	slog.New(logging.NewUserHandler(&b, logging.FormatYAML, true, nil)).Error("Failed")
+	if text := b.String(); !strings.Contains(text, "\033[91mERROR:\033[0m") {
+		t.Fatalf("Expected a coloured level, got: %q", text)
+	}
+
+	// concurrent records stay on their own lines, redirected ones skip the writer
+	b.Reset()
+	handler := logging.NewUserHandler(&b, logging.FormatCompact, false, nil)
+	var redirected []string
+	restore := handler.Redirect(func(line string) { redirected = append(redirected, line) })
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.New(handler).With(slog.Int("worker", i)).Info("Done", slog.String("output", strings.Repeat("x", 100)))
+		}()
+	}
+	wg.Wait()
+	restore()
+	if b.Len() != 0 || len(redirected) != 50 {
+		t.Fatalf("Expected every line to be redirected, got %d lines and %q", len(redirected), b.String())
+	}
+	for _, line := range redirected {
+		if !strings.HasPrefix(line, "INFO: Done worker=") || !strings.HasSuffix(line, strings.Repeat("x", 100)) {
+			t.Fatalf("Corrupted line: %q", line)
+		}
+	}
+	slog.New(handler).Info("Restored")
+	if b.String() != "INFO: Restored\n" {
+		t.Fatalf("Expected lines to go to the writer after restoring, got: %q", b.String())
+	}
+}
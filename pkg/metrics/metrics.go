@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lastSuccessMetric = "uupd_last_success_timestamp_seconds"
+
+type Module struct {
+	Name     string
+	Duration time.Duration
+	Success  bool
+}
+
+// Run holds what gets exported about the last run, zero timestamps are left out
+type Run struct {
+	Finished    time.Time
+	Success     bool
+	LastSuccess time.Time
+	Modules     []Module
+	// Build time of the booted image
+	ImageTimestamp time.Time
+	Staged         bool
+	RebootRequired bool
+}
+
+func boolValue(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func seconds(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
+
+// WriteText writes the run in the Prometheus text exposition format
+func WriteText(w io.Writer, run Run) error {
+	b := bufio.NewWriter(w)
+	gauge := func(name string, help string, samples ...string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name) //nolint:errcheck
+		for _, sample := range samples {
+			fmt.Fprintf(b, "%s%s\n", name, sample) //nolint:errcheck
+		}
+	}
+
+	gauge("uupd_last_run_timestamp_seconds", "When the last run finished.", " "+seconds(run.Finished))
+	gauge("uupd_last_run_success", "Whether every module of the last run succeeded.", fmt.Sprintf(" %d", boolValue(run.Success)))
+	if !run.LastSuccess.IsZero() {
+		gauge(lastSuccessMetric, "When the last successful run finished.", " "+seconds(run.LastSuccess))
+	}
+	if len(run.Modules) > 0 {
+		var durations, successes []string
+		for _, module := range run.Modules {
+			durations = append(durations, fmt.Sprintf("{module=%q} %s", module.Name, strconv.FormatFloat(module.Duration.Seconds(), 'f', 3, 64)))
+			successes = append(successes, fmt.Sprintf("{module=%q} %d", module.Name, boolValue(module.Success)))
+		}
+		gauge("uupd_module_duration_seconds", "How long each module took in the last run.", durations...)
+		gauge("uupd_module_success", "Whether each module succeeded in the last run.", successes...)
+	}
+	if !run.ImageTimestamp.IsZero() {
+		gauge("uupd_booted_image_timestamp_seconds", "When the booted system image was built.", " "+seconds(run.ImageTimestamp))
+		gauge("uupd_booted_image_age_seconds", "Age of the booted system image when the last run finished.", " "+strconv.FormatFloat(run.Finished.Sub(run.ImageTimestamp).Seconds(), 'f', 0, 64))
+	}
+	gauge("uupd_update_staged", "Whether a system update is downloaded but not deployed yet.", fmt.Sprintf(" %d", boolValue(run.Staged)))
+	gauge("uupd_reboot_required", "Whether a system update waits for a reboot.", fmt.Sprintf(" %d", boolValue(run.RebootRequired)))
+	return b.Flush()
+}
+
+// LastSuccess reads the last successful run out of an earlier metrics file, zero if there's none
+func LastSuccess(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), lastSuccessMetric+" ")
+		if !found {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s in %s: %w", lastSuccessMetric, path, err)
+		}
+		return time.UnixMilli(int64(parsed * 1000)), nil
+	}
+	return time.Time{}, scanner.Err()
+}
+
+// Write replaces the metrics file in one go, the textfile collector may read it at any time.
+// The last success carries over from the previous file when the run failed.
+func Write(path string, run Run) error {
+	if run.Success {
+		run.LastSuccess = run.Finished
+	} else {
+		var err error
+		if run.LastSuccess, err = LastSuccess(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".uupd.prom.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if err := WriteText(tmp, run); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,66 @@
+package metrics_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/metrics"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "textfile_collector", "uupd.prom")
+	first := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)
+
+	run := metrics.Run{
+		Finished: first,
+		Success:  true,
+		Modules: []metrics.Module{
+			{Name: "system", Duration: 90 * time.Second, Success: true},
+			{Name: "brew", Duration: 1500 * time.Millisecond, Success: true},
+		},
+		ImageTimestamp: first.Add(-48 * time.Hour),
+		RebootRequired: true,
+	}
+	if err := metrics.Write(path, run); err != nil {
+		t.Fatalf("unable to write metrics: %v", err)
+	}
+
+	run.Finished = first.Add(24 * time.Hour)
+	run.Success = false
+	run.Modules[1].Success = false
+	if err := metrics.Write(path, run); err != nil {
+		t.Fatalf("unable to write metrics: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read metrics: %v", err)
+	}
+	text := string(data)
+	for _, expected := range []string{
+		"# TYPE uupd_last_run_timestamp_seconds gauge\nuupd_last_run_timestamp_seconds 1704168000\n",
+		"uupd_last_run_success 0\n",
+		"uupd_last_success_timestamp_seconds 1704081600\n",
+		"uupd_module_duration_seconds{module=\"system\"} 90.000\n",
+		"uupd_module_duration_seconds{module=\"brew\"} 1.500\n",
+		"uupd_module_success{module=\"brew\"} 0\n",
+		"uupd_booted_image_age_seconds 259200\n",
+		"uupd_update_staged 0\n",
+		"uupd_reboot_required 1\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected metrics to contain %q, got:\n%s", expected, text)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the metrics file to be left, got: %v", entries)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Fatalf("Expected the metrics to be readable by node_exporter, got: %v", info.Mode())
+	}
+}
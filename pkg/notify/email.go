@@ -0,0 +1,388 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/config"
+)
+
+const (
+	WhenDigest = "digest"
+
+	TransportSMTP     = "smtp"
+	TransportSendmail = "sendmail"
+
+	SecurityStartTLS = "starttls"
+	SecurityTLS      = "tls"
+	SecurityNone     = "none"
+
+	// Only the end of the output of failed commands is mailed, that's usually where the error is
+	maxMailedOutput = 4096
+)
+
+// ValidateEmail checks the email configuration before anything gets sent
+func ValidateEmail(conf config.Email) error {
+	if !conf.Enable {
+		return nil
+	}
+	if len(conf.To) == 0 {
+		return errors.New("email needs at least one recipient")
+	}
+	switch conf.When {
+	case WhenAlways, WhenFailure:
+	case WhenDigest:
+		if conf.DigestInterval <= 0 {
+			return fmt.Errorf("invalid email digest interval: %v", conf.DigestInterval)
+		}
+	default:
+		return fmt.Errorf("invalid email when: %s, expected %s, %s or %s", conf.When, WhenAlways, WhenFailure, WhenDigest)
+	}
+	switch conf.Transport {
+	case TransportSendmail:
+	case TransportSMTP:
+		if !slices.Contains([]string{SecurityStartTLS, SecurityTLS, SecurityNone}, conf.SMTP.Security) {
+			return fmt.Errorf("invalid smtp security: %s, expected %s, %s or %s", conf.SMTP.Security, SecurityStartTLS, SecurityTLS, SecurityNone)
+		}
+	default:
+		return fmt.Errorf("invalid email transport: %s, expected %s or %s", conf.Transport, TransportSMTP, TransportSendmail)
+	}
+	return nil
+}
+
+func tail(output string) string {
+	if len(output) <= maxMailedOutput {
+		return output
+	}
+	return "…" + output[len(output)-maxMailedOutput:]
+}
+
+func reportText(report Report) string {
+	var b strings.Builder
+	result := "success"
+	if !report.Success {
+		result = "failed"
+	}
+	fmt.Fprintf(&b, "Host: %s\nResult: %s\nStarted: %s\nFinished: %s\n", report.Hostname, result, report.Started.Format(time.RFC1123), report.Finished.Format(time.RFC1123))
+	if report.DryRun {
+		b.WriteString("Dry run, nothing got changed\n")
+	}
+	if report.Image != "" {
+		fmt.Fprintf(&b, "System image: %s\n", report.Image)
+	}
+	if report.Staged {
+		fmt.Fprintf(&b, "%s\n", report.StagedText())
+	}
+
+	b.WriteString("\nModules:\n")
+	for _, module := range report.Modules {
+		status := "ok"
+		if module.Failure {
+			status = "FAILED"
+		}
+		fmt.Fprintf(&b, "  %-8s %s\n", status, module.Context)
+	}
+	if len(report.Modules) == 0 {
+		b.WriteString("  Nothing to update\n")
+	}
+
+	for _, failure := range report.Failures() {
+		fmt.Fprintf(&b, "\n== %s ==\n", failure.Context)
+		if len(failure.Cli) > 0 {
+			fmt.Fprintf(&b, "Command: %s\n", strings.Join(failure.Cli, " "))
+		}
+		if failure.Error != "" {
+			fmt.Fprintf(&b, "Error: %s\n", failure.Error)
+		}
+		if failure.Output != "" {
+			fmt.Fprintf(&b, "\n%s\n", strings.TrimRight(tail(failure.Output), "\n"))
+		}
+	}
+	return b.String()
+}
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("report").Funcs(htmltemplate.FuncMap{"tail": tail}).Parse(`<html><body>
+<h2>{{.Title}}</h2>
+<p>{{if .DryRun}}Dry run, nothing got changed<br>{{end}}Started {{.Started.Format "Mon, 02 Jan 2006 15:04:05 MST"}}, finished {{.Finished.Format "Mon, 02 Jan 2006 15:04:05 MST"}}</p>
+{{if .Image}}<p>System image: <code>{{.Image}}</code>{{if .Staged}}<br>{{.StagedText}}{{end}}</p>{{end}}
+<table>
+{{range .Modules}}<tr><td>{{if .Failure}}&#10007; failed{{else}}&#10003; ok{{end}}</td><td>{{.Context}}</td></tr>
+{{else}}<tr><td colspan="2">Nothing to update</td></tr>
+{{end}}</table>
+{{range .Failures}}<h3>{{.Context}}</h3>
+{{if .Cli}}<p>Command: <code>{{range $i, $arg := .Cli}}{{if $i}} {{end}}{{$arg}}{{end}}</code></p>{{end}}
+{{if .Error}}<p>Error: {{.Error}}</p>{{end}}
+{{if .Output}}<pre>{{tail .Output}}</pre>{{end}}
+{{end}}</body></html>
+`))
+
+// digestState keeps the runs since the last digest
+type digestState struct {
+	Since time.Time
+	Runs  []Report
+}
+
+func digestText(state digestState, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Runs between %s and %s:\n\n", state.Since.Format(time.RFC1123), now.Format(time.RFC1123))
+	for _, run := range state.Runs {
+		if run.Success {
+			fmt.Fprintf(&b, "%s  ok      %d modules updated\n", run.Started.Format("2006-01-02 15:04"), len(run.Modules))
+			continue
+		}
+		var contexts []string
+		for _, failure := range run.Failures() {
+			contexts = append(contexts, failure.Context)
+		}
+		fmt.Fprintf(&b, "%s  FAILED  %s\n", run.Started.Format("2006-01-02 15:04"), strings.Join(contexts, ", "))
+	}
+	if last := state.Runs[len(state.Runs)-1]; last.Staged {
+		fmt.Fprintf(&b, "\n%s\n", last.StagedText())
+	}
+	for _, run := range state.Runs {
+		if !run.Success {
+			fmt.Fprintf(&b, "\n---\n\n%s", reportText(run))
+		}
+	}
+	return b.String()
+}
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest").Funcs(htmltemplate.FuncMap{"tail": tail}).Parse(`<html><body>
+<h2>Runs between {{.Since.Format "Mon, 02 Jan 2006 15:04 MST"}} and {{.Now.Format "Mon, 02 Jan 2006 15:04 MST"}}</h2>
+<table>
+{{range .Runs}}<tr><td>{{.Started.Format "2006-01-02 15:04"}}</td><td>{{if .Success}}&#10003; ok{{else}}&#10007; failed{{end}}</td><td>{{range $i, $f := .Failures}}{{if $i}}, {{end}}{{$f.Context}}{{else}}{{len .Modules}} modules updated{{end}}</td></tr>
+{{end}}</table>
+{{with .Last}}{{if .Staged}}<p>{{.StagedText}}</p>{{end}}{{end}}
+{{range .Runs}}{{if not .Success}}{{$run := .}}{{range .Failures}}<h3>{{$run.Started.Format "2006-01-02 15:04"}}: {{.Context}}</h3>
+{{if .Error}}<p>Error: {{.Error}}</p>{{end}}
+{{if .Output}}<pre>{{tail .Output}}</pre>{{end}}
+{{end}}{{end}}{{end}}</body></html>
+`))
+
+// buildMessage writes a multipart/alternative mail with a plain text and an html version of the body
+func buildMessage(from string, to []string, subject string, text string, html string, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{{"text/plain", text}, {"text/html", html}} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from},
+		{"To", strings.Join(to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", writer.Boundary())},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func sendSMTP(conf config.Email, from string, msg []byte) error {
+	server := conf.SMTP
+	address := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	dialer := net.Dialer{Timeout: server.Timeout}
+	tlsConfig := &tls.Config{ServerName: server.Host}
+
+	var conn net.Conn
+	var err error
+	if server.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(&dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	if server.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(server.Timeout))
+	}
+	client, err := smtp.NewClient(conn, server.Host)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return err
+	}
+	defer client.Close() //nolint:errcheck
+
+	hostname, _ := os.Hostname()
+	if err := client.Hello(hostname); err != nil {
+		return err
+	}
+	if server.Security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't support STARTTLS", address)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if server.Username != "" {
+		// PlainAuth refuses to send the password over unencrypted connections to anything but localhost
+		password, err := config.ReadSecret(server.Password, server.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the smtp password: %w", err)
+		}
+		if err := client.Auth(smtp.PlainAuth("", server.Username, password, server.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range conf.To {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func sendSendmail(conf config.Email, from string, msg []byte) error {
+	cmd := exec.Command(conf.Sendmail, append([]string{"-i", "-f", from, "--"}, conf.To...)...)
+	cmd.Stdin = bytes.NewReader(msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail failed: %v, %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func sendMail(conf config.Email, subject string, text string, html string, now time.Time) error {
+	from := conf.From
+	if from == "" {
+		hostname, _ := os.Hostname()
+		from = "uupd@" + hostname
+	}
+	msg, err := buildMessage(from, conf.To, subject, text, html, now)
+	if err != nil {
+		return err
+	}
+	if conf.Transport == TransportSMTP {
+		return sendSMTP(conf, from, msg)
+	}
+	return sendSendmail(conf, from, msg)
+}
+
+// digest adds the report to the runs waiting for the next digest, and mails them once the interval passed
+func digest(conf config.Email, report Report, now time.Time) error {
+	state := digestState{Since: now}
+	data, err := os.ReadFile(conf.State)
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("invalid email digest state in %s: %w", conf.State, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	report.Modules = slices.Clone(report.Modules)
+	for i := range report.Modules {
+		report.Modules[i].Output = tail(report.Modules[i].Output)
+	}
+	state.Runs = append(state.Runs, report)
+
+	if now.Sub(state.Since) >= conf.DigestInterval {
+		failed := 0
+		for _, run := range state.Runs {
+			if !run.Success {
+				failed++
+			}
+		}
+		subject := fmt.Sprintf("Update digest for %s: %d runs, %d failed", report.Hostname, len(state.Runs), failed)
+		var html strings.Builder
+		err := digestHTML.Execute(&html, struct {
+			digestState
+			Now  time.Time
+			Last Report
+		}{state, now, report})
+		if err != nil {
+			return err
+		}
+		if err := sendMail(conf, subject, digestText(state, now), html.String(), now); err != nil {
+			// the runs stay around for the next try
+			return errors.Join(err, writeDigestState(conf.State, state))
+		}
+		state = digestState{Since: now}
+	}
+	return writeDigestState(conf.State, state)
+}
+
+func writeDigestState(path string, state digestState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// the captured output may contain things only root should see
+	return os.WriteFile(path, data, 0600)
+}
+
+// SendEmail mails the report, or adds it to the digest
+func SendEmail(conf config.Email, report Report, now time.Time) error {
+	if !conf.Enable {
+		return nil
+	}
+	switch conf.When {
+	case WhenDigest:
+		return digest(conf, report, now)
+	case WhenFailure:
+		if report.Success {
+			return nil
+		}
+	}
+	var html strings.Builder
+	if err := reportHTML.Execute(&html, report); err != nil {
+		return err
+	}
+	return sendMail(conf, report.Title(), reportText(report), html.String(), now)
+}
@@ -0,0 +1,279 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/ublue-os/uupd/pkg/session"
+)
+
+const (
+	UrgencyLow      = "low"
+	UrgencyNormal   = "normal"
+	UrgencyCritical = "critical"
+
+	ActionReboot  = "reboot"
+	ActionLater   = "later"
+	ActionDetails = "details"
+)
+
+const (
+	notificationsName      = "org.freedesktop.Notifications"
+	notificationsPath      = "/org/freedesktop/Notifications"
+	notificationsInterface = "org.freedesktop.Notifications"
+)
+
+type Action struct {
+	Key   string
+	Label string
+}
+
+// Notification follows the desktop notifications spec: https://specifications.freedesktop.org/notification-spec/latest/
+type Notification struct {
+	Summary string
+	Body    string
+	// Icon name from the icon theme, or a file:// URI
+	Icon    string
+	Urgency string
+	Actions []Action
+	// ID of an earlier notification this one replaces, 0 for a new one
+	ReplacesID uint32
+}
+
+func urgencyLevel(urgency string) byte {
+	switch urgency {
+	case UrgencyLow:
+		return 0
+	case UrgencyCritical:
+		return 2
+	}
+	return 1
+}
+
+// Notifier talks to the notification server on a session bus
+type Notifier struct {
+	conn *dbus.Conn
+	// Signals of the notification server, subscribed before anything gets sent so no answer gets lost
+	signals chan *dbus.Signal
+}
+
+var notificationSignals = []string{"ActionInvoked", "NotificationClosed"}
+
+func signalMatch(member string) []dbus.MatchOption {
+	return []dbus.MatchOption{dbus.WithMatchInterface(notificationsInterface), dbus.WithMatchMember(member), dbus.WithMatchObjectPath(notificationsPath)}
+}
+
+// UserBusAddress returns the address of the session bus of a logged in user
+func UserBusAddress(uid int) string {
+	return fmt.Sprintf("unix:path=/run/user/%d/bus", uid)
+}
+
+// Dial connects to the session bus at the address, root is allowed to connect to the bus of every user
+func Dial(address string) (*Notifier, error) {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	n := &Notifier{conn: conn, signals: make(chan *dbus.Signal, 10)}
+	conn.Signal(n.signals)
+	for _, member := range notificationSignals {
+		if err := conn.AddMatchSignal(signalMatch(member)...); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *Notifier) Close() error {
+	for _, member := range notificationSignals {
+		_ = n.conn.RemoveMatchSignal(signalMatch(member)...)
+	}
+	n.conn.RemoveSignal(n.signals)
+	return n.conn.Close()
+}
+
+// Send shows the notification and returns its ID
+func (n *Notifier) Send(notification Notification) (uint32, error) {
+	actions := []string{}
+	for _, action := range notification.Actions {
+		actions = append(actions, action.Key, action.Label)
+	}
+	hints := map[string]dbus.Variant{
+		"urgency":       dbus.MakeVariant(urgencyLevel(notification.Urgency)),
+		"desktop-entry": dbus.MakeVariant("uupd"),
+	}
+
+	var id uint32
+	err := n.conn.Object(notificationsName, notificationsPath).Call(notificationsInterface+".Notify", 0,
+		"uupd",
+		notification.ReplacesID,
+		notification.Icon,
+		notification.Summary,
+		notification.Body,
+		actions,
+		hints,
+		int32(-1),
+	).Store(&id)
+	return id, err
+}
+
+// Wait returns the key of the action the user picked on the notification, or "" if it got closed without picking one
+// Only one Wait at a time per notifier, signals of other notifications get dropped
+func (n *Notifier) Wait(ctx context.Context, id uint32) (string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case signal, ok := <-n.signals:
+			if !ok {
+				return "", errors.New("session bus connection closed")
+			}
+			if len(signal.Body) < 2 {
+				continue
+			}
+			if signalID, ok := signal.Body[0].(uint32); !ok || signalID != id {
+				continue
+			}
+			switch signal.Name {
+			case notificationsInterface + ".ActionInvoked":
+				action, _ := signal.Body[1].(string)
+				return action, nil
+			case notificationsInterface + ".NotificationClosed":
+				return "", nil
+			}
+		}
+	}
+}
+
+// notifySend is the fallback for sessions that can't be reached over D-Bus
+func notifySend(user session.User, notification Notification) error {
+	cmd := exec.Command("/usr/bin/machinectl", "shell", fmt.Sprintf("%d@", user.UID), "/usr/bin/notify-send", "--urgency", notification.Urgency, "--app-name", "uupd", "--icon", notification.Icon, notification.Summary, notification.Body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("notify-send failed: %v, %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Send shows the notification to every user, actions only work for users reachable over D-Bus
+func Send(users []session.User, notification Notification) error {
+	_, err := deliver(users, notification)
+	return err
+}
+
+// deliver is Send, also returning the names of the users that got the notification
+func deliver(users []session.User, notification Notification) ([]string, error) {
+	var delivered []string
+	var errs []error
+	for _, user := range users {
+		notifier, err := Dial(UserBusAddress(user.UID))
+		if err != nil {
+			slog.Debug("Failed connecting to session bus, falling back to notify-send", slog.String("user", user.Name), slog.Any("error", err))
+			err = notifySend(user, notification)
+		} else {
+			_, err = notifier.Send(notification)
+			notifier.Close() //nolint:errcheck
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed notifying %s: %w", user.Name, err))
+			continue
+		}
+		delivered = append(delivered, user.Name)
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// Prompt shows the notification to every user and returns the first action any of them picked within the timeout.
+// If followUp returns a notification for the picked action, it replaces the notification of every user and Prompt
+// keeps waiting for an answer to it instead.
+func Prompt(users []session.User, notification Notification, timeout time.Duration, followUp func(action string) *Notification) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type sent struct {
+		notifier *Notifier
+		id       uint32
+	}
+	var notifications []sent
+	defer func() {
+		for _, s := range notifications {
+			s.notifier.Close() //nolint:errcheck
+		}
+	}()
+
+	var errs []error
+	for _, user := range users {
+		notifier, err := Dial(UserBusAddress(user.UID))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed connecting to the session bus of %s: %w", user.Name, err))
+			continue
+		}
+		id, err := notifier.Send(notification)
+		if err != nil {
+			notifier.Close() //nolint:errcheck
+			errs = append(errs, fmt.Errorf("failed notifying %s: %w", user.Name, err))
+			continue
+		}
+		notifications = append(notifications, sent{notifier, id})
+	}
+	if len(notifications) == 0 {
+		return "", errors.Join(append(errs, errors.New("no user could be notified"))...)
+	}
+
+	for {
+		// every notification shown gets its own round of waiting
+		round, stop := context.WithCancel(ctx)
+		actions := make(chan string, len(notifications))
+		var waiting sync.WaitGroup
+		for _, s := range notifications {
+			waiting.Add(1)
+			go func() {
+				defer waiting.Done()
+				action, err := s.notifier.Wait(round, s.id)
+				if err == nil && action != "" {
+					actions <- action
+				}
+			}()
+		}
+
+		select {
+		case action := <-actions:
+			stop()
+			// the next round waits on the same notifiers
+			waiting.Wait()
+			var next *Notification
+			if followUp != nil {
+				next = followUp(action)
+			}
+			if next == nil {
+				return action, nil
+			}
+			for i, s := range notifications {
+				next.ReplacesID = s.id
+				// the server hands out a new ID if the old notification got closed already
+				if id, err := s.notifier.Send(*next); err == nil {
+					notifications[i].id = id
+				}
+			}
+		case <-ctx.Done():
+			stop()
+			return "", nil
+		}
+	}
+}
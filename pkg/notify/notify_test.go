@@ -0,0 +1,504 @@
+package notify_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/notify"
+	"github.com/ublue-os/uupd/pkg/session"
+)
+
+// startBus runs a private session bus, skipping the test without dbus-daemon
+func startBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address", "--address=unix:path="+filepath.Join(t.TempDir(), "bus"))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("unable to get stdout: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unable to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("unable to read bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// server is a notification server that picks the first action of every notification
+type server struct {
+	conn     *dbus.Conn
+	m        sync.Mutex
+	received []string
+	hints    []map[string]dbus.Variant
+}
+
+func (s *server) Notify(app string, replacesID uint32, icon string, summary string, body string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.received = append(s.received, summary)
+	s.hints = append(s.hints, hints)
+	id := replacesID
+	if id == 0 {
+		id = uint32(len(s.received))
+	}
+	if len(actions) > 0 {
+		// answer right away, the client has to be listening before it sends
+		go func() {
+			_ = s.conn.Emit("/org/freedesktop/Notifications", "org.freedesktop.Notifications.ActionInvoked", id, actions[0])
+		}()
+	}
+	return id, nil
+}
+
+// startServer runs the fake notification server on a private session bus and returns the bus address
+func startServer(t *testing.T) (*server, string) {
+	t.Helper()
+	address := startBus(t)
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("unable to connect to bus: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	fake := &server{conn: conn}
+	if err := conn.Export(fake, "/org/freedesktop/Notifications", "org.freedesktop.Notifications"); err != nil {
+		t.Fatalf("unable to export server: %v", err)
+	}
+	if reply, err := conn.RequestName("org.freedesktop.Notifications", dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("unable to own the notifications name: %v", err)
+	}
+	return fake, address
+}
+
+func TestNotifier(t *testing.T) {
+	fake, address := startServer(t)
+
+	notifier, err := notify.Dial(address)
+	if err != nil {
+		t.Fatalf("unable to dial bus: %v", err)
+	}
+	defer notifier.Close() //nolint:errcheck
+
+	id, err := notifier.Send(notify.Notification{Summary: "Updates Completed", Urgency: notify.UrgencyLow})
+	if err != nil {
+		t.Fatalf("unable to send notification: %v", err)
+	}
+	fake.m.Lock()
+	urgency := fake.hints[0]["urgency"].Value()
+	fake.m.Unlock()
+	if urgency != byte(0) {
+		t.Fatalf("Expected low urgency, got: %v", urgency)
+	}
+
+	replaced, err := notifier.Send(notify.Notification{Summary: "Updates Completed", ReplacesID: id})
+	if err != nil || replaced != id {
+		t.Fatalf("Notification %d not replaced: %d, %v", id, replaced, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, err = notifier.Send(notify.Notification{
+		Summary: "Reboot Pending",
+		Urgency: notify.UrgencyCritical,
+		Actions: []notify.Action{{Key: notify.ActionReboot, Label: "Reboot now"}, {Key: notify.ActionLater, Label: "Remind me later"}},
+	})
+	if err != nil {
+		t.Fatalf("unable to send notification: %v", err)
+	}
+	action, err := notifier.Wait(ctx, id)
+	if err != nil {
+		t.Fatalf("Failed waiting for action: %v", err)
+	}
+	if action != notify.ActionReboot {
+		t.Fatalf("Expected the reboot action, got: %q", action)
+	}
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	if !slices.Equal(fake.received, []string{"Updates Completed", "Updates Completed", "Reboot Pending"}) {
+		t.Fatalf("Unexpected notifications: %v", fake.received)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	conf := config.Notifications{OptOut: []string{"bob"}}
+	conf.QuietHours.Start = "22:00"
+	conf.QuietHours.End = "07:30"
+	conf.Events.ModuleFailed = config.NotificationEvent{Enable: true, Urgency: notify.UrgencyCritical, Icon: "dialog-error", Summary: "{{.Count}} Updates Failed", Body: "Systems Failed: {{.Modules}}"}
+	for _, event := range []*config.NotificationEvent{&conf.Events.UpdateStaged, &conf.Events.RebootPending, &conf.Events.ChecksSkipped, &conf.Events.ImageOutdated} {
+		*event = config.NotificationEvent{Urgency: notify.UrgencyNormal}
+	}
+
+	policy, err := notify.NewPolicy(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	notification, enabled, err := policy.Render(notify.EventModuleFailed, notify.Data{Modules: "Brew, Flatpak", Count: 2})
+	if err != nil || !enabled {
+		t.Fatalf("Expected the event to render, got: %v, %v", enabled, err)
+	}
+	if notification.Summary != "2 Updates Failed" || notification.Body != "Systems Failed: Brew, Flatpak" || notification.Urgency != notify.UrgencyCritical {
+		t.Fatalf("Unexpected notification: %+v", notification)
+	}
+	if _, enabled, _ := policy.Render(notify.EventUpdateStaged, notify.Data{}); enabled {
+		t.Fatalf("Expected disabled event not to render")
+	}
+
+	at := func(clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 1, 1, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+	}
+	for clock, quiet := range map[string]bool{"21:59": false, "22:00": true, "03:00": true, "07:29": true, "07:30": false, "12:00": false} {
+		if policy.Quiet(at(clock)) != quiet {
+			t.Fatalf("Expected quiet at %s to be %v", clock, quiet)
+		}
+	}
+
+	users := []session.User{{UID: 1000, Name: "alice"}, {UID: 1001, Name: "bob"}}
+	_, recipients, err := policy.Prepare(users, notify.EventModuleFailed, notify.Data{}, at("12:00"))
+	if err != nil || len(recipients) != 1 || recipients[0].Name != "alice" {
+		t.Fatalf("Expected only alice to get notified, got: %v, %v", recipients, err)
+	}
+	if _, recipients, _ := policy.Prepare(users, notify.EventModuleFailed, notify.Data{}, at("23:00")); len(recipients) != 0 {
+		t.Fatalf("Expected nobody to get notified during quiet hours, got: %v", recipients)
+	}
+
+	invalid := []func(conf *config.Notifications){
+		func(conf *config.Notifications) { conf.Events.ModuleFailed.Urgency = "urgent" },
+		func(conf *config.Notifications) { conf.Events.ModuleFailed.Body = "{{.Module}}" },
+		func(conf *config.Notifications) { conf.Events.ModuleFailed.Summary = "{{.Modules" },
+		func(conf *config.Notifications) { conf.QuietHours.End = "" },
+		func(conf *config.Notifications) { conf.QuietHours.Start = "10pm" },
+	}
+	for i, change := range invalid {
+		broken := conf
+		change(&broken)
+		if _, err := notify.NewPolicy(broken); err == nil {
+			t.Fatalf("Expected invalid configuration %d to fail", i)
+		}
+	}
+}
+
+func TestPendingStore(t *testing.T) {
+	dir := t.TempDir()
+	store := notify.PendingStore{Path: filepath.Join(dir, "uupd", "notifications.json"), Expiry: time.Hour}
+	now := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)
+
+	failed := notify.Notification{Summary: "Some System Updates Failed", Body: "Systems Failed: Brew", Urgency: notify.UrgencyCritical}
+	if err := store.Add(notify.EventModuleFailed, failed, []string{"alice"}, now); err != nil {
+		t.Fatalf("unable to add notification: %v", err)
+	}
+	reboot := notify.Notification{Summary: "System Update Ready", Actions: []notify.Action{{Key: notify.ActionReboot, Label: "Reboot now"}}}
+	if err := store.Add(notify.EventRebootPending, reboot, nil, now); err != nil {
+		t.Fatalf("unable to add notification: %v", err)
+	}
+	// the same failure again keeps its ID and who already got it
+	if err := store.Add(notify.EventModuleFailed, failed, []string{"bob"}, now.Add(30*time.Minute)); err != nil {
+		t.Fatalf("unable to add notification: %v", err)
+	}
+
+	pending, err := store.Load(now.Add(70 * time.Minute))
+	if err != nil {
+		t.Fatalf("unable to load notifications: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Event != notify.EventModuleFailed {
+		t.Fatalf("Expected only the renewed failure left after the reboot notification expired, got: %+v", pending)
+	}
+	if !pending[0].Created.Equal(now) || !slices.Equal(pending[0].Delivered, []string{"bob", "alice"}) {
+		t.Fatalf("Expected the failure to be deduplicated, got: %+v", pending[0])
+	}
+
+	fake, address := startServer(t)
+	notifier, err := notify.Dial(address)
+	if err != nil {
+		t.Fatalf("unable to dial bus: %v", err)
+	}
+	defer notifier.Close() //nolint:errcheck
+
+	if err := store.Add(notify.EventRebootPending, reboot, nil, now.Add(70*time.Minute)); err != nil {
+		t.Fatalf("unable to add notification: %v", err)
+	}
+	statePath := filepath.Join(dir, "state", "delivered.json")
+	for _, expected := range []int{2, 0} {
+		shown, err := notify.DeliverPending(notifier, store, "carol", statePath, now.Add(75*time.Minute))
+		if err != nil || shown != expected {
+			t.Fatalf("Expected %d notifications shown, got: %d, %v", expected, shown, err)
+		}
+	}
+	if shown, err := notify.DeliverPending(notifier, store, "alice", filepath.Join(dir, "alice.json"), now.Add(75*time.Minute)); err != nil || shown != 1 {
+		t.Fatalf("Expected alice to only get the reboot notification, got: %d, %v", shown, err)
+	}
+	fake.m.Lock()
+	if len(fake.received) != 3 {
+		t.Fatalf("Unexpected notifications: %v", fake.received)
+	}
+	fake.m.Unlock()
+
+	if err := store.Clear(now.Add(75*time.Minute), notify.EventModuleFailed); err != nil {
+		t.Fatalf("unable to clear notifications: %v", err)
+	}
+	pending, _ = store.Load(now.Add(75 * time.Minute))
+	if len(pending) != 1 || pending[0].Event != notify.EventRebootPending || len(pending[0].Notification.Actions) != 0 {
+		t.Fatalf("Expected only the reboot notification without actions left, got: %+v", pending)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	type request struct {
+		path    string
+		headers http.Header
+		body    string
+	}
+	var m sync.Mutex
+	var requests []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		m.Lock()
+		requests = append(requests, request{r.URL.Path, r.Header, string(body)})
+		m.Unlock()
+		if r.URL.Path == "/broken" {
+			http.Error(w, "no such topic", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	webhooks := []config.Webhook{
+		{URL: srv.URL + "/hook", When: notify.WhenAlways, Headers: map[string]string{"X-Secret": "hunter2"}},
+		{URL: srv.URL + "/failures"},
+	}
+	push := []config.Push{
+		{Service: notify.ServiceNtfy, URL: srv.URL + "/uupd", Token: "tk_ntfy", When: notify.WhenAlways},
+		{Service: notify.ServiceGotify, URL: srv.URL + "/gotify/", Token: "gotify-app", When: notify.WhenFailure},
+	}
+	if err := notify.ValidateSinks(webhooks, push); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	started := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)
+	report := notify.Report{
+		Hostname: "nas",
+		Started:  started,
+		Finished: started.Add(90 * time.Second),
+		Modules: []notify.ModuleResult{
+			{Context: "Flatpak Update"},
+			{Context: "Brew Upgrade", Failure: true, Error: "exit status 1"},
+		},
+	}
+	if err := notify.SendReport(webhooks, push, report); err != nil {
+		t.Fatalf("unable to send failure report: %v", err)
+	}
+	report.Success = true
+	report.Modules = report.Modules[:1]
+	if err := notify.SendReport(webhooks, push, report); err != nil {
+		t.Fatalf("unable to send success report: %v", err)
+	}
+
+	if err := notify.SendWebhook(config.Webhook{URL: srv.URL + "/broken"}, report); err == nil || !strings.Contains(err.Error(), "no such topic") {
+		t.Fatalf("Expected the error of the sink, got: %v", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	var paths []string
+	for _, r := range requests {
+		paths = append(paths, r.path)
+	}
+	if !slices.Equal(paths, []string{"/hook", "/failures", "/uupd", "/gotify/message", "/hook", "/uupd", "/broken"}) {
+		t.Fatalf("Unexpected requests: %v", paths)
+	}
+
+	var decoded notify.Report
+	if err := json.Unmarshal([]byte(requests[0].body), &decoded); err != nil || decoded.Success || len(decoded.Failures()) != 1 {
+		t.Fatalf("Unexpected webhook payload: %s, %v", requests[0].body, err)
+	}
+	if requests[0].headers.Get("X-Secret") != "hunter2" {
+		t.Fatalf("Expected the configured webhook headers, got: %v", requests[0].headers)
+	}
+	ntfy := requests[2]
+	if ntfy.headers.Get("Title") != "Updates failed on nas" || ntfy.headers.Get("Priority") != "high" || ntfy.headers.Get("Authorization") != "Bearer tk_ntfy" {
+		t.Fatalf("Unexpected ntfy headers: %v", ntfy.headers)
+	}
+	if ntfy.body != "✓ Flatpak Update\n✗ Brew Upgrade: exit status 1\nTook 1m30s" {
+		t.Fatalf("Unexpected ntfy message: %q", ntfy.body)
+	}
+	var gotify map[string]any
+	if err := json.Unmarshal([]byte(requests[3].body), &gotify); err != nil || gotify["priority"] != float64(8) || requests[3].headers.Get("X-Gotify-Key") != "gotify-app" {
+		t.Fatalf("Unexpected gotify message: %s, %v", requests[3].body, err)
+	}
+
+	for _, invalid := range [][]config.Push{{{Service: "pushover", URL: srv.URL}}, {{Service: notify.ServiceNtfy, URL: "ntfy.sh/uupd"}}, {{Service: notify.ServiceNtfy, URL: srv.URL, When: "success"}}} {
+		if err := notify.ValidateSinks(nil, invalid); err == nil {
+			t.Fatalf("Expected invalid push to fail: %+v", invalid)
+		}
+	}
+}
+
+// startSMTP runs an SMTP server that accepts a single mail and sends what it got on the channel
+func startSMTP(t *testing.T) (int, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		var envelope []string
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO":
+				_ = tp.PrintfLine("250 localhost")
+			case "MAIL", "RCPT":
+				envelope = append(envelope, line)
+				_ = tp.PrintfLine("250 OK")
+			case "DATA":
+				_ = tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				mails <- strings.Join(envelope, "\n") + "\n" + string(data)
+				_ = tp.PrintfLine("250 OK")
+			case "QUIT":
+				_ = tp.PrintfLine("221 Bye")
+				return
+			default:
+				_ = tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, mails
+}
+
+func TestEmail(t *testing.T) {
+	port, mails := startSMTP(t)
+	conf := config.Email{Enable: true, From: "uupd@nas", To: []string{"admin@example.com"}, When: notify.WhenFailure, Transport: notify.TransportSMTP}
+	conf.SMTP.Host = "127.0.0.1"
+	conf.SMTP.Port = port
+	conf.SMTP.Security = notify.SecurityNone
+	conf.SMTP.Timeout = 5 * time.Second
+	if err := notify.ValidateEmail(conf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	now := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)
+	report := notify.Report{
+		Hostname: "nas",
+		Started:  now,
+		Finished: now.Add(time.Minute),
+		Image:    "ghcr.io/ublue-os/bazzite:stable",
+		Staged:   true,
+		Update:   "41.20240101",
+		Changes:  12,
+		Modules: []notify.ModuleResult{
+			{Context: "System Update"},
+			{Context: "Brew Upgrade", Failure: true, Error: "exit status 1", Cli: []string{"brew", "upgrade", "-y"}, Output: "Error: <formula> not found"},
+		},
+	}
+	if err := notify.SendEmail(conf, notify.Report{Hostname: "nas", Success: true}, now); err != nil {
+		t.Fatalf("Expected successful runs to be skipped, got: %v", err)
+	}
+	if err := notify.SendEmail(conf, report, now); err != nil {
+		t.Fatalf("unable to send email: %v", err)
+	}
+	mail := <-mails
+	for _, expected := range []string{
+		"MAIL FROM:<uupd@nas>",
+		"RCPT TO:<admin@example.com>",
+		"Subject: Updates failed on nas",
+		"Content-Type: multipart/alternative",
+		"System update to 41.20240101 staged (12 packages changed)",
+		"Command: brew upgrade -y",
+		"<pre>Error: &lt;formula&gt; not found</pre>",
+	} {
+		if !strings.Contains(mail, expected) {
+			t.Fatalf("Expected mail to contain %q, got:\n%s", expected, mail)
+		}
+	}
+
+	dir := t.TempDir()
+	sendmail := filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat >> " + filepath.Join(dir, "mail") + "\n"
+	if err := os.WriteFile(sendmail, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write sendmail: %v", err)
+	}
+	digest := config.Email{Enable: true, From: "uupd@nas", To: []string{"admin@example.com"}, When: notify.WhenDigest, DigestInterval: 7 * 24 * time.Hour, State: filepath.Join(dir, "state", "digest.json"), Transport: notify.TransportSendmail, Sendmail: sendmail}
+	if err := notify.ValidateEmail(digest); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for day := range 8 {
+		run := report
+		run.Success = day != 3
+		if run.Success {
+			run.Modules = run.Modules[:1]
+		}
+		if err := notify.SendEmail(digest, run, now.Add(time.Duration(day)*24*time.Hour)); err != nil {
+			t.Fatalf("unable to add run to digest: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "mail")); (err == nil) != (day == 7) {
+			t.Fatalf("Expected the digest to only be sent after a week, day %d: %v", day, err)
+		}
+	}
+	sent, _ := os.ReadFile(filepath.Join(dir, "mail"))
+	if !strings.Contains(string(sent), "Subject: Update digest for nas: 8 runs, 1 failed") || !strings.Contains(string(sent), "Brew Upgrade") {
+		t.Fatalf("Unexpected digest:\n%s", sent)
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	if strings.TrimSpace(string(args)) != "-i -f uupd@nas -- admin@example.com" {
+		t.Fatalf("Unexpected sendmail arguments: %s", args)
+	}
+	state, _ := os.ReadFile(digest.State)
+	if strings.Contains(string(state), "Brew") {
+		t.Fatalf("Expected the digest state to be reset, got: %s", state)
+	}
+
+	invalid := []config.Email{
+		{Enable: true, When: notify.WhenAlways, Transport: notify.TransportSendmail},
+		{Enable: true, To: []string{"admin"}, When: "weekly", Transport: notify.TransportSendmail},
+		{Enable: true, To: []string{"admin"}, When: notify.WhenAlways, Transport: "mailx"},
+		{Enable: true, To: []string{"admin"}, When: notify.WhenDigest, Transport: notify.TransportSendmail},
+	}
+	for i, conf := range invalid {
+		if err := notify.ValidateEmail(conf); err == nil {
+			t.Fatalf("Expected invalid email configuration %d to fail", i)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Pending is a notification kept around for the users that weren't logged in when it got sent
+type Pending struct {
+	ID    string
+	Event string
+	// Never has actions, nothing is waiting for an answer by the time it gets delivered
+	Notification Notification
+	Created      time.Time
+	Expires      time.Time
+	// Names of the users that already got it
+	Delivered []string
+}
+
+// PendingStore keeps the pending notifications in a json file that root writes and every user can read
+type PendingStore struct {
+	Path   string
+	Expiry time.Duration
+}
+
+// Load returns the pending notifications that didn't expire yet, a missing file has none
+func (s PendingStore) Load(now time.Time) ([]Pending, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending []Pending
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, fmt.Errorf("invalid pending notifications in %s: %w", s.Path, err)
+	}
+	return slices.DeleteFunc(pending, func(p Pending) bool { return !now.Before(p.Expires) }), nil
+}
+
+func (s PendingStore) write(pending []Pending) error {
+	data, err := json.MarshalIndent(pending, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	// users may be reading the file while it's written, so it gets replaced in one go
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// Add keeps the notification for the users that didn't get it yet, replacing the pending one of the same event.
+// Resending the same notification keeps its ID, so nobody gets it twice.
+func (s PendingStore) Add(event string, notification Notification, delivered []string, now time.Time) error {
+	pending, err := s.Load(now)
+	if err != nil {
+		return err
+	}
+	notification.Actions = nil
+	notification.ReplacesID = 0
+	entry := Pending{
+		ID:           fmt.Sprintf("%s-%d", event, now.UnixNano()),
+		Event:        event,
+		Notification: notification,
+		Created:      now,
+		Expires:      now.Add(s.Expiry),
+		Delivered:    delivered,
+	}
+	index := slices.IndexFunc(pending, func(p Pending) bool { return p.Event == event })
+	if index < 0 {
+		return s.write(append(pending, entry))
+	}
+	if same := pending[index].Notification; same.Summary == notification.Summary && same.Body == notification.Body && same.Icon == notification.Icon && same.Urgency == notification.Urgency {
+		entry.ID = pending[index].ID
+		entry.Created = pending[index].Created
+		for _, name := range pending[index].Delivered {
+			if !slices.Contains(entry.Delivered, name) {
+				entry.Delivered = append(entry.Delivered, name)
+			}
+		}
+	}
+	pending[index] = entry
+	return s.write(pending)
+}
+
+// Clear drops the pending notifications of the events, once they don't apply anymore
+func (s PendingStore) Clear(now time.Time, events ...string) error {
+	pending, err := s.Load(now)
+	if err != nil {
+		return err
+	}
+	cleared := slices.DeleteFunc(slices.Clone(pending), func(p Pending) bool { return slices.Contains(events, p.Event) })
+	if len(cleared) == len(pending) {
+		return nil
+	}
+	return s.write(cleared)
+}
+
+// StatePath is where a user keeps the IDs of the pending notifications they got, following the XDG base directory spec
+func StatePath() (string, error) {
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(state, "uupd", "delivered.json"), nil
+}
+
+// DeliverPending shows the user every pending notification they didn't get yet and remembers them in the state file.
+// Returns how many got shown.
+func DeliverPending(notifier *Notifier, store PendingStore, user string, statePath string, now time.Time) (int, error) {
+	pending, err := store.Load(now)
+	if err != nil {
+		return 0, err
+	}
+
+	var delivered []string
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, &delivered); err != nil {
+			return 0, fmt.Errorf("invalid state in %s: %w", statePath, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	// only remember the IDs still pending, the rest can't come back
+	var state []string
+	shown := 0
+	var errs []error
+	for _, p := range pending {
+		if slices.Contains(p.Delivered, user) {
+			continue
+		}
+		if slices.Contains(delivered, p.ID) {
+			state = append(state, p.ID)
+			continue
+		}
+		if _, err := notifier.Send(p.Notification); err != nil {
+			errs = append(errs, fmt.Errorf("failed showing %s notification: %w", p.Event, err))
+			continue
+		}
+		state = append(state, p.ID)
+		shown++
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return shown, err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return shown, err
+	}
+	if err := os.WriteFile(statePath, data, 0600); err != nil {
+		return shown, err
+	}
+	return shown, errors.Join(errs...)
+}
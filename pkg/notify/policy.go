@@ -0,0 +1,225 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/session"
+)
+
+const (
+	EventUpdateStaged  = "update-staged"
+	EventRebootPending = "reboot-pending"
+	EventModuleFailed  = "module-failed"
+	EventChecksSkipped = "checks-skipped"
+	EventImageOutdated = "image-outdated"
+)
+
+// Data holds the fields the summary and body templates can use, fields that don't apply to an event are empty
+type Data struct {
+	// Comma separated modules the event is about
+	Modules string
+	// Failed modules, or changed packages for staged updates
+	Count int
+	Error string
+	// Images, or deployments, the system update goes between
+	From string
+	To   string
+}
+
+type event struct {
+	enable  bool
+	urgency string
+	icon    string
+	summary *template.Template
+	body    *template.Template
+}
+
+// Policy decides which events notify whom, and renders their notifications
+type Policy struct {
+	events     map[string]event
+	optOut     []string
+	quietStart time.Duration
+	quietEnd   time.Duration
+	quiet      bool
+	// nil when pending notifications are disabled
+	pending  *PendingStore
+	webhooks []config.Webhook
+	push     []config.Push
+	email    config.Email
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s, expected HH:MM", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func parseEvent(name string, conf config.NotificationEvent) (event, error) {
+	parsed := event{enable: conf.Enable, urgency: conf.Urgency, icon: conf.Icon}
+	switch conf.Urgency {
+	case UrgencyLow, UrgencyNormal, UrgencyCritical:
+	default:
+		return parsed, fmt.Errorf("invalid urgency for %s: %s, expected %s, %s or %s", name, conf.Urgency, UrgencyLow, UrgencyNormal, UrgencyCritical)
+	}
+
+	var err error
+	if parsed.summary, err = template.New(name + " summary").Parse(conf.Summary); err != nil {
+		return parsed, err
+	}
+	if parsed.body, err = template.New(name + " body").Parse(conf.Body); err != nil {
+		return parsed, err
+	}
+	// unknown fields only show up when executing the templates
+	for _, tmpl := range []*template.Template{parsed.summary, parsed.body} {
+		if err := tmpl.Execute(&strings.Builder{}, Data{}); err != nil {
+			return parsed, err
+		}
+	}
+	return parsed, nil
+}
+
+func NewPolicy(conf config.Notifications) (Policy, error) {
+	policy := Policy{events: map[string]event{}, optOut: conf.OptOut, webhooks: conf.Webhooks, push: conf.Push, email: conf.Email}
+	if err := errors.Join(ValidateSinks(conf.Webhooks, conf.Push), ValidateEmail(conf.Email)); err != nil {
+		return policy, err
+	}
+	if conf.Pending.Enable {
+		policy.pending = &PendingStore{Path: conf.Pending.Path, Expiry: conf.Pending.Expiry}
+	}
+
+	events := map[string]config.NotificationEvent{
+		EventUpdateStaged:  conf.Events.UpdateStaged,
+		EventRebootPending: conf.Events.RebootPending,
+		EventModuleFailed:  conf.Events.ModuleFailed,
+		EventChecksSkipped: conf.Events.ChecksSkipped,
+		EventImageOutdated: conf.Events.ImageOutdated,
+	}
+	for name, eventConf := range events {
+		parsed, err := parseEvent(name, eventConf)
+		if err != nil {
+			return policy, err
+		}
+		policy.events[name] = parsed
+	}
+
+	start, end := conf.QuietHours.Start, conf.QuietHours.End
+	if start == "" && end == "" {
+		return policy, nil
+	}
+	if start == "" || end == "" {
+		return policy, fmt.Errorf("quiet hours need both a start and an end, got: %q to %q", start, end)
+	}
+	var err error
+	if policy.quietStart, err = parseClock(start); err != nil {
+		return policy, err
+	}
+	if policy.quietEnd, err = parseClock(end); err != nil {
+		return policy, err
+	}
+	policy.quiet = policy.quietStart != policy.quietEnd
+	return policy, nil
+}
+
+// Quiet returns whether the time falls within the quiet hours
+func (p Policy) Quiet(now time.Time) bool {
+	if !p.quiet {
+		return false
+	}
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if p.quietStart < p.quietEnd {
+		return clock >= p.quietStart && clock < p.quietEnd
+	}
+	return clock >= p.quietStart || clock < p.quietEnd
+}
+
+// Recipients drops the users that opted out of notifications
+func (p Policy) Recipients(users []session.User) []session.User {
+	var recipients []session.User
+	for _, user := range users {
+		if !slices.Contains(p.optOut, user.Name) {
+			recipients = append(recipients, user)
+		}
+	}
+	return recipients
+}
+
+// Enabled returns whether the event notifies at all, to skip gathering its data otherwise
+func (p Policy) Enabled(name string) bool {
+	return p.events[name].enable
+}
+
+// Render fills in the notification of the event, the bool is false if the event is disabled
+func (p Policy) Render(name string, data Data) (Notification, bool, error) {
+	event, ok := p.events[name]
+	if !ok {
+		return Notification{}, false, fmt.Errorf("unknown notification event: %s", name)
+	}
+	if !event.enable {
+		return Notification{}, false, nil
+	}
+	var summary, body strings.Builder
+	if err := event.summary.Execute(&summary, data); err != nil {
+		return Notification{}, false, err
+	}
+	if err := event.body.Execute(&body, data); err != nil {
+		return Notification{}, false, err
+	}
+	return Notification{Summary: summary.String(), Body: body.String(), Icon: event.icon, Urgency: event.urgency}, true, nil
+}
+
+func (p Policy) recipients(users []session.User, name string, now time.Time) []session.User {
+	if p.Quiet(now) {
+		slog.Debug("Not notifying during quiet hours", slog.String("event", name))
+		return nil
+	}
+	return p.Recipients(users)
+}
+
+// Prepare renders the notification of the event and returns who should get it right now, nobody if the event is disabled or it's quiet hours
+func (p Policy) Prepare(users []session.User, name string, data Data, now time.Time) (Notification, []session.User, error) {
+	notification, enabled, err := p.Render(name, data)
+	if err != nil || !enabled {
+		return notification, nil, err
+	}
+	return notification, p.recipients(users, name, now), nil
+}
+
+// Defer keeps the notification for the users that log in later, everyone but the delivered users gets it with uupd notify-pending
+func (p Policy) Defer(name string, notification Notification, delivered []string) error {
+	if p.pending == nil {
+		return nil
+	}
+	return p.pending.Add(name, notification, delivered, time.Now())
+}
+
+// Clear drops the pending notifications of events that don't apply anymore
+func (p Policy) Clear(names ...string) error {
+	if p.pending == nil {
+		return nil
+	}
+	return p.pending.Clear(time.Now(), names...)
+}
+
+// Send notifies the users about the event following the policy, and defers it for the users that aren't logged in
+func (p Policy) Send(users []session.User, name string, data Data) error {
+	notification, enabled, err := p.Render(name, data)
+	if err != nil || !enabled {
+		return err
+	}
+	delivered, err := deliver(p.recipients(users, name, time.Now()), notification)
+	return errors.Join(err, p.Defer(name, notification, delivered))
+}
+
+// Report hands the report of the run to the webhook, push and email sinks, quiet hours only apply to desktop notifications
+func (p Policy) Report(report Report) error {
+	return errors.Join(SendReport(p.webhooks, p.push, report), SendEmail(p.email, report, time.Now()))
+}
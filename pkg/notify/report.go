@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ModuleResult is the outcome of one command a module ran
+type ModuleResult struct {
+	Context string   `json:"context"`
+	Failure bool     `json:"failure"`
+	Error   string   `json:"error,omitempty"`
+	Cli     []string `json:"cli,omitempty"`
+	Output  string   `json:"output,omitempty"`
+}
+
+// Report summarizes a run for the sinks that aren't a desktop
+type Report struct {
+	Hostname string         `json:"hostname"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	DryRun   bool           `json:"dry_run"`
+	Success  bool           `json:"success"`
+	Modules  []ModuleResult `json:"modules"`
+	// The booted system image, and the update waiting for a reboot if there is one
+	Image   string `json:"image,omitempty"`
+	Staged  bool   `json:"staged"`
+	Update  string `json:"update,omitempty"`
+	Changes int    `json:"changes,omitempty"`
+}
+
+// Failures returns the results of the commands that failed
+func (r Report) Failures() []ModuleResult {
+	var failures []ModuleResult
+	for _, module := range r.Modules {
+		if module.Failure {
+			failures = append(failures, module)
+		}
+	}
+	return failures
+}
+
+// Title is a one line summary of the run
+func (r Report) Title() string {
+	if r.Success {
+		return fmt.Sprintf("Updates completed on %s", r.Hostname)
+	}
+	return fmt.Sprintf("Updates failed on %s", r.Hostname)
+}
+
+// Text lists the result of every module, with the errors of failed ones
+func (r Report) Text() string {
+	var lines []string
+	for _, module := range r.Modules {
+		if module.Failure {
+			lines = append(lines, fmt.Sprintf("✗ %s: %s", module.Context, module.Error))
+		} else {
+			lines = append(lines, fmt.Sprintf("✓ %s", module.Context))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "Nothing to update")
+	}
+	if r.Staged {
+		lines = append(lines, r.StagedText())
+	}
+	lines = append(lines, fmt.Sprintf("Took %v", r.Finished.Sub(r.Started).Round(time.Second)))
+	return strings.Join(lines, "\n")
+}
+
+// StagedText describes the staged system update
+func (r Report) StagedText() string {
+	if r.Update == "" {
+		return "System update staged, reboot to apply it"
+	}
+	return fmt.Sprintf("System update to %s staged (%d packages changed), reboot to apply it", r.Update, r.Changes)
+}
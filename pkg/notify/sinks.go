@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/config"
+)
+
+const (
+	WhenAlways  = "always"
+	WhenFailure = "failure"
+
+	ServiceNtfy   = "ntfy"
+	ServiceGotify = "gotify"
+
+	defaultSinkTimeout = 10 * time.Second
+)
+
+func validateWhen(when string) error {
+	switch when {
+	case WhenAlways, WhenFailure, "":
+		return nil
+	}
+	return fmt.Errorf("invalid when: %s, expected %s or %s", when, WhenAlways, WhenFailure)
+}
+
+func validateURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid url: %s, expected an http(s) url", raw)
+	}
+	return nil
+}
+
+// ValidateSinks checks the webhook and push configuration before anything gets sent
+func ValidateSinks(webhooks []config.Webhook, push []config.Push) error {
+	for _, webhook := range webhooks {
+		if err := errors.Join(validateURL(webhook.URL), validateWhen(webhook.When)); err != nil {
+			return fmt.Errorf("invalid webhook: %w", err)
+		}
+	}
+	for _, p := range push {
+		if p.Service != ServiceNtfy && p.Service != ServiceGotify {
+			return fmt.Errorf("invalid push service: %s, expected %s or %s", p.Service, ServiceNtfy, ServiceGotify)
+		}
+		if err := errors.Join(validateURL(p.URL), validateWhen(p.When)); err != nil {
+			return fmt.Errorf("invalid %s push: %w", p.Service, err)
+		}
+	}
+	return nil
+}
+
+// fires returns whether a sink configured with when gets the report, sinks default to failures only
+func fires(when string, report Report) bool {
+	return when == WhenAlways || !report.Success
+}
+
+func post(target string, contentType string, body []byte, headers map[string]string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultSinkTimeout
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SendWebhook posts the report as json
+func SendWebhook(webhook config.Webhook, report Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	headers, err := webhookHeaders(webhook)
+	if err != nil {
+		return err
+	}
+	return post(webhook.URL, "application/json", body, headers, webhook.Timeout)
+}
+
+// webhookHeaders adds the headers of the headers file to the ones set in the configuration
+func webhookHeaders(webhook config.Webhook) (map[string]string, error) {
+	secret, err := config.ReadSecret("", webhook.HeadersFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the webhook headers: %w", err)
+	}
+	headers := maps.Clone(webhook.Headers)
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	for _, line := range strings.Split(secret, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid header in %s, expected \"Name: value\"", webhook.HeadersFile)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// SendPush publishes the summary of the report to an ntfy topic, or as a Gotify message
+func SendPush(push config.Push, report Report) error {
+	token, err := config.ReadSecret(push.Token, push.TokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read the %s token: %w", push.Service, err)
+	}
+	switch push.Service {
+	case ServiceNtfy:
+		// https://docs.ntfy.sh/publish/
+		headers := map[string]string{"Title": report.Title(), "Priority": "default", "Tags": "white_check_mark"}
+		if !report.Success {
+			headers["Priority"] = "high"
+			headers["Tags"] = "warning"
+		}
+		if token != "" {
+			headers["Authorization"] = "Bearer " + token
+		}
+		return post(push.URL, "text/plain; charset=utf-8", []byte(report.Text()), headers, push.Timeout)
+	case ServiceGotify:
+		// https://gotify.net/api-docs#/message/createMessage
+		priority := 4
+		if !report.Success {
+			priority = 8
+		}
+		body, err := json.Marshal(map[string]any{"title": report.Title(), "message": report.Text(), "priority": priority})
+		if err != nil {
+			return err
+		}
+		return post(strings.TrimSuffix(push.URL, "/")+"/message", "application/json", body, map[string]string{"X-Gotify-Key": token}, push.Timeout)
+	}
+	return fmt.Errorf("unknown push service: %s", push.Service)
+}
+
+// SendReport hands the report to every sink configured for it
+func SendReport(webhooks []config.Webhook, push []config.Push, report Report) error {
+	var errs []error
+	for _, webhook := range webhooks {
+		if fires(webhook.When, report) {
+			errs = append(errs, SendWebhook(webhook, report))
+		}
+	}
+	for _, p := range push {
+		if fires(p.When, report) {
+			errs = append(errs, SendPush(p, report))
+		}
+	}
+	return errors.Join(errs...)
+}
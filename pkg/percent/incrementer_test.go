@@ -1,7 +1,10 @@
 package percent_test
 
 import (
+	"bytes"
+	"errors"
 	"math"
+	"sync"
 	"testing"
 
 	"github.com/ublue-os/uupd/pkg/percent"
@@ -41,3 +44,111 @@ func TestProperIncrement(t *testing.T) {
 		iter++
 	}
 }
+
+func TestConcurrentForks(t *testing.T) {
+	max := 8
+	tracker := InitIncrementer(max)
+
+	var wg sync.WaitGroup
+	for range max {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fork := tracker.Fork()
+			fork.SectionPercent(50)
+			fork.IncrementSection(nil)
+		}()
+	}
+	wg.Wait()
+
+	if tracker.CurrentStep() != max {
+		t.Fatalf("Forks did not share steps. Expected: %d, Got: %d", max, tracker.CurrentStep())
+	}
+	if tracker.OverallPercent() != 100 {
+		t.Fatalf("Wrong overall percent after all forks finished: %v", tracker.OverallPercent())
+	}
+}
+
+func TestRenderers(t *testing.T) {
+	var b bytes.Buffer
+	renderer, err := percent.NewRenderer(percent.ModePlain, &b)
+	if err != nil {
+		t.Fatalf("unable to create renderer: %v", err)
+	}
+	tracker := percent.NewIncrementer(renderer, 2)
+	renderer.Start()
+	fork := tracker.Fork()
+	fork.ReportStatusChange("Flatpak", "System Apps")
+	fork.SectionPercent(50)
+	// same status, only the percentage changed
+	fork.ReportStatusChange("Flatpak", "System Apps")
+	fork.IncrementSection(nil)
+	fork = tracker.Fork()
+	fork.ReportStatusChange("Distrobox", "Distroboxes for User: alice")
+	fork.IncrementSection(errors.New("exit status 1"))
+	renderer.Stop()
+
+	expected := "[1/2] Updating Flatpak (System Apps), 0% done\n" +
+		"Finished updating Flatpak (System Apps)\n" +
+		"[2/2] Updating Distrobox (Distroboxes for User: alice), 50% done\n" +
+		"Failed updating Distrobox (Distroboxes for User: alice): exit status 1\n"
+	if b.String() != expected {
+		t.Fatalf("Unexpected plain output:\n%s", b.String())
+	}
+
+	b.Reset()
+	renderer, _ = percent.NewRenderer(percent.ModeOSC, &b)
+	tracker = percent.NewIncrementer(renderer, 4)
+	renderer.SetPhase(percent.PhaseWaiting)
+	renderer.SetPhase(percent.PhaseChecking)
+	renderer.Start()
+	tracker.IncrementSection(nil)
+	// brew has no progress of its own until it's done
+	tracker.ReportStatusChange("Brew", "Brew")
+	tracker.SectionPercent(50)
+	tracker.ReportStatusChange("System", "Downloading")
+	tracker.IncrementSection(errors.New("exit status 1"))
+	tracker.ReportStatusChange("Flatpak", "System Apps")
+	renderer.Stop()
+	expected = "\033]9;4;4;0\a\033]9;4;3;0\a\033]9;4;0\a" +
+		"\033]9;4;3;0\a\033]9;4;1;38\a\033]9;4;2;38\a\033]9;4;2;50\a\033]9;4;0\a"
+	if b.String() != expected {
+		t.Fatalf("Unexpected OSC output: %q", b.String())
+	}
+
+	if err := percent.ValidateMode("bars"); err == nil {
+		t.Fatalf("Expected an unknown progress mode to fail")
+	}
+}
+
+func TestWeights(t *testing.T) {
+	// system knows its download, the users of the second module don't
+	weights, total := percent.ResolveWeights([][]float64{{300}, {100, 0, 0}, nil})
+	if total != 800 || weights[1][1] != 200 || weights[1][2] != 200 {
+		t.Fatalf("Unexpected weights: %v %v", weights, total)
+	}
+	if _, total := percent.ResolveWeights([][]float64{{0}, {0, 0}}); total != 3 {
+		t.Fatalf("Expected equal weights without any estimate, got: %v", total)
+	}
+
+	tracker := percent.NewIncrementer(nil, 4)
+	tracker.TotalWeight = total
+	system := tracker.ForkWeighted(weights[0])
+	system.SectionPercent(50)
+	if overall := tracker.OverallPercent(); overall != 19 {
+		t.Fatalf("Expected half of the system to be 19%%, got: %v", overall)
+	}
+	system.IncrementSection(nil)
+
+	module := tracker.ForkWeighted(weights[1])
+	module.IncrementSection(nil)
+	user := module.Fork()
+	user.IncrementSection(nil)
+	if overall := tracker.OverallPercent(); overall != 75 {
+		t.Fatalf("Expected the system, the module and one user to be 75%%, got: %v", overall)
+	}
+	module.Fork().IncrementSection(nil)
+	if overall := tracker.OverallPercent(); overall != 100 {
+		t.Fatalf("Expected everything to be done, got: %v", overall)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jedib0t/go-pretty/v6/progress"
@@ -18,15 +19,33 @@ import (
 type Incrementer struct {
 	DoneIncrements int
 	MaxIncrements  int
-	// Controls the OSC progress escape code, as well as the actual cmdline progressbar
-	ProgressEnabled bool
-	ProgressWriter  progress.Writer
-	PTracker        StepTracker
+	// Shows the progress, nothing gets shown without one
+	Renderer Renderer
+	PTracker StepTracker
+	// Called on every status change of the root and its forks, set it before forking
+	OnStatus func(title string, description string)
+	// Sum of the weights of all steps, every step weighs 1 when it's unset
+	TotalWeight float64
+
+	// Forks share the step count of their root, everything is guarded by the mutex of the root
+	root  *Incrementer
+	forks []*Incrementer
+	m     sync.Mutex
+	// Weight of the section of this incrementer and of the ones forked from it, 0 weighs 1
+	weight     float64
+	forkWeight float64
+	doneWeight float64
 }
 
 type StepTracker struct {
 	Progress float64
-	Tracker  *progress.Tracker
+	// Last status reported for the section
+	Title       string
+	Description string
+	// Set once the section reports a percentage of its own, jumping to 100% when done doesn't count
+	Measured bool
+	// Progress bar of the fancy renderer
+	Tracker *progress.Tracker
 }
 
 var CuteColors = progress.StyleColors{
@@ -104,99 +123,156 @@ func NewProgressWriter() progress.Writer {
 }
 
 func (it *Incrementer) ReportStatusChange(title string, description string) {
-	if !it.ProgressEnabled {
-		slog.Info("Updating",
-			slog.String("title", title),
-			slog.String("description", description),
-			slog.Int("progress", it.CurrentStep()),
-			slog.Int("total", it.MaxIncrements),
-			slog.Float64("step_progress", it.PTracker.Progress),
-			slog.Float64("overall", it.OverallPercent()),
-		)
-		return
+	r := it.base()
+	if r.OnStatus != nil {
+		r.OnStatus(title, description)
 	}
-	// Only System (Bootc) updates have proper progress reporting
-	if title == "System" {
-		it.PTracker.Tracker.UpdateTotal(100)
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	it.PTracker.Title = title
+	it.PTracker.Description = description
+	if r.Renderer == nil {
+		return
 	}
-	percentage := it.OverallPercent()
+	r.Renderer.Update(&it.PTracker, Status{
+		Title:         title,
+		Description:   description,
+		Step:          r.DoneIncrements + 1,
+		Total:         r.MaxIncrements,
+		Percent:       it.PTracker.Progress,
+		Overall:       r.overallPercent(),
+		Indeterminate: !r.measured(),
+	})
+}
 
-	// OSC escape sequence to up the overall percentage
-	fmt.Printf("\033]9;4;1;%d\a", int(percentage))
+func NewIncrementer(renderer Renderer, max int) Incrementer {
+	// trackers get added once something is reported for a section
+	return Incrementer{
+		DoneIncrements: 0,
+		MaxIncrements:  max,
+		Renderer:       renderer,
+	}
+}
 
-	finalMessage := fmt.Sprintf("Updating %s (%s) Step: [%d/%d]", title, description, it.CurrentStep()+1, it.MaxIncrements+1)
+// Fork returns an Incrementer with its own step tracker that shares the step count of this one
+// Used for modules (and users) that get updated concurrently
+func (it *Incrementer) Fork() *Incrementer {
+	r := it.base()
+	r.m.Lock()
+	defer r.m.Unlock()
 
-	it.ProgressWriter.SetMessageLength(len(finalMessage))
-	it.PTracker.Tracker.UpdateMessage(finalMessage)
-	it.PTracker.Tracker.SetValue(int64(it.PTracker.Progress))
+	fork := &Incrementer{
+		MaxIncrements: r.MaxIncrements,
+		root:          r,
+		weight:        it.forkWeight,
+		forkWeight:    it.forkWeight,
+	}
+	r.forks = append(r.forks, fork)
+	return fork
 }
 
-func ResetOscProgress() {
-	// OSC escape sequence to reset all previous OSC progress hints to 0%.
-	// Documentation is on https://conemu.github.io/en/AnsiEscapeCodes.html#ConEmu_specific_OSC
-	print("\033]9;4;0\a")
-}
+// ForkWeighted forks a module with the weights of its steps: the first one is the section of the fork,
+// the others get shared equally by the forks of it (e.g. one per user)
+func (it *Incrementer) ForkWeighted(weights []float64) *Incrementer {
+	fork := it.Fork()
+	r := it.base()
+	r.m.Lock()
+	defer r.m.Unlock()
 
-func newTracker(progressEnabled bool) StepTracker {
-	var tracker progress.Tracker
-	if progressEnabled {
-		tracker = progress.Tracker{
-			Message: "Updating",
-			Units:   progress.UnitsDefault,
-			Total:   0,
-		}
+	if len(weights) > 0 {
+		fork.weight = weights[0]
+		fork.forkWeight = weights[0]
 	}
-	return StepTracker{
-		Progress: 0.0,
-		Tracker:  &tracker,
+	if len(weights) > 1 {
+		fork.forkWeight = 0
+		for _, weight := range weights[1:] {
+			fork.forkWeight += weight
+		}
+		fork.forkWeight /= float64(len(weights) - 1)
 	}
+	return fork
 }
 
-func NewIncrementer(progressEnabled bool, max int) Incrementer {
-	var pw progress.Writer
-	tracker := newTracker(progressEnabled)
-	if progressEnabled {
-		pw = NewProgressWriter()
-		pw.AppendTracker(tracker.Tracker)
+func (it *Incrementer) sectionWeight() float64 {
+	if it.weight <= 0 {
+		return 1
 	}
-	return Incrementer{
-		0,
-		max,
-		progressEnabled,
-		pw,
-		tracker,
+	return it.weight
+}
+
+func (it *Incrementer) base() *Incrementer {
+	if it.root != nil {
+		return it.root
 	}
+	return it
 }
 
 func (it *Incrementer) IncrementSection(err error) {
-	if it.ProgressEnabled {
-		if err != nil {
-			it.PTracker.Tracker.MarkAsErrored()
-		} else {
-			it.PTracker.Tracker.MarkAsDone()
-		}
+	r := it.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.Renderer != nil {
+		r.Renderer.Finish(&it.PTracker, err)
 	}
 
-	if int64(it.DoneIncrements) >= int64(it.MaxIncrements) {
+	if int64(r.DoneIncrements) >= int64(r.MaxIncrements) {
 		return
 	}
-	it.DoneIncrements += 1
+	r.DoneIncrements += 1
+	r.doneWeight += it.sectionWeight()
 
-	if it.ProgressEnabled {
-		it.PTracker = newTracker(it.ProgressEnabled)
-		it.ProgressWriter.AppendTracker(it.PTracker.Tracker)
-	}
+	// the next tracker gets added once something is reported for the new section
+	it.PTracker = StepTracker{}
 }
 
 func (it *Incrementer) OverallPercent() float64 {
-	steps := ((float64(it.CurrentStep()) + it.PTracker.Progress/100.0) / float64(it.MaxIncrements)) * 100.0
-	return math.Round(steps)
+	r := it.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.overallPercent()
+}
+
+// Callers need to hold the lock of the root incrementer
+func (it *Incrementer) overallPercent() float64 {
+	total := it.TotalWeight
+	if total <= 0 {
+		total = float64(it.MaxIncrements)
+	}
+	progress := it.doneWeight + it.sectionWeight()*it.PTracker.Progress/100.0
+	for _, fork := range it.forks {
+		progress += fork.sectionWeight() * fork.PTracker.Progress / 100.0
+	}
+	return math.Round(math.Min(progress/total*100.0, 100))
+}
+
+// Callers need to hold the lock of the root incrementer
+func (it *Incrementer) measured() bool {
+	if it.PTracker.Measured {
+		return true
+	}
+	for _, fork := range it.forks {
+		if fork.PTracker.Measured {
+			return true
+		}
+	}
+	return false
 }
 
 func (it *Incrementer) SectionPercent(percent float64) {
+	r := it.base()
+	r.m.Lock()
+	defer r.m.Unlock()
 	it.PTracker.Progress = percent
+	if percent > 0 && percent < 100 {
+		it.PTracker.Measured = true
+	}
 }
 
 func (it *Incrementer) CurrentStep() int {
-	return it.DoneIncrements
+	r := it.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.DoneIncrements
 }
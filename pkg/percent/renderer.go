@@ -0,0 +1,301 @@
+package percent
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+)
+
+const (
+	// Picks one of the others depending on the terminal and the log output
+	ModeAuto = "auto"
+	// go-pretty progress bars and the OSC progress of the terminal
+	ModeFancy = "fancy"
+	// One line per step, for screen readers and dumb terminals
+	ModePlain = "plain"
+	// Only the OSC progress of the terminal (tab or taskbar), the status gets logged
+	ModeOSC = "osc-only"
+	// No progress output, the status gets logged
+	ModeNone = "none"
+)
+
+// Status of a section of the run, passed to the renderer on every change
+type Status struct {
+	Title       string
+	Description string
+	// Current step, starting at 1
+	Step  int
+	Total int
+	// Progress of the section and of the whole run
+	Percent float64
+	Overall float64
+	// None of the running sections reports progress of its own, only finished steps move the run forward
+	Indeterminate bool
+}
+
+// Phase of the run while it's getting ready, before any module runs
+type Phase int
+
+const (
+	// Modules run, the progress follows their steps
+	PhaseRunning Phase = iota
+	// Checks run, there's no telling how long the run takes yet
+	PhaseChecking
+	// Waiting on the lock or on the hardware checks to pass
+	PhaseWaiting
+)
+
+// Renderer shows the progress of a run, every progress mode has its own.
+// Update and Finish get called with the lock of the root incrementer held.
+type Renderer interface {
+	Start()
+	// SetPhase shows what the run is busy with before Start, Start switches to PhaseRunning
+	SetPhase(phase Phase)
+	// Update shows the status of a section, the section stays the same until it's finished
+	Update(section *StepTracker, status Status)
+	// Finish marks the section as done, or as failed when there's an error
+	Finish(section *StepTracker, err error)
+	Stop()
+}
+
+func ValidateMode(mode string) error {
+	switch mode {
+	case ModeAuto, ModeFancy, ModePlain, ModeOSC, ModeNone:
+		return nil
+	}
+	return fmt.Errorf("invalid progress mode %q, expected one of %q, %q, %q, %q or %q", mode, ModeAuto, ModeFancy, ModePlain, ModeOSC, ModeNone)
+}
+
+// NewRenderer returns the renderer of the mode writing to w, auto needs to be resolved by the caller
+func NewRenderer(mode string, w io.Writer) (Renderer, error) {
+	switch mode {
+	case ModeFancy:
+		return NewFancyRenderer(w), nil
+	case ModePlain:
+		return &PlainRenderer{w: w}, nil
+	case ModeOSC:
+		return &OSCRenderer{osc: oscProgress{w: w}}, nil
+	case ModeNone:
+		return LogRenderer{}, nil
+	}
+	return nil, fmt.Errorf("invalid progress mode %q", mode)
+}
+
+// States of the OSC progress, see https://conemu.github.io/en/AnsiEscapeCodes.html#ConEmu_specific_OSC
+const (
+	oscNormal        = 1
+	oscError         = 2
+	oscIndeterminate = 3
+	oscPaused        = 4
+)
+
+// writeOsc sets the state and the progress shown by the terminal
+func writeOsc(w io.Writer, state int, percentage float64) {
+	fmt.Fprintf(w, "\033]9;4;%d;%d\a", state, int(percentage)) //nolint:errcheck
+}
+
+// resetOsc resets all previous OSC progress hints to 0%
+func resetOsc(w io.Writer) {
+	fmt.Fprint(w, "\033]9;4;0\a") //nolint:errcheck
+}
+
+// oscProgress keeps track of what the terminal shows, once a module fails the progress stays in the error state
+type oscProgress struct {
+	w             io.Writer
+	phase         Phase
+	failed        bool
+	indeterminate bool
+	percent       float64
+}
+
+func (o *oscProgress) setPhase(phase Phase) {
+	o.phase = phase
+	o.write()
+}
+
+func (o *oscProgress) update(status Status) {
+	o.percent = status.Overall
+	o.indeterminate = status.Indeterminate
+	o.write()
+}
+
+func (o *oscProgress) finish(err error) {
+	if err == nil {
+		return
+	}
+	o.failed = true
+	o.write()
+}
+
+func (o *oscProgress) write() {
+	switch {
+	case o.phase == PhaseWaiting:
+		writeOsc(o.w, oscPaused, o.percent)
+	case o.phase == PhaseChecking:
+		writeOsc(o.w, oscIndeterminate, 0)
+	case o.failed:
+		writeOsc(o.w, oscError, o.percent)
+	case o.indeterminate:
+		writeOsc(o.w, oscIndeterminate, 0)
+	default:
+		writeOsc(o.w, oscNormal, o.percent)
+	}
+}
+
+// LogRenderer logs every status change, for JSON logs and the journal
+type LogRenderer struct{}
+
+func (LogRenderer) Start() {}
+
+func (LogRenderer) SetPhase(phase Phase) {}
+
+func (LogRenderer) Update(section *StepTracker, status Status) {
+	slog.Info("Updating",
+		slog.String("title", status.Title),
+		slog.String("description", status.Description),
+		slog.Int("progress", status.Step-1),
+		slog.Int("total", status.Total),
+		slog.Float64("step_progress", status.Percent),
+		slog.Float64("overall", status.Overall),
+	)
+}
+
+func (LogRenderer) Finish(section *StepTracker, err error) {}
+
+func (LogRenderer) Stop() {}
+
+// OSCRenderer only sets the progress of the terminal, logging the status like LogRenderer
+type OSCRenderer struct {
+	osc oscProgress
+}
+
+func (r *OSCRenderer) Start() {
+	r.osc.phase = PhaseRunning
+	resetOsc(r.osc.w)
+}
+
+func (r *OSCRenderer) SetPhase(phase Phase) {
+	r.osc.setPhase(phase)
+}
+
+func (r *OSCRenderer) Update(section *StepTracker, status Status) {
+	r.osc.update(status)
+	LogRenderer{}.Update(section, status)
+}
+
+func (r *OSCRenderer) Finish(section *StepTracker, err error) {
+	r.osc.finish(err)
+}
+
+func (r *OSCRenderer) Stop() {
+	resetOsc(r.osc.w)
+}
+
+// PlainRenderer prints a line whenever a section starts, changes stage or finishes, without any escape codes
+type PlainRenderer struct {
+	w    io.Writer
+	last string
+}
+
+func (r *PlainRenderer) Start() {}
+
+func (r *PlainRenderer) SetPhase(phase Phase) {}
+
+func (r *PlainRenderer) Update(section *StepTracker, status Status) {
+	line := fmt.Sprintf("[%d/%d] Updating %s (%s)", min(status.Step, status.Total), status.Total, status.Title, status.Description)
+	// percentages come in far too often to print every one of them
+	if line == r.last {
+		return
+	}
+	r.last = line
+	fmt.Fprintf(r.w, "%s, %d%% done\n", line, int(status.Overall)) //nolint:errcheck
+}
+
+func (r *PlainRenderer) Finish(section *StepTracker, err error) {
+	if section.Title == "" {
+		return
+	}
+	r.last = ""
+	if err != nil {
+		fmt.Fprintf(r.w, "Failed updating %s (%s): %v\n", section.Title, section.Description, err) //nolint:errcheck
+		return
+	}
+	fmt.Fprintf(r.w, "Finished updating %s (%s)\n", section.Title, section.Description) //nolint:errcheck
+}
+
+func (r *PlainRenderer) Stop() {}
+
+// FancyRenderer draws a go-pretty progress bar per section and sets the progress of the terminal
+type FancyRenderer struct {
+	osc     oscProgress
+	Writer  progress.Writer
+	started bool
+}
+
+func NewFancyRenderer(w io.Writer) *FancyRenderer {
+	pw := NewProgressWriter()
+	pw.SetOutputWriter(w)
+	return &FancyRenderer{osc: oscProgress{w: w}, Writer: pw}
+}
+
+func (r *FancyRenderer) Start() {
+	r.osc.phase = PhaseRunning
+	resetOsc(r.osc.w)
+	r.started = true
+	go r.Writer.Render()
+}
+
+func (r *FancyRenderer) SetPhase(phase Phase) {
+	r.osc.setPhase(phase)
+}
+
+func (r *FancyRenderer) Update(section *StepTracker, status Status) {
+	if section.Tracker == nil {
+		section.Tracker = &progress.Tracker{Message: "Updating", Units: progress.UnitsDefault}
+		r.Writer.AppendTracker(section.Tracker)
+	}
+	// Only System (Bootc) updates have proper progress reporting
+	if status.Title == "System" {
+		section.Tracker.UpdateTotal(100)
+	}
+
+	// OSC escape sequence to up the overall percentage
+	r.osc.update(status)
+
+	finalMessage := fmt.Sprintf("Updating %s (%s) Step: [%d/%d]", status.Title, status.Description, status.Step, status.Total+1)
+
+	r.Writer.SetMessageLength(len(finalMessage))
+	section.Tracker.UpdateMessage(finalMessage)
+	section.Tracker.SetValue(int64(section.Progress))
+}
+
+func (r *FancyRenderer) Finish(section *StepTracker, err error) {
+	r.osc.finish(err)
+	if section.Tracker == nil {
+		return
+	}
+	if err != nil {
+		section.Tracker.MarkAsErrored()
+	} else {
+		section.Tracker.MarkAsDone()
+	}
+}
+
+// Log prints the line above the progress bars
+func (r *FancyRenderer) Log(line string) {
+	r.Writer.Log("%s", line)
+}
+
+// Stop can get called more than once, and before Start when the run ends early
+func (r *FancyRenderer) Stop() {
+	if r.started {
+		r.Writer.Stop()
+		// give the last render the time to finish
+		time.Sleep(time.Millisecond * 100)
+		r.started = false
+	}
+	resetOsc(r.osc.w)
+}
@@ -0,0 +1,33 @@
+package percent
+
+// ResolveWeights fills in the unknown (0) step weights of every module with the average of the known ones,
+// every step weighs the same when none are known. It returns the weights along with their sum.
+func ResolveWeights(modules [][]float64) ([][]float64, float64) {
+	known, count := 0.0, 0
+	for _, weights := range modules {
+		for _, weight := range weights {
+			if weight > 0 {
+				known += weight
+				count++
+			}
+		}
+	}
+	fallback := 1.0
+	if count > 0 {
+		fallback = known / float64(count)
+	}
+
+	resolved := make([][]float64, len(modules))
+	total := 0.0
+	for i, weights := range modules {
+		resolved[i] = make([]float64, len(weights))
+		for j, weight := range weights {
+			if weight <= 0 {
+				weight = fallback
+			}
+			resolved[i][j] = weight
+			total += weight
+		}
+	}
+	return resolved, total
+}
@@ -0,0 +1,209 @@
+package resources
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ublue-os/uupd/pkg/config"
+)
+
+const (
+	systemdRunBinary = "/usr/bin/systemd-run"
+	systemctlBinary  = "/usr/bin/systemctl"
+	niceBinary       = "/usr/bin/nice"
+	ioniceBinary     = "/usr/bin/ionice"
+	nftBinary        = "/usr/sbin/nft"
+	nftTable         = "uupd"
+)
+
+var ioClasses = []string{"idle", "best-effort", "realtime"}
+
+// Limits describes how the commands of a module are throttled
+// Commands run inside a transient systemd scope in Slice, so cgroup limits (and the network limit) apply to them and their children
+type Limits struct {
+	Enabled             bool
+	Module              string
+	Slice               string
+	Nice                int
+	IOClass             string
+	CpuWeight           int
+	IoWeight            int
+	IoReadBandwidthMax  []string
+	IoWriteBandwidthMax []string
+}
+
+// NewLimits merges the global limits with the per-module overrides
+func NewLimits(module string, moduleLimits config.ModuleLimits) Limits {
+	global := config.Get().Limits
+	limits := Limits{
+		Enabled:             global.Enable,
+		Module:              module,
+		Slice:               global.Slice,
+		Nice:                global.Nice,
+		IOClass:             global.IOClass,
+		CpuWeight:           global.CpuWeight,
+		IoWeight:            global.IoWeight,
+		IoReadBandwidthMax:  global.IoReadBandwidthMax,
+		IoWriteBandwidthMax: global.IoWriteBandwidthMax,
+	}
+	if moduleLimits.Nice != nil {
+		limits.Nice = *moduleLimits.Nice
+	}
+	if moduleLimits.IOClass != nil {
+		limits.IOClass = *moduleLimits.IOClass
+	}
+	if moduleLimits.CpuWeight != nil {
+		limits.CpuWeight = *moduleLimits.CpuWeight
+	}
+	if moduleLimits.IoWeight != nil {
+		limits.IoWeight = *moduleLimits.IoWeight
+	}
+	return limits
+}
+
+func (l Limits) Validate() error {
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("nice level out of range (-20 to 19): %d", l.Nice)
+	}
+	if l.IOClass != "" && !slices.Contains(ioClasses, l.IOClass) {
+		return fmt.Errorf("unknown io class: %s, expected one of: %s", l.IOClass, strings.Join(ioClasses, ", "))
+	}
+	if l.CpuWeight != 0 && (l.CpuWeight < 1 || l.CpuWeight > 10000) {
+		return fmt.Errorf("cpu weight out of range (1 to 10000): %d", l.CpuWeight)
+	}
+	if l.IoWeight != 0 && (l.IoWeight < 1 || l.IoWeight > 10000) {
+		return fmt.Errorf("io weight out of range (1 to 10000): %d", l.IoWeight)
+	}
+	if l.Enabled && !strings.HasSuffix(l.Slice, ".slice") {
+		return fmt.Errorf("invalid slice name: %s", l.Slice)
+	}
+	return nil
+}
+
+// Wrap prefixes the command line so it runs with the configured limits
+// Returns the command line untouched if limits aren't enabled
+func (l Limits) Wrap(cli []string) []string {
+	if !l.Enabled {
+		return cli
+	}
+
+	wrapped := []string{
+		systemdRunBinary,
+		"--scope",
+		"--quiet",
+		"--collect",
+		"--slice=" + l.Slice,
+		"--description=uupd " + l.Module + " update",
+	}
+	for _, property := range l.properties() {
+		wrapped = append(wrapped, "--property="+property)
+	}
+	wrapped = append(wrapped, "--")
+
+	if l.Nice != 0 {
+		wrapped = append(wrapped, niceBinary, "-n", strconv.Itoa(l.Nice))
+	}
+	if l.IOClass != "" {
+		wrapped = append(wrapped, ioniceBinary, "-c", l.IOClass)
+	}
+	return append(wrapped, cli...)
+}
+
+// Command works like exec.Command, with the limits applied
+func (l Limits) Command(cli []string) *exec.Cmd {
+	wrapped := l.Wrap(cli)
+	return exec.Command(wrapped[0], wrapped[1:]...)
+}
+
+// LimitService applies the cgroup limits to a system service, for commands that only ask a daemon outside of the slice to do the work
+// Nice, the io class and the network limit can't be changed at runtime, so they don't apply. Returns a function that resets the properties again
+func (l Limits) LimitService(service string) (func(), error) {
+	properties := l.properties()
+	if !l.Enabled || len(properties) == 0 {
+		return func() {}, nil
+	}
+	args := append([]string{"set-property", "--runtime", service}, properties...)
+	if out, err := exec.Command(systemctlBinary, args...).CombinedOutput(); err != nil {
+		return func() {}, fmt.Errorf("failed to limit %s: %v: %s", service, err, strings.TrimSpace(string(out)))
+	}
+
+	return func() {
+		// an empty assignment resets a property to its default
+		args := []string{"set-property", "--runtime", service}
+		for _, property := range properties {
+			name, _, _ := strings.Cut(property, "=")
+			args = append(args, name+"=")
+		}
+		if out, err := exec.Command(systemctlBinary, args...).CombinedOutput(); err != nil {
+			slog.Warn("Failed resetting service limits", slog.String("service", service), slog.Any("error", err), slog.String("output", string(out)))
+		}
+	}, nil
+}
+
+func (l Limits) properties() []string {
+	var properties []string
+	if l.CpuWeight != 0 {
+		properties = append(properties, fmt.Sprintf("CPUWeight=%d", l.CpuWeight))
+	}
+	if l.IoWeight != 0 {
+		properties = append(properties, fmt.Sprintf("IOWeight=%d", l.IoWeight))
+	}
+	for _, limit := range l.IoReadBandwidthMax {
+		properties = append(properties, "IOReadBandwidthMax="+limit)
+	}
+	for _, limit := range l.IoWriteBandwidthMax {
+		properties = append(properties, "IOWriteBandwidthMax="+limit)
+	}
+	return properties
+}
+
+// SliceCgroupPath returns the cgroup v2 path of a slice and its level in the hierarchy
+// e.g: "system-uupd.slice" -> "system.slice/system-uupd.slice", 2
+func SliceCgroupPath(slice string) (string, int) {
+	name := strings.TrimSuffix(slice, ".slice")
+	parts := strings.Split(name, "-")
+	var path []string
+	for i := range parts {
+		path = append(path, strings.Join(parts[:i+1], "-")+".slice")
+	}
+	return strings.Join(path, "/"), len(path)
+}
+
+// NetworkRuleset returns the nftables ruleset that polices incoming traffic of every socket in the slice
+func NetworkRuleset(slice string, maxBytes uint64) string {
+	path, level := SliceCgroupPath(slice)
+	return fmt.Sprintf(`table inet %s {
+	chain input {
+		type filter hook input priority filter; policy accept;
+		socket cgroupv2 level %d "%s" limit rate over %d bytes/second drop
+	}
+}
+`, nftTable, level, path, maxBytes)
+}
+
+// LimitNetwork throttles downloads made from inside the slice by dropping packets above the configured rate, making TCP back off
+// The slice needs to exist before the rule gets loaded, so it gets started here. Returns a function that removes the limit again
+func LimitNetwork(slice string, maxBytes uint64) (func(), error) {
+	if out, err := exec.Command(systemctlBinary, "start", slice).CombinedOutput(); err != nil {
+		return func() {}, fmt.Errorf("failed to start slice %s: %v: %s", slice, err, strings.TrimSpace(string(out)))
+	}
+
+	// Start from a clean table in case a previous run didn't clean up after itself
+	_ = exec.Command(nftBinary, "delete", "table", "inet", nftTable).Run()
+
+	cmd := exec.Command(nftBinary, "-f", "-")
+	cmd.Stdin = strings.NewReader(NetworkRuleset(slice, maxBytes))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return func() {}, fmt.Errorf("failed to load network limit: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return func() {
+		if out, err := exec.Command(nftBinary, "delete", "table", "inet", nftTable).CombinedOutput(); err != nil {
+			slog.Warn("Failed removing network limit", slog.Any("error", err), slog.String("output", string(out)))
+		}
+	}, nil
+}
@@ -0,0 +1,136 @@
+package resources_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ublue-os/uupd/pkg/config"
+	"github.com/ublue-os/uupd/pkg/resources"
+)
+
+func TestWrapDisabled(t *testing.T) {
+	cli := []string{"/usr/bin/flatpak", "update", "-y"}
+	limits := resources.Limits{Enabled: false, Nice: 10}
+
+	if wrapped := limits.Wrap(cli); !slices.Equal(wrapped, cli) {
+		t.Fatalf("Command was wrapped with limits disabled: %v", wrapped)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	cli := []string{"/usr/bin/flatpak", "update", "-y"}
+	limits := resources.Limits{
+		Enabled:            true,
+		Module:             "flatpak",
+		Slice:              "uupd.slice",
+		Nice:               10,
+		IOClass:            "idle",
+		CpuWeight:          20,
+		IoReadBandwidthMax: []string{"/dev/sda 10M"},
+	}
+
+	wrapped := limits.Wrap(cli)
+	if !slices.Equal(wrapped[len(wrapped)-len(cli):], cli) {
+		t.Fatalf("Wrapped command doesn't end with the original command: %v", wrapped)
+	}
+	for _, arg := range []string{"--scope", "--slice=uupd.slice", "--property=CPUWeight=20", "--property=IOReadBandwidthMax=/dev/sda 10M", "-n", "10", "-c", "idle"} {
+		if !slices.Contains(wrapped, arg) {
+			t.Fatalf("Wrapped command is missing %q: %v", arg, wrapped)
+		}
+	}
+	if slices.ContainsFunc(wrapped, func(arg string) bool { return strings.HasPrefix(arg, "--property=IOWeight") }) {
+		t.Fatalf("Unset IOWeight was added: %v", wrapped)
+	}
+}
+
+func TestSliceCgroupPath(t *testing.T) {
+	testCases := []struct {
+		Slice string
+		Path  string
+		Level int
+	}{
+		{"uupd.slice", "uupd.slice", 1},
+		{"system-uupd.slice", "system.slice/system-uupd.slice", 2},
+		{"a-b-c.slice", "a.slice/a-b.slice/a-b-c.slice", 3},
+	}
+	for _, testCase := range testCases {
+		path, level := resources.SliceCgroupPath(testCase.Slice)
+		if path != testCase.Path || level != testCase.Level {
+			t.Fatalf("Wrong cgroup path for %s. Expected: %s (%d), Got: %s (%d)", testCase.Slice, testCase.Path, testCase.Level, path, level)
+		}
+	}
+
+	ruleset := resources.NetworkRuleset("system-uupd.slice", 1000)
+	if !strings.Contains(ruleset, `socket cgroupv2 level 2 "system.slice/system-uupd.slice" limit rate over 1000 bytes/second drop`) {
+		t.Fatalf("Unexpected ruleset: %s", ruleset)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []resources.Limits{
+		{Nice: 42},
+		{IOClass: "turbo"},
+		{CpuWeight: 100000},
+		{Enabled: true, Slice: "uupd.service"},
+	}
+	for _, limits := range invalid {
+		if err := limits.Validate(); err == nil {
+			t.Fatalf("Invalid limits went through: %+v", limits)
+		}
+	}
+
+	valid := resources.Limits{Enabled: true, Slice: "uupd.slice", Nice: 19, IOClass: "best-effort", IoWeight: 10}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Valid limits were rejected: %v", err)
+	}
+}
+
+func TestModuleOverrides(t *testing.T) {
+	newConfig := `{
+			"limits": {
+				"enable": true,
+				"nice": 10,
+				"io-class": "idle"
+			},
+			"modules": {
+				"system": {
+					"limits": {
+						"nice": 5
+					}
+				},
+				"flatpak": {
+					"limits": {
+						"nice": 0,
+						"io-class": ""
+					}
+				}
+			}
+		}
+	`
+
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "config.json")
+	if err := os.WriteFile(path, []byte(newConfig), 0644); err != nil {
+		t.Fatalf("unable to write file: %s, %v", path, err)
+	}
+	if err := config.InitConfig(path); err != nil {
+		t.Fatalf("unable to init config: %v", err)
+	}
+
+	limits := resources.NewLimits("system", config.Get().Modules.System.Limits)
+	if !limits.Enabled || limits.Nice != 5 || limits.IOClass != "idle" || limits.Slice != "uupd.slice" {
+		t.Fatalf("Module limits were not merged with the global ones: %+v", limits)
+	}
+	// zero values are overrides too
+	limits = resources.NewLimits("flatpak", config.Get().Modules.Flatpak.Limits)
+	if limits.Nice != 0 || limits.IOClass != "" {
+		t.Fatalf("Module limits did not reset the global ones: %+v", limits)
+	}
+	limits = resources.NewLimits("brew", config.Get().Modules.Brew.Limits)
+	if limits.Nice != 10 || limits.IOClass != "idle" {
+		t.Fatalf("Unset module limits did not inherit the global ones: %+v", limits)
+	}
+}
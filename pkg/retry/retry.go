@@ -0,0 +1,157 @@
+package retry
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/config"
+)
+
+// Class is the kind of failure a command ran into, used to decide whether it's worth retrying
+type Class string
+
+const (
+	ClassNetwork Class = "network"
+	ClassLock    Class = "lock"
+	ClassOther   Class = "other"
+	// Only valid in a policy, matches every class
+	ClassAny Class = "any"
+)
+
+// Substrings (lowercase) found in the output of bootc, rpm-ostree, flatpak, brew and distrobox when they hit transient errors
+var networkPatterns = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"name or service not known",
+	"connection refused",
+	"connection reset",
+	"connection timed out",
+	"network is unreachable",
+	"no route to host",
+	"tls handshake",
+	"i/o timeout",
+	"timeout was reached",
+	"unexpected eof",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"too many requests",
+	"failed to connect",
+}
+
+var lockPatterns = []string{
+	"transaction in progress",
+	"another transaction",
+	"is locked",
+	"could not acquire lock",
+	"waiting for lock",
+}
+
+type Policy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	RetryOn    []Class
+}
+
+// ValidateRetryOn checks the classes of a retry policy
+func ValidateRetryOn(classes []string) error {
+	for _, class := range classes {
+		if !slices.Contains([]Class{ClassNetwork, ClassLock, ClassOther, ClassAny}, Class(strings.ToLower(class))) {
+			return fmt.Errorf("invalid retry-on: %q, expected %s, %s, %s or %s", class, ClassNetwork, ClassLock, ClassOther, ClassAny)
+		}
+	}
+	return nil
+}
+
+func NewPolicy(conf config.Retry) Policy {
+	policy := Policy{
+		Attempts:   conf.Attempts,
+		Backoff:    conf.Backoff,
+		MaxBackoff: conf.MaxBackoff,
+	}
+	for _, class := range conf.RetryOn {
+		policy.RetryOn = append(policy.RetryOn, Class(strings.ToLower(class)))
+	}
+	return policy
+}
+
+// Classify guesses the failure class from the output and error of a command
+func Classify(out []byte, err error) Class {
+	text := bytes.ToLower(out)
+	if err != nil {
+		text = append(text, []byte(strings.ToLower(err.Error()))...)
+	}
+	for _, pattern := range lockPatterns {
+		if bytes.Contains(text, []byte(pattern)) {
+			return ClassLock
+		}
+	}
+	for _, pattern := range networkPatterns {
+		if bytes.Contains(text, []byte(pattern)) {
+			return ClassNetwork
+		}
+	}
+	return ClassOther
+}
+
+func (p Policy) Retryable(class Class) bool {
+	for _, allowed := range p.RetryOn {
+		if allowed == ClassAny || allowed == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before the given attempt (starting at 1 for the first retry), doubling every time
+func (p Policy) Delay(attempt int) time.Duration {
+	if attempt < 1 || p.Backoff <= 0 {
+		return 0
+	}
+	delay := p.Backoff
+	for range attempt - 1 {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return delay
+}
+
+// Run calls fn until it succeeds, the failure isn't retryable or the attempts run out
+// Works like session.RunLog, returning the output and error of the last attempt
+func Run(logger *slog.Logger, p Policy, fn func() ([]byte, error)) ([]byte, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attempts := max(p.Attempts, 1)
+
+	var out []byte
+	var err error
+	for attempt := range attempts {
+		if attempt > 0 {
+			delay := p.Delay(attempt)
+			logger.Info("Retrying after transient failure", slog.Int("attempt", attempt+1), slog.Int("max_attempts", attempts), slog.Duration("backoff", delay))
+			time.Sleep(delay)
+		}
+		out, err = fn()
+		if err == nil {
+			return out, nil
+		}
+		class := Classify(out, err)
+		if !p.Retryable(class) {
+			logger.Debug("Failure is not retryable", slog.String("class", string(class)), slog.Any("error", err))
+			return out, err
+		}
+		logger.Warn("Transient failure", slog.String("class", string(class)), slog.Int("attempt", attempt+1), slog.Any("error", err))
+	}
+	return out, fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
@@ -0,0 +1,100 @@
+package retry_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	appLogging "github.com/ublue-os/uupd/pkg/logging"
+	"github.com/ublue-os/uupd/pkg/retry"
+)
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		Output   string
+		Err      error
+		Expected retry.Class
+	}{
+		{"error: Could not resolve host: ghcr.io", errors.New("exit status 1"), retry.ClassNetwork},
+		{"", errors.New("dial tcp: i/o timeout"), retry.ClassNetwork},
+		{"error: Transaction in progress: upgrade", errors.New("exit status 1"), retry.ClassLock},
+		{"error: No such remote 'flathub'", errors.New("exit status 1"), retry.ClassOther},
+	}
+
+	for _, testCase := range testCases {
+		if class := retry.Classify([]byte(testCase.Output), testCase.Err); class != testCase.Expected {
+			t.Fatalf("Wrong class for %q. Expected: %s, Got: %s", testCase.Output, testCase.Expected, class)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := retry.Policy{Attempts: 5, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for attempt, delay := range expected {
+		if got := policy.Delay(attempt); got != delay {
+			t.Fatalf("Wrong delay for attempt %d. Expected: %v, Got: %v", attempt, delay, got)
+		}
+	}
+}
+
+func TestRetriesTransientFailures(t *testing.T) {
+	policy := retry.Policy{Attempts: 3, RetryOn: []retry.Class{retry.ClassNetwork}}
+
+	calls := 0
+	_, err := retry.Run(appLogging.NewMuteLogger(), policy, func() ([]byte, error) {
+		calls++
+		if calls < 3 {
+			return []byte("Connection reset by peer"), errors.New("exit status 1")
+		}
+		return []byte{}, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected success after retrying, got: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("Wrong number of attempts. Expected: %d, Got: %d", 3, calls)
+	}
+}
+
+func TestGivesUp(t *testing.T) {
+	policy := retry.Policy{Attempts: 2, RetryOn: []retry.Class{retry.ClassAny}}
+
+	calls := 0
+	_, err := retry.Run(appLogging.NewMuteLogger(), policy, func() ([]byte, error) {
+		calls++
+		return []byte{}, errors.New("exit status 1")
+	})
+	if err == nil {
+		t.Fatalf("Expected failure after running out of attempts")
+	}
+	if calls != 2 {
+		t.Fatalf("Wrong number of attempts. Expected: %d, Got: %d", 2, calls)
+	}
+}
+
+func TestNoRetryOnPermanentFailure(t *testing.T) {
+	policy := retry.Policy{Attempts: 3, RetryOn: []retry.Class{retry.ClassNetwork}}
+
+	calls := 0
+	_, err := retry.Run(appLogging.NewMuteLogger(), policy, func() ([]byte, error) {
+		calls++
+		return []byte("error: Nothing matches"), errors.New("exit status 1")
+	})
+	if err == nil {
+		t.Fatalf("Expected failure to be returned")
+	}
+	if calls != 1 {
+		t.Fatalf("Permanent failure was retried %d times", calls-1)
+	}
+}
+
+func TestValidateRetryOn(t *testing.T) {
+	if err := retry.ValidateRetryOn([]string{"network", "Lock", "other", "any"}); err != nil {
+		t.Fatalf("Valid classes were rejected: %v", err)
+	}
+	if err := retry.ValidateRetryOn([]string{"network", "netwrok"}); err == nil {
+		t.Fatalf("Invalid class went through")
+	}
+}
@@ -0,0 +1,213 @@
+package runlog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	idFormat  = "20060102-150405"
+	extension = ".log"
+	// Status line of the header of every entry
+	statusFailed = "Status: failed"
+)
+
+// Store keeps the full output of every module of the last runs, one directory per run and one file per module and user
+type Store struct {
+	Dir string
+	// Amount of runs kept, 0 keeps all of them
+	Keep int
+	// Runs older than this get removed, 0 keeps them regardless of age
+	MaxAge time.Duration
+}
+
+// Entry is the output of one command of a module
+type Entry struct {
+	Context string
+	Cli     []string
+	Failure bool
+	Error   error
+	Output  string
+}
+
+// Log is a module log file of a run
+type Log struct {
+	Name   string
+	Path   string
+	Failed bool
+}
+
+// NewRunID names runs after the time they started, so they sort chronologically
+func NewRunID(started time.Time) string {
+	return started.Format(idFormat)
+}
+
+func validID(id string) bool {
+	_, err := time.Parse(idFormat, id)
+	return err == nil
+}
+
+// LogName is the file name of the log of a module, multi-user modules get one per user
+func LogName(module string, user string) string {
+	name := module
+	if user != "" {
+		name += "-" + user
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Write appends the entries to the log of the module in the run
+func (s Store) Write(id string, module string, user string, entries ...Entry) error {
+	dir := filepath.Join(s.Dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, LogName(module, user)+extension), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, entry := range entries {
+		status := "Status: ok"
+		if entry.Failure {
+			status = statusFailed
+		}
+		fmt.Fprintf(w, "=== %s ===\nCommand: %s\n%s\n", entry.Context, strings.Join(entry.Cli, " "), status) //nolint:errcheck
+		if entry.Error != nil {
+			fmt.Fprintf(w, "Error: %v\n", entry.Error) //nolint:errcheck
+		}
+		w.WriteString("\n" + entry.Output) //nolint:errcheck
+		if entry.Output != "" && !strings.HasSuffix(entry.Output, "\n") {
+			w.WriteString("\n") //nolint:errcheck
+		}
+		w.WriteString("\n") //nolint:errcheck
+	}
+	if err := w.Flush(); err != nil {
+		file.Close() //nolint:errcheck
+		return err
+	}
+	return file.Close()
+}
+
+// Runs lists the ids of the kept runs, newest first
+func (s Store) Runs() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []string
+	for _, entry := range entries {
+		if entry.IsDir() && validID(entry.Name()) {
+			runs = append(runs, entry.Name())
+		}
+	}
+	slices.Sort(runs)
+	slices.Reverse(runs)
+	return runs, nil
+}
+
+// Resolve turns "latest" into the id of the newest run and checks the run exists
+func (s Store) Resolve(id string) (string, error) {
+	runs, err := s.Runs()
+	if err != nil {
+		return "", err
+	}
+	if id == "latest" {
+		if len(runs) == 0 {
+			return "", fmt.Errorf("no runs logged in %s", s.Dir)
+		}
+		return runs[0], nil
+	}
+	if !slices.Contains(runs, id) {
+		return "", fmt.Errorf("no run %q logged in %s", id, s.Dir)
+	}
+	return id, nil
+}
+
+// Logs lists the module logs of a run
+func (s Store) Logs(id string) ([]Log, error) {
+	dir := filepath.Join(s.Dir, id)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var logs []Log
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), extension)
+		if entry.IsDir() || !found {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		failed, err := hasFailure(path)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, Log{Name: name, Path: path, Failed: failed})
+	}
+	return logs, nil
+}
+
+// Find returns the logs of a module in a run, for multi-user modules the ones of every user unless one is named
+func (s Store) Find(id string, module string) ([]Log, error) {
+	logs, err := s.Logs(id)
+	if err != nil {
+		return nil, err
+	}
+	var found []Log
+	for _, log := range logs {
+		if log.Name == module {
+			return []Log{log}, nil
+		}
+		if strings.HasPrefix(log.Name, module+"-") {
+			found = append(found, log)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no log of %q in run %s", module, id)
+	}
+	return found, nil
+}
+
+func hasFailure(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains("\n"+string(data), "\n"+statusFailed+"\n"), nil
+}
+
+// Prune removes the runs beyond the retention limits, returning how many got removed
+func (s Store) Prune(now time.Time) (int, error) {
+	runs, err := s.Runs()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i, id := range runs {
+		started, _ := time.ParseInLocation(idFormat, id, now.Location())
+		tooMany := s.Keep > 0 && i >= s.Keep
+		tooOld := s.MaxAge > 0 && now.Sub(started) > s.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.Dir, id)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,82 @@
+package runlog_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/runlog"
+)
+
+func TestStore(t *testing.T) {
+	store := runlog.Store{Dir: t.TempDir(), Keep: 2, MaxAge: 48 * time.Hour}
+	now := time.Date(2024, 3, 10, 4, 0, 0, 0, time.Local)
+
+	if runs, err := store.Runs(); err != nil || len(runs) != 0 {
+		t.Fatalf("Expected no runs, got: %v %v", runs, err)
+	}
+
+	var ids []string
+	for i := range 3 {
+		id := runlog.NewRunID(now.Add(time.Duration(i-2) * time.Hour))
+		ids = append(ids, id)
+		entries := []runlog.Entry{
+			{Context: "System Apps", Cli: []string{"flatpak", "update"}, Output: "Nothing to do."},
+		}
+		if err := store.Write(id, "flatpak", "", entries...); err != nil {
+			t.Fatalf("unable to write log: %v", err)
+		}
+		failed := runlog.Entry{Context: "Distroboxes for User: alice", Cli: []string{"distrobox", "upgrade", "-a"}, Failure: true, Error: errors.New("exit status 1"), Output: "line one\nline two\n"}
+		if err := store.Write(id, "distrobox", "alice", failed); err != nil {
+			t.Fatalf("unable to write log: %v", err)
+		}
+		if err := store.Write(id, "distrobox", "bob", runlog.Entry{Context: "Distroboxes for User: bob"}); err != nil {
+			t.Fatalf("unable to write log: %v", err)
+		}
+	}
+
+	latest, err := store.Resolve("latest")
+	if err != nil || latest != ids[2] {
+		t.Fatalf("Expected the latest run to be %s, got: %s %v", ids[2], latest, err)
+	}
+	if _, err := store.Resolve("20000101-000000"); err == nil {
+		t.Fatalf("Expected an unknown run to fail")
+	}
+
+	logs, err := store.Find(latest, "distrobox")
+	if err != nil {
+		t.Fatalf("unable to find logs: %v", err)
+	}
+	if len(logs) != 2 || logs[0].Name != "distrobox-alice" || !logs[0].Failed || logs[1].Failed {
+		t.Fatalf("Unexpected distrobox logs: %+v", logs)
+	}
+	data, err := os.ReadFile(logs[0].Path)
+	if err != nil {
+		t.Fatalf("unable to read log: %v", err)
+	}
+	for _, expected := range []string{"=== Distroboxes for User: alice ===\n", "Command: distrobox upgrade -a\n", "Error: exit status 1\n", "\nline one\nline two\n"} {
+		if !strings.Contains(string(data), expected) {
+			t.Fatalf("Expected the log to contain %q, got:\n%s", expected, data)
+		}
+	}
+	if logs, err := store.Find(latest, "distrobox-bob"); err != nil || len(logs) != 1 {
+		t.Fatalf("Expected the log of one user, got: %+v %v", logs, err)
+	}
+	if _, err := store.Find(latest, "brew"); err == nil {
+		t.Fatalf("Expected a module without logs to fail")
+	}
+
+	removed, err := store.Prune(now)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected the oldest run to be removed, got: %d %v", removed, err)
+	}
+	removed, err = store.Prune(now.Add(47*time.Hour + 30*time.Minute))
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected the expired run to be removed, got: %d %v", removed, err)
+	}
+	if runs, _ := store.Runs(); len(runs) != 1 || runs[0] != ids[2] {
+		t.Fatalf("Unexpected runs left: %v", runs)
+	}
+}
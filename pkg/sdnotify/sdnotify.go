@@ -0,0 +1,157 @@
+package sdnotify
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notify sends the state to the service manager, it does nothing unless systemd set NOTIFY_SOCKET.
+// See sd_notify(3) for the states.
+func Notify(states ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract sockets start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+func Ready() error {
+	return Notify("READY=1")
+}
+
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// WatchdogInterval returns the WatchdogSec= of the service, 0 if it isn't set or meant for another process
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Heartbeat keeps the watchdog and the timeouts of the service happy while the run makes progress.
+// Once nothing got reported for the stall timeout the pings stop, so systemd stops a wedged run.
+type Heartbeat struct {
+	m            sync.Mutex
+	last         time.Time
+	stalled      bool
+	waiting      int
+	stallTimeout time.Duration
+	interval     time.Duration
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// StartHeartbeat pings every half watchdog interval, or every 30s without a watchdog to extend the timeouts
+func StartHeartbeat(stallTimeout time.Duration) *Heartbeat {
+	h := &Heartbeat{last: time.Now(), stallTimeout: stallTimeout, interval: WatchdogInterval() / 2, stop: make(chan struct{}), done: make(chan struct{})}
+	if h.interval <= 0 {
+		h.interval = 30 * time.Second
+	}
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		close(h.done)
+		return h
+	}
+	go h.loop()
+	return h
+}
+
+func (h *Heartbeat) loop() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.beat()
+		}
+	}
+}
+
+func (h *Heartbeat) beat() {
+	h.m.Lock()
+	idle := time.Since(h.last)
+	stalled := h.stallTimeout > 0 && idle > h.stallTimeout && h.waiting == 0
+	warn := stalled && !h.stalled
+	h.stalled = stalled
+	h.m.Unlock()
+
+	if warn {
+		slog.Warn("No progress reported, no longer pinging the systemd watchdog", slog.Duration("idle", idle))
+	}
+	if stalled {
+		return
+	}
+	extend := fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", (2 * h.interval).Microseconds())
+	if err := Notify("WATCHDOG=1", extend); err != nil {
+		slog.Debug("Failed notifying systemd", slog.Any("error", err))
+	}
+}
+
+// Touch records progress
+func (h *Heartbeat) Touch() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.last = time.Now()
+	h.stalled = false
+}
+
+// Status records progress and shows it in systemctl status
+func (h *Heartbeat) Status(status string) {
+	h.Touch()
+	if err := Status(status); err != nil {
+		slog.Debug("Failed notifying systemd", slog.Any("error", err))
+	}
+}
+
+// Wait shows the status and keeps pinging until done gets called, for waits that report no progress on purpose
+func (h *Heartbeat) Wait(status string) (done func()) {
+	h.Status(status)
+	h.m.Lock()
+	h.waiting++
+	h.m.Unlock()
+	return func() {
+		h.m.Lock()
+		h.waiting--
+		h.m.Unlock()
+		h.Touch()
+	}
+}
+
+// ModuleStatus is Status for the status changes of the progress tracker
+func (h *Heartbeat) ModuleStatus(title string, description string) {
+	h.Status(fmt.Sprintf("Updating %s (%s)", title, description))
+}
+
+func (h *Heartbeat) Stop() {
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	<-h.done
+}
@@ -0,0 +1,109 @@
+package sdnotify_test
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ublue-os/uupd/pkg/sdnotify"
+)
+
+// listen pretends to be systemd, returning every datagram sent to NOTIFY_SOCKET
+func listen(t *testing.T) chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	messages := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	return messages
+}
+
+func receive(t *testing.T, messages chan string) string {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Nothing sent to the notify socket")
+	}
+	return ""
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdnotify.Ready(); err != nil {
+		t.Fatalf("Expected notifying without systemd to do nothing, got: %v", err)
+	}
+
+	messages := listen(t)
+	if err := sdnotify.Ready(); err != nil {
+		t.Fatalf("unable to notify: %v", err)
+	}
+	if message := receive(t, messages); message != "READY=1" {
+		t.Fatalf("Unexpected message: %q", message)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := sdnotify.WatchdogInterval(); interval != 0 {
+		t.Fatalf("Expected the watchdog of another process to be ignored, got: %v", interval)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	if interval := sdnotify.WatchdogInterval(); interval != 100*time.Millisecond {
+		t.Fatalf("Unexpected watchdog interval: %v", interval)
+	}
+
+	heartbeat := sdnotify.StartHeartbeat(300 * time.Millisecond)
+	defer heartbeat.Stop()
+	heartbeat.ModuleStatus("Flatpak", "Applications for alice")
+	if message := receive(t, messages); message != "STATUS=Updating Flatpak (Applications for alice)" {
+		t.Fatalf("Unexpected status: %q", message)
+	}
+	if message := receive(t, messages); message != "WATCHDOG=1\nEXTEND_TIMEOUT_USEC=100000" {
+		t.Fatalf("Unexpected ping: %q", message)
+	}
+
+	// pings stop once nothing got reported for the stall timeout
+	time.Sleep(500 * time.Millisecond)
+	for len(messages) > 0 {
+		<-messages
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(messages) != 0 {
+		t.Fatalf("Expected no pings while stalled, got: %q", <-messages)
+	}
+
+	heartbeat.Touch()
+	if message := receive(t, messages); !strings.HasPrefix(message, "WATCHDOG=1") {
+		t.Fatalf("Expected pings to resume after progress, got: %q", message)
+	}
+
+	// waiting on users doesn't count as a stall
+	done := heartbeat.Wait("Waiting for users to answer the reboot prompt")
+	time.Sleep(500 * time.Millisecond)
+	for len(messages) > 0 {
+		<-messages
+	}
+	if message := receive(t, messages); !strings.HasPrefix(message, "WATCHDOG=1") {
+		t.Fatalf("Expected pings while waiting, got: %q", message)
+	}
+	done()
+	heartbeat.Stop()
+}
@@ -2,6 +2,7 @@ package session
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -17,6 +18,10 @@ type User struct {
 	Name string
 }
 
+// OnOutput gets called for every line a command run with RunLog prints, to tell that it still makes progress.
+// Set it before running any command
+var OnOutput func()
+
 // Runs any specified Command while logging it to the logger
 // Made to work just like (Command).CombinedOutput()
 func RunLog(logger *slog.Logger, level slog.Level, command *exec.Cmd) ([]byte, error) {
@@ -33,21 +38,29 @@ func RunLog(logger *slog.Logger, level slog.Level, command *exec.Cmd) ([]byte, e
 		actualLogger.Warn("Error occurred starting external command", slog.Any("error", err))
 		return []byte{}, err
 	}
+	var output bytes.Buffer
 	scanner := bufio.NewScanner(multiReader)
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
 		actualLogger.Log(context.TODO(), level, scanner.Text())
+		if OnOutput != nil {
+			OnOutput()
+		}
+		output.Write(scanner.Bytes())
+		output.WriteByte('\n')
 	}
 	err = command.Wait()
 	if err != nil {
 		actualLogger.Warn("Error occurred while waiting for external command", slog.Any("error", err))
-		return []byte{}, err
+		// keep the output around so callers can tell what went wrong
+		return output.Bytes(), err
 	}
 
-	return scanner.Bytes(), scanner.Err()
+	return output.Bytes(), scanner.Err()
 }
 
-func RunUID(logger *slog.Logger, level slog.Level, uid int, command []string, env map[string]string) ([]byte, error) {
+// Runs the command as the user with the given UID, wrap is applied to the whole command line (e.g. for resource limits)
+func RunUID(logger *slog.Logger, level slog.Level, uid int, command []string, env map[string]string, wrap func([]string) []string) ([]byte, error) {
 	user, err := osUser.LookupId(fmt.Sprintf("%d", uid))
 
 	if err != nil {
@@ -59,6 +72,9 @@ func RunUID(logger *slog.Logger, level slog.Level, uid int, command []string, en
 		user.Username,
 	}
 	cmdArgs = append(cmdArgs, command...)
+	if wrap != nil {
+		cmdArgs = wrap(cmdArgs)
+	}
 
 	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
 
@@ -110,12 +126,3 @@ func ListUsers() ([]User, error) {
 	}
 	return users, nil
 }
-
-func Notify(users []User, summary string, body string, urgency string) error {
-	for _, user := range users {
-		// we don't care if these exit
-		cmd := exec.Command("/usr/bin/machinectl", "shell", fmt.Sprintf("%d@", user.UID), "/usr/bin/notify-send", "--urgency", urgency, "--app-name", "uupd", summary, body)
-		_ = cmd.Run()
-	}
-	return nil
-}
@@ -0,0 +1,131 @@
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ublue-os/uupd/pkg/imageref"
+)
+
+const cosignSignatureAnnotation string = "dev.cosignproject.cosign/signature"
+
+// The simple signing payload cosign signs
+type payload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+type signatureManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// SignatureTag returns where cosign stores the signatures of an image digest: "<repository>:sha256-<hex>.sig"
+func SignatureTag(image string, digest string) string {
+	return imageref.Repository(image) + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+func parsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key isn't PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type: %T, only ECDSA keys are supported", key)
+	}
+	return ecdsaKey, nil
+}
+
+// VerifyPayload checks that a cosign payload is signed by the public key (PEM) and refers to the digest
+func VerifyPayload(publicKey []byte, data []byte, signature string, digest string) error {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	rawSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature isn't base64 encoded: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(key, hash[:], rawSignature) {
+		return errors.New("signature doesn't match the public key")
+	}
+
+	var signed payload
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("unable to parse signed payload: %w", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s, not %s", signed.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
+
+// VerifyCosign pulls the cosign signatures of the image digest with skopeo and checks that one of them is signed by the key
+func VerifyCosign(skopeoPath string, image string, digest string, publicKeyPath string) error {
+	publicKey, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "uupd-signature-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	tag := SignatureTag(image, digest)
+	cmd := exec.Command(skopeoPath, "copy", "--quiet", "docker://"+tag, "dir:"+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to fetch signatures from %s: %v, %s", tag, err, strings.TrimSpace(string(out)))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	var manifest signatureManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("unable to parse signature manifest: %w", err)
+	}
+
+	err = fmt.Errorf("no signatures found in %s", tag)
+	for _, layer := range manifest.Layers {
+		signature, exists := layer.Annotations[cosignSignatureAnnotation]
+		if !exists {
+			continue
+		}
+		// the dir transport names blobs after their digest, without the algorithm
+		_, hex, _ := strings.Cut(layer.Digest, ":")
+		data, readErr := os.ReadFile(filepath.Join(dir, hex))
+		if readErr != nil {
+			err = readErr
+			continue
+		}
+		if err = VerifyPayload(publicKey, data, signature, digest); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package signature
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ublue-os/uupd/pkg/imageref"
+)
+
+type requirement struct {
+	Type     string   `json:"type"`
+	KeyPath  string   `json:"keyPath"`
+	KeyPaths []string `json:"keyPaths"`
+}
+
+// Policy is the subset of containers-policy.json(5) needed to tell whether images get verified
+type Policy struct {
+	Default    []requirement                       `json:"default"`
+	Transports map[string]map[string][]requirement `json:"transports"`
+}
+
+func ReadPolicy(path string) (Policy, error) {
+	var policy Policy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// scopes lists the docker transport scopes that can apply to an image, most specific first
+func scopes(image string) []string {
+	scopes := []string{image}
+	repository := imageref.Repository(image)
+	if repository != image {
+		scopes = append(scopes, repository)
+	}
+	for i := strings.LastIndex(repository, "/"); i > 0; i = strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+		scopes = append(scopes, repository)
+	}
+	// wildcards only match subdomains, "*.example.com" applies to "registry.example.com"
+	host := strings.Split(strings.Split(repository, ":")[0], ".")
+	for i := 1; i < len(host); i++ {
+		scopes = append(scopes, "*."+strings.Join(host[i:], "."))
+	}
+	return append(scopes, "")
+}
+
+func (p Policy) requirements(image string) []requirement {
+	docker := p.Transports["docker"]
+	for _, scope := range scopes(image) {
+		if requirements, exists := docker[scope]; exists {
+			return requirements
+		}
+	}
+	return p.Default
+}
+
+// SigstoreKeys returns whether pulling the image requires a sigstore signature, and the keys it gets checked against
+func (p Policy) SigstoreKeys(image string) (bool, []string) {
+	enforced := false
+	var keys []string
+	for _, requirement := range p.requirements(image) {
+		if requirement.Type != "sigstoreSigned" {
+			continue
+		}
+		enforced = true
+		if requirement.KeyPath != "" {
+			keys = append(keys, requirement.KeyPath)
+		}
+		keys = append(keys, requirement.KeyPaths...)
+	}
+	return enforced, keys
+}
+
+// SignedTransport tells whether an ostree container reference makes rpm-ostree verify the image
+func SignedTransport(ref string) bool {
+	for _, prefix := range []string{"ostree-image-signed:", "ostree-remote-image:", "ostree-remote-registry:"} {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package signature_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ublue-os/uupd/pkg/signature"
+)
+
+const testPolicy = `{
+	"default": [{"type": "insecureAcceptAnything"}],
+	"transports": {
+		"docker": {
+			"ghcr.io/ublue-os": [{"type": "sigstoreSigned", "keyPath": "/etc/pki/containers/ublue-os.pub"}],
+			"ghcr.io/ublue-os/unsigned": [{"type": "insecureAcceptAnything"}],
+			"*.example.com": [{"type": "sigstoreSigned", "keyPaths": ["/a.pub", "/b.pub"]}]
+		}
+	}
+}`
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(testPolicy), 0644); err != nil {
+		t.Fatalf("unable to write policy: %v", err)
+	}
+	policy, err := signature.ReadPolicy(path)
+	if err != nil {
+		t.Fatalf("unable to read policy: %v", err)
+	}
+
+	cases := []struct {
+		image    string
+		enforced bool
+		keys     []string
+	}{
+		{"ghcr.io/ublue-os/bluefin:stable", true, []string{"/etc/pki/containers/ublue-os.pub"}},
+		{"ghcr.io/ublue-os/unsigned:latest", false, nil},
+		{"registry.example.com/os/image@sha256:1234", true, []string{"/a.pub", "/b.pub"}},
+		{"quay.io/fedora/fedora-bootc:41", false, nil},
+	}
+	for _, c := range cases {
+		enforced, keys := policy.SigstoreKeys(c.image)
+		if enforced != c.enforced || !slices.Equal(keys, c.keys) {
+			t.Fatalf("Policy for %s returned %v %v, expected %v %v", c.image, enforced, keys, c.enforced, c.keys)
+		}
+	}
+}
+
+func TestSignedTransport(t *testing.T) {
+	if !signature.SignedTransport("ostree-image-signed:docker://ghcr.io/ublue-os/bluefin:stable") {
+		t.Fatalf("Signed transport not detected")
+	}
+	if signature.SignedTransport("ostree-unverified-registry:ghcr.io/ublue-os/bluefin:stable") {
+		t.Fatalf("Unverified transport detected as signed")
+	}
+}
+
+// sign returns a throwaway public key (PEM) and a cosign payload for the digest signed with its private key
+func sign(t *testing.T, digest string) ([]byte, []byte, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unable to marshal public key: %v", err)
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"ghcr.io/ublue-os/bluefin"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, digest))
+	hash := sha256.Sum256(payload)
+	rawSignature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("unable to sign payload: %v", err)
+	}
+	return publicKey, payload, base64.StdEncoding.EncodeToString(rawSignature)
+}
+
+func TestVerifyPayload(t *testing.T) {
+	const digest = "sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"
+	publicKey, payload, sig := sign(t, digest)
+
+	if err := signature.VerifyPayload(publicKey, payload, sig, digest); err != nil {
+		t.Fatalf("Valid signature rejected: %v", err)
+	}
+	if err := signature.VerifyPayload(publicKey, payload, sig, "sha256:0000"); err == nil {
+		t.Fatalf("Signature for another digest accepted")
+	}
+	otherKey, _, _ := sign(t, digest)
+	if err := signature.VerifyPayload(otherKey, payload, sig, digest); err == nil {
+		t.Fatalf("Signature accepted with the wrong key")
+	}
+	if err := signature.VerifyPayload(publicKey, append(payload, ' '), sig, digest); err == nil {
+		t.Fatalf("Tampered payload accepted")
+	}
+}
+
+func TestVerifyCosign(t *testing.T) {
+	const digest = "sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"
+	publicKey, payload, sig := sign(t, digest)
+	dir := t.TempDir()
+
+	// what "skopeo copy" writes into a dir: layout for a cosign signature
+	const blob = "1111111111111111111111111111111111111111111111111111111111111111"
+	fixture := filepath.Join(dir, "fixture")
+	if err := os.MkdirAll(fixture, 0755); err != nil {
+		t.Fatalf("unable to create fixture: %v", err)
+	}
+	manifest, _ := json.Marshal(map[string]any{
+		"layers": []map[string]any{{
+			"digest":      "sha256:" + blob,
+			"annotations": map[string]string{"dev.cosignproject.cosign/signature": sig},
+		}},
+	})
+	for name, data := range map[string][]byte{"manifest.json": manifest, blob: payload} {
+		if err := os.WriteFile(filepath.Join(fixture, name), data, 0644); err != nil {
+			t.Fatalf("unable to write fixture: %v", err)
+		}
+	}
+
+	skopeo := filepath.Join(dir, "skopeo")
+	script := fmt.Sprintf("#!/bin/sh\n[ \"$3\" = \"docker://%s\" ] || exit 1\ncp %s/* \"${4#dir:}\"\n", signature.SignatureTag("ghcr.io/ublue-os/bluefin:stable", digest), fixture)
+	if err := os.WriteFile(skopeo, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake skopeo: %v", err)
+	}
+	keyPath := filepath.Join(dir, "cosign.pub")
+	if err := os.WriteFile(keyPath, publicKey, 0644); err != nil {
+		t.Fatalf("unable to write public key: %v", err)
+	}
+
+	if err := signature.VerifyCosign(skopeo, "ghcr.io/ublue-os/bluefin:stable", digest, keyPath); err != nil {
+		t.Fatalf("Valid cosign signature rejected: %v", err)
+	}
+	if err := signature.VerifyCosign(skopeo, "ghcr.io/ublue-os/aurora:stable", digest, keyPath); err == nil {
+		t.Fatalf("Image without signatures accepted")
+	}
+	otherKey, _, _ := sign(t, digest)
+	if err := os.WriteFile(keyPath, otherKey, 0644); err != nil {
+		t.Fatalf("unable to write public key: %v", err)
+	}
+	if err := signature.VerifyCosign(skopeo, "ghcr.io/ublue-os/bluefin:stable", digest, keyPath); err == nil {
+		t.Fatalf("Cosign signature accepted with the wrong key")
+	}
+}
@@ -17,6 +17,7 @@ BuildRequires:  systemd-rpm-macros
 Recommends:     bootc
 Recommends:     distrobox
 Recommends:     flatpak
+Recommends:     nftables
 Requires:       libnotify
 Requires:       systemd
 Provides:       %{name} = %{version}
@@ -37,6 +38,10 @@ install -Dpm 0755 %{name} %{buildroot}%{_bindir}/%{name}
 install -Dpm 644 %{name}.service %{buildroot}%{_unitdir}/%{name}.service
 install -Dpm 644 %{name}-manual.service %{buildroot}%{_unitdir}/%{name}-manual.service
 install -Dpm 644 %{name}.timer %{buildroot}%{_unitdir}/%{name}.timer
+install -Dpm 644 %{name}-notify-pending.service %{buildroot}%{_userunitdir}/%{name}-notify-pending.service
+install -Dpm 644 %{name}-notify-pending.preset %{buildroot}%{_userpresetdir}/50-%{name}-notify-pending.preset
+install -dm 755 %{buildroot}%{_sharedstatedir}/%{name}
+install -Dpm 644 %{name}.catalog %{buildroot}%{_journalcatalogdir}/%{name}.catalog
 install -Dpm 644 %{name}.rules %{buildroot}%{_sysconfdir}/polkit-1/rules.d/%{name}.rules
 install -Dpm 644 config.json %{buildroot}/%{_sysconfdir}/%{name}/config.json
 
@@ -45,15 +50,21 @@ go test -v ./...
 
 %post
 %systemd_post %{name}.timer
+%systemd_user_post %{name}-notify-pending.service
 
 %preun
 %systemd_preun %{name}.timer
+%systemd_user_preun %{name}-notify-pending.service
 
 %files
 %{_bindir}/%{name}
 %{_unitdir}/%{name}.service
 %{_unitdir}/%{name}.timer
 %{_unitdir}/%{name}-manual.service
+%{_userunitdir}/%{name}-notify-pending.service
+%{_userpresetdir}/50-%{name}-notify-pending.preset
+%{_journalcatalogdir}/%{name}.catalog
+%dir %{_sharedstatedir}/%{name}
 %config(noreplace) %{_sysconfdir}/polkit-1/rules.d/%{name}.rules
 %config(noreplace) %{_sysconfdir}/%{name}/config.json
 %changelog